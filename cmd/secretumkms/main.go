@@ -0,0 +1,55 @@
+// secretumkms is a local stand-in for a kms or a PKCS#11 device. It owns
+// the key encryption keys and wraps the server data keys over a unix socket
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+
+	"github.com/danilomarques1/secretumserver/encrypt"
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	godotenv.Load()
+	initKeystore := flag.Bool("init", false, "create the keystore and exit")
+	flag.Parse()
+
+	path := getEnv("KMS_KEYSTORE_PATH", "kms-keystore.json")
+	if *initKeystore {
+		if _, err := encrypt.CreateLocalKeystore(path); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Keystore created at %v\n", path)
+		return
+	}
+	keystore, err := encrypt.LoadLocalKeystore(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	socket := getEnv("KMS_SOCKET", "secretumkms.sock")
+	os.Remove(socket)
+	lis, err := net.Listen("unix", socket)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer lis.Close()
+	if err := os.Chmod(socket, 0600); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Starting kms on %v\n", socket)
+	if err := encrypt.ServeKMS(lis, keystore); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); len(value) > 0 {
+		return value
+	}
+	return fallback
+}
@@ -2,172 +2,201 @@ package encrypt
 
 import (
 	"crypto/aes"
-	"encoding/hex"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
 	"errors"
-	"math"
-	"os"
-	"strings"
 )
 
 var (
-	ErrInvalidKey        = errors.New("Invalid encryption key")
-	ErrInvalidPlainText  = errors.New("Invalid plain text")
-	ErrInvalidCipherText = errors.New("Invalid cipher text")
+	ErrInvalidKey         = errors.New("Invalid encryption key")
+	ErrInvalidPlainText   = errors.New("Invalid plain text")
+	ErrInvalidCipherText  = errors.New("Invalid cipher text")
+	ErrUnsupportedVersion = errors.New("Unsupported cipher text version")
+	ErrAuthentication     = errors.New("Cipher text authentication failed")
 )
 
+// versions of the cipher text envelope. The version is the first byte
+// of the decoded envelope
 const (
-	PlainTextPartSize  = 16
-	CipherTextPartSize = 32
+	// version | key id size | key id | nonce | cipher text | tag
+	VersionGCM byte = 1
+)
+
+const (
+	KeySize   = 32 // AES-256
+	NonceSize = 12
 )
 
 // TODO better name?
 type Encrypt interface {
-	// will return the message encrypted
-	EncryptMessage(plainText string) (string, error)
+	// will return the message encrypted. The associatedData is authenticated
+	// but not encrypted, the same value must be given to decrypt the message
+	EncryptMessage(plainText string, associatedData []byte) (string, error)
 }
 
 type encrypt struct {
-	key []byte
+	keyring *Keyring
 }
 
-func NewEncrypt() (Encrypt, error) {
-	key := os.Getenv("ENCRYPT_KEY")
-	if len(key) == 0 {
-		return nil, ErrInvalidKey
-	}
-	hashedKey, err := hash(key)
-	if err != nil {
-		return nil, err
-	}
-
-	e := &encrypt{}
-	e.key = []byte(hashedKey[:32])
-
-	return e, nil
+func NewEncrypt(keyring *Keyring) Encrypt {
+	return &encrypt{keyring: keyring}
 }
 
-// returns the message encrypted
-func (e *encrypt) EncryptMessage(plainText string) (string, error) {
-	parts, err := e.parsePlainTextParts(plainText)
+// returns the message encrypted with the primary key of the keyring
+func (e *encrypt) EncryptMessage(plainText string, associatedData []byte) (string, error) {
+	e.keyring.lock.RLock()
+	defer e.keyring.lock.RUnlock()
+	if e.keyring.lock.wiped {
+		return "", ErrKeyringWiped
+	}
+	key, err := e.keyring.primaryKey()
 	if err != nil {
 		return "", err
 	}
-	c, err := aes.NewCipher(e.key)
+	gcm, err := newGCM(key.material)
 	if err != nil {
 		return "", err
 	}
 
-	encrypted := make([]byte, 0)
-	for _, block := range parts {
-		dst := make([]byte, aes.BlockSize)
-		src := make([]byte, aes.BlockSize)
-		copy(src, []byte(block))
-		c.Encrypt(dst, src)
-		encrypted = append(encrypted, dst...)
+	nonce := make([]byte, NonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
 	}
 
-	return hex.EncodeToString(encrypted), nil
-}
+	envelope := make([]byte, 0, 2+len(key.Id)+NonceSize+len(plainText)+gcm.Overhead())
+	envelope = append(envelope, VersionGCM, byte(len(key.Id)))
+	envelope = append(envelope, key.Id...)
+	header := envelope
+	envelope = append(envelope, nonce...)
+	envelope = gcm.Seal(envelope, nonce, []byte(plainText), authenticatedData(header, associatedData))
 
-// breaks the plainText into slice of 16 chars each element (the last element may not have 16 chars)
-func (e *encrypt) parsePlainTextParts(plainText string) ([]string, error) {
-	messageSize := len(plainText)
-	if messageSize < PlainTextPartSize {
-		return []string{plainText}, nil
-	}
-	partsSize := int(math.Ceil(float64(messageSize) / float64(PlainTextPartSize)))
-	parts := make([]string, 0, partsSize)
-	start := 0
-	end := PlainTextPartSize
-	for i := 0; i < partsSize; i++ {
-		part := plainText[start:end]
-		parts = append(parts, part)
-
-		start += PlainTextPartSize
-		end += PlainTextPartSize
-		if end > messageSize {
-			end = messageSize
-		}
-	}
-
-	return parts, nil
+	// base64 (instead of hex) guarantees that an envelope is never
+	// mistaken for a legacy cipher text
+	return base64.StdEncoding.EncodeToString(envelope), nil
 }
 
 // TODO better name?
 type Decrypt interface {
-	// will return the message decrypted
-	DecryptMessage(cipherText string) (string, error)
+	// will return the message decrypted. ErrAuthentication is returned
+	// when the cipher text or the associatedData were tampered with
+	DecryptMessage(cipherText string, associatedData []byte) (string, error)
 }
 
 type decrypt struct {
-	key []byte
+	keyring *Keyring
+}
+
+func NewDecrypt(keyring *Keyring) Decrypt {
+	return &decrypt{keyring: keyring}
 }
 
-func NewDecrypt() (Decrypt, error) {
-	key := os.Getenv("ENCRYPT_KEY")
-	if len(key) == 0 {
-		return nil, ErrInvalidKey
+func (d *decrypt) DecryptMessage(cipherText string, associatedData []byte) (string, error) {
+	keyId, header, sealed, err := parseEnvelope(cipherText)
+	if err != nil {
+		return "", err
+	}
+	d.keyring.lock.RLock()
+	defer d.keyring.lock.RUnlock()
+	if d.keyring.lock.wiped {
+		return "", ErrKeyringWiped
 	}
-	hashedKey, err := hash(key)
+	key, err := d.keyring.key(keyId)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	d := &decrypt{}
-	d.key = []byte(hashedKey[:32])
-
-	return d, nil
+	if sealed == nil {
+		if key.legacy == nil {
+			return "", ErrInvalidKey
+		}
+		return decryptLegacy(key.legacy, cipherText)
+	}
+	return decryptGCM(key.material, sealed, authenticatedData(header, associatedData))
 }
 
-func (d *decrypt) DecryptMessage(cipherText string) (string, error) {
-	parts, err := d.parseCipherText(cipherText)
+func decryptGCM(key, envelope, associatedData []byte) (string, error) {
+	gcm, err := newGCM(key)
 	if err != nil {
 		return "", err
 	}
+	if len(envelope) < NonceSize+gcm.Overhead() {
+		return "", ErrInvalidCipherText
+	}
 
-	decryptedMessage := make([]byte, 0)
-	for _, part := range parts {
-		cipherText, err := hex.DecodeString(part)
-		if err != nil {
-			return "", err
-		}
-		c, err := aes.NewCipher(d.key)
-		if err != nil {
-			return "", err
-		}
-		dst := make([]byte, len(cipherText))
-		src := make([]byte, len(cipherText))
-		copy(src, []byte(cipherText))
-		c.Decrypt(dst, src)
-		decryptedMessage = append(decryptedMessage, dst...)
+	nonce, sealed := envelope[:NonceSize], envelope[NonceSize:]
+	plainText, err := gcm.Open(nil, nonce, sealed, associatedData)
+	if err != nil {
+		return "", ErrAuthentication
 	}
-	out := string(decryptedMessage[:])
-	out = strings.ReplaceAll(out, "\x00", "") // removing the null
 
-	return out, nil
+	return string(plainText), nil
+}
+
+// KeyIdOf returns the id of the key cipherText was encrypted with
+func KeyIdOf(cipherText string) (string, error) {
+	keyId, _, _, err := parseEnvelope(cipherText)
+	return keyId, err
 }
 
-// returns the cipherText as blocks of 32 chars
-func (d *decrypt) parseCipherText(cipherText string) ([]string, error) {
-	cipherTextSize := len(cipherText)
-	if cipherTextSize < CipherTextPartSize {
-		return nil, ErrInvalidCipherText
+// returns the key id, the authenticated header and the
+// nonce | cipher text | tag part of the envelope. The sealed part is nil
+// for legacy cipher texts
+func parseEnvelope(cipherText string) (string, []byte, []byte, error) {
+	if isLegacyCipherText(cipherText) {
+		return DefaultKeyId, nil, nil, nil
+	}
+
+	envelope, err := base64.StdEncoding.DecodeString(cipherText)
+	if err != nil || len(envelope) == 0 {
+		return "", nil, nil, ErrInvalidCipherText
 	}
 
-	start := 0
-	end := CipherTextPartSize
-	parts := make([]string, 0)
-	partsSize := int(math.Ceil(float64(cipherTextSize) / float64(CipherTextPartSize)))
-	for i := 0; i < partsSize; i++ {
-		part := cipherText[start:end]
-		parts = append(parts, part)
-
-		start += CipherTextPartSize
-		end += CipherTextPartSize
-		if end > cipherTextSize {
-			end = cipherTextSize
+	switch envelope[0] {
+	case VersionGCM:
+		if len(envelope) < 2 {
+			return "", nil, nil, ErrInvalidCipherText
 		}
+		size := int(envelope[1])
+		if size == 0 || len(envelope) < 2+size {
+			return "", nil, nil, ErrInvalidCipherText
+		}
+		return string(envelope[2 : 2+size]), envelope[:2+size], envelope[2+size:], nil
+	default:
+		return "", nil, nil, ErrUnsupportedVersion
 	}
+}
+
+// the envelope header is authenticated along with the caller data so the
+// key id can not be swapped
+func authenticatedData(header, associatedData []byte) []byte {
+	data := make([]byte, 0, len(header)+len(associatedData))
+	data = append(data, header...)
+	return append(data, associatedData...)
+}
+
+// returns the data that binds a cipher text to the entry it belongs to,
+// so a cipher text can not be copied over to another entry or master
+func AssociatedData(masterId, key string) []byte {
+	data := make([]byte, 0, len(masterId)+len(key)+1)
+	data = append(data, masterId...)
+	data = append(data, 0)
+	data = append(data, key...)
+	return data
+}
 
-	return parts, nil
+// like AssociatedData for the other encrypted fields of an entry, so they
+// can not be swapped with the password or with each other
+func FieldAssociatedData(masterId, key, field string) []byte {
+	data := AssociatedData(masterId, key)
+	data = append(data, 0)
+	return append(data, field...)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(c)
 }
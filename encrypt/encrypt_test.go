@@ -17,26 +17,26 @@ func TestEncrypt(t *testing.T) {
 		{"Should return the correct output 2", "hold back the river let me look in your eyes", "hold back the river let me look in your eyes"},
 		{"Should return the correct output 3", "the encrypt plain text", "the encrypt plain text"},
 		{"Should return the correct output 4", "Everybody's got their dues in life to pay, oh, oh, oh I know nobody knows Where it comes and where it goes I know it's everybody's sin You got to lose to know how to win", "Everybody's got their dues in life to pay, oh, oh, oh I know nobody knows Where it comes and where it goes I know it's everybody's sin You got to lose to know how to win"},
+		{"Should keep null bytes", "null\x00in the middle\x00", "null\x00in the middle\x00"},
+		{"Should encrypt an empty message", "", ""},
 	}
 
 	for _, tc := range cases {
 		t.Run(tc.label, func(t *testing.T) {
-			e, err := NewEncrypt()
+			keyring, err := LoadKeyring()
 			if err != nil {
 				t.Fatalf("Err should when creating be nil %v\n", err)
 			}
+			e := NewEncrypt(keyring)
+			d := NewDecrypt(keyring)
 
-			d, err := NewDecrypt()
-			if err != nil {
-				t.Fatalf("Err should when decrypting be nil %v\n", err)
-			}
-
-			crypted, err := e.EncryptMessage(tc.input)
+			ad := AssociatedData("master-id", "key")
+			crypted, err := e.EncryptMessage(tc.input, ad)
 			if err != nil {
 				t.Fatalf("Err should when encrypting be nil %v\n", err)
 			}
 
-			decrypted, err := d.DecryptMessage(crypted)
+			decrypted, err := d.DecryptMessage(crypted, ad)
 			if err != nil {
 				t.Fatalf("Err should when decrypting be nil %v\n", err)
 			}
@@ -48,3 +48,90 @@ func TestEncrypt(t *testing.T) {
 		})
 	}
 }
+
+func TestEncryptIsRandomized(t *testing.T) {
+	t.Setenv("ENCRYPT_KEY", "this_is_a_ver_secret_key_that_will_be_used_for_encryption")
+	keyring, err := LoadKeyring()
+	if err != nil {
+		t.Fatalf("Err should when creating be nil %v\n", err)
+	}
+	e := NewEncrypt(keyring)
+
+	ad := AssociatedData("master-id", "key")
+	first, err := e.EncryptMessage("same password", ad)
+	if err != nil {
+		t.Fatalf("Err should when encrypting be nil %v\n", err)
+	}
+	second, err := e.EncryptMessage("same password", ad)
+	if err != nil {
+		t.Fatalf("Err should when encrypting be nil %v\n", err)
+	}
+
+	if first == second {
+		t.Fatalf("Same plain text should not produce the same cipher text %v\n", first)
+	}
+}
+
+func TestDecryptAuthentication(t *testing.T) {
+	t.Setenv("ENCRYPT_KEY", "this_is_a_ver_secret_key_that_will_be_used_for_encryption")
+	keyring, err := LoadKeyring()
+	if err != nil {
+		t.Fatalf("Err should when creating be nil %v\n", err)
+	}
+	e := NewEncrypt(keyring)
+	d := NewDecrypt(keyring)
+
+	ad := AssociatedData("master-id", "github")
+	crypted, err := e.EncryptMessage("hold back the river", ad)
+	if err != nil {
+		t.Fatalf("Err should when encrypting be nil %v\n", err)
+	}
+
+	// flips a char of the authentication tag
+	tampered := []byte(crypted)
+	last := len(tampered) - 4
+	if tampered[last] == 'A' {
+		tampered[last] = 'B'
+	} else {
+		tampered[last] = 'A'
+	}
+
+	cases := []struct {
+		label      string
+		cipherText string
+		ad         []byte
+	}{
+		{"Should fail with a tampered cipher text", string(tampered), ad},
+		{"Should fail with another entry key", crypted, AssociatedData("master-id", "gitlab")},
+		{"Should fail with another master", crypted, AssociatedData("other-master-id", "github")},
+		{"Should fail with another field of the entry", crypted, FieldAssociatedData("master-id", "github", "notes")},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.label, func(t *testing.T) {
+			if _, err := d.DecryptMessage(tc.cipherText, tc.ad); err != ErrAuthentication {
+				t.Fatalf("Err should be %v got %v\n", ErrAuthentication, err)
+			}
+		})
+	}
+}
+
+func TestDecryptLegacy(t *testing.T) {
+	t.Setenv("ENCRYPT_KEY", "this_is_a_ver_secret_key_that_will_be_used_for_encryption")
+	keyring, err := LoadKeyring()
+	if err != nil {
+		t.Fatalf("Err should when creating be nil %v\n", err)
+	}
+	d := NewDecrypt(keyring)
+
+	legacy := "a36e37c2e9ab5656605b0cdadcb6317bd41e0e7e627405948a1330fbf999198d"
+	decrypted, err := d.DecryptMessage(legacy, nil)
+	if err != nil {
+		t.Fatalf("Err should when decrypting be nil %v\n", err)
+	}
+
+	expected := "hold back the river"
+	if decrypted != expected {
+		t.Fatalf("Wrong output expected %v got %v\n", expected, decrypted)
+	}
+}
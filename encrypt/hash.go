@@ -3,9 +3,24 @@ package encrypt
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
 )
 
-// sha256 hashing. We use to hash the encryption key
+const keyDerivationInfo = "secretum aes-256-gcm"
+
+// derives the 256 bits encryption key from a configured secret
+func deriveKey(secret string) ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(secret), nil, []byte(keyDerivationInfo)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// sha256 hashing. We used to hash the encryption key, it is kept to
+// decrypt the legacy cipher texts
 func hash(message string) (string, error) {
 	sha := sha256.New()
 	if _, err := sha.Write([]byte(message)); err != nil {
@@ -0,0 +1,105 @@
+package encrypt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+var (
+	ErrInvalidKdf        = errors.New("Unsupported key derivation function")
+	ErrWeakKdfParams     = errors.New("Key derivation parameters are too weak")
+	ErrInvalidWrappedKey = errors.New("Invalid wrapped vault key")
+)
+
+const KdfArgon2id = "argon2id"
+
+// minimum Argon2id parameters accepted from clients, following the
+// OWASP recommendation of 19 MiB, 2 iterations and 1 degree of parallelism
+const (
+	MinKdfTime       = 2
+	MinKdfMemory     = 19 * 1024 // in KiB
+	MinKdfThreads    = 1
+	MinKdfSaltSize   = 16
+	VaultKeySize     = 32
+	MinWrappedKeyLen = VaultKeySize
+	AuthHashSize     = 32
+)
+
+// the HKDF labels that split the master key the client derives with the
+// kdf params, so the auth hash sent to the server tells nothing about the
+// key that wraps the vault key
+const (
+	AuthHashInfo      = "secretum auth"
+	VaultWrappingInfo = "secretum vault"
+)
+
+// KdfParams are the client side key derivation parameters of a vault
+type KdfParams struct {
+	Algorithm string
+	Salt      []byte
+	Time      uint32
+	Memory    uint32 // in KiB
+	Threads   uint8
+	KeyLength uint32
+}
+
+// DefaultKdfParams returns the parameters handed out for an unknown email,
+// with a salt that is stable for that email so the response does not
+// reveal whether the account exists
+func DefaultKdfParams(secret []byte, email string) KdfParams {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(email))
+
+	return KdfParams{
+		Algorithm: KdfArgon2id,
+		Salt:      mac.Sum(nil)[:MinKdfSaltSize],
+		Time:      3,
+		Memory:    64 * 1024,
+		Threads:   4,
+		KeyLength: VaultKeySize,
+	}
+}
+
+func (p KdfParams) Validate() error {
+	if p.Algorithm != KdfArgon2id {
+		return ErrInvalidKdf
+	}
+	if len(p.Salt) < MinKdfSaltSize || p.Time < MinKdfTime || p.Memory < MinKdfMemory ||
+		p.Threads < MinKdfThreads || p.KeyLength < VaultKeySize {
+		return ErrWeakKdfParams
+	}
+	return nil
+}
+
+// DeriveAuthHash returns what a zero knowledge client sends instead of
+// the master password. The server only keeps a hash of it
+func DeriveAuthHash(masterKey []byte) ([]byte, error) {
+	return expandMasterKey(masterKey, AuthHashInfo, AuthHashSize)
+}
+
+// DeriveVaultWrappingKey returns the key a zero knowledge client wraps the
+// vault key with. It never leaves the client
+func DeriveVaultWrappingKey(masterKey []byte) ([]byte, error) {
+	return expandMasterKey(masterKey, VaultWrappingInfo, VaultKeySize)
+}
+
+func expandMasterKey(masterKey []byte, info string, size int) ([]byte, error) {
+	key := make([]byte, size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, masterKey, nil, []byte(info)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ValidateWrappedKey only checks the size, the wrapping is opaque to the
+// server
+func ValidateWrappedKey(wrapped []byte) error {
+	if len(wrapped) < MinWrappedKeyLen {
+		return ErrInvalidWrappedKey
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package encrypt
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDeriveAuthHash(t *testing.T) {
+	masterKey := bytes.Repeat([]byte{7}, VaultKeySize)
+	authHash, err := DeriveAuthHash(masterKey)
+	if err != nil {
+		t.Fatalf("Err should when deriving the auth hash be nil %v\n", err)
+	}
+	wrappingKey, err := DeriveVaultWrappingKey(masterKey)
+	if err != nil {
+		t.Fatalf("Err should when deriving the wrapping key be nil %v\n", err)
+	}
+
+	if len(authHash) != AuthHashSize || len(wrappingKey) != VaultKeySize {
+		t.Fatalf("Wrong sizes %v %v\n", len(authHash), len(wrappingKey))
+	}
+	if bytes.Equal(authHash, wrappingKey) || bytes.Equal(authHash, masterKey) {
+		t.Fatalf("The auth hash should be neither the wrapping key nor the master key\n")
+	}
+	again, _ := DeriveAuthHash(masterKey)
+	if !bytes.Equal(authHash, again) {
+		t.Fatalf("The auth hash should be deterministic\n")
+	}
+}
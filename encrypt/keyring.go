@@ -0,0 +1,277 @@
+package encrypt
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrNoKeys         = errors.New("No encryption keys configured")
+	ErrUnknownKey     = errors.New("Unknown encryption key")
+	ErrNoPrimaryKey   = errors.New("Keyring has no primary key")
+	ErrKeyNotActive   = errors.New("Encryption key is not active")
+	ErrDuplicatedKey  = errors.New("Encryption key already in the keyring")
+	ErrInvalidKeyId   = errors.New("Invalid encryption key id")
+	ErrInvalidKeySpec = errors.New("Invalid ENCRYPT_KEYS entry, expected id:secret")
+	ErrKeyringWiped   = errors.New("Keyring was wiped")
+)
+
+// DefaultKeyId is the id of the key derived from ENCRYPT_KEY. Legacy
+// cipher texts do not record a key id and belong to this key
+const DefaultKeyId = "default"
+
+type KeyState int
+
+const (
+	// the key can encrypt (when primary) and decrypt
+	KeyActive KeyState = iota
+	// the key can only decrypt, entries using it should be re-encrypted
+	KeyRetired
+)
+
+type Key struct {
+	Id       string
+	State    KeyState
+	material []byte
+	// the key of the legacy cipher texts, only kept for the keys derived
+	// from a secret
+	legacy []byte
+}
+
+// Keyring holds every key a cipher text may have been encrypted with.
+// New messages are always encrypted with the primary key
+type Keyring struct {
+	keys    map[string]*Key
+	primary string
+	// shared with the clones, which share the key material
+	lock *keyringLock
+}
+
+// the messages are encrypted and decrypted under the read lock, so a wipe
+// waits for them and the later ones fail instead of using zeroed keys
+type keyringLock struct {
+	sync.RWMutex
+	wiped bool
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[string]*Key), lock: &keyringLock{}}
+}
+
+// LoadKeyring builds the keyring from the environment:
+//
+//	ENCRYPT_KEY          the original key, registered as DefaultKeyId
+//	ENCRYPT_KEYS         comma separated id:secret pairs
+//	ENCRYPT_PRIMARY_KEY  id of the key used for new writes
+//	ENCRYPT_RETIRED_KEYS comma separated ids that may only decrypt
+//
+// when there is a single key ENCRYPT_PRIMARY_KEY may be omitted
+func LoadKeyring() (*Keyring, error) {
+	k := NewKeyring()
+	retired := make(map[string]bool)
+	for _, id := range splitList(os.Getenv("ENCRYPT_RETIRED_KEYS")) {
+		retired[id] = true
+	}
+	stateOf := func(id string) KeyState {
+		if retired[id] {
+			return KeyRetired
+		}
+		return KeyActive
+	}
+
+	if secret := os.Getenv("ENCRYPT_KEY"); len(secret) > 0 {
+		if err := k.AddSecret(DefaultKeyId, secret, stateOf(DefaultKeyId)); err != nil {
+			return nil, err
+		}
+	}
+	for _, spec := range splitList(os.Getenv("ENCRYPT_KEYS")) {
+		id, secret, found := strings.Cut(spec, ":")
+		if !found || len(id) == 0 || len(secret) == 0 {
+			return nil, ErrInvalidKeySpec
+		}
+		if err := k.AddSecret(id, secret, stateOf(id)); err != nil {
+			return nil, err
+		}
+	}
+	if len(k.keys) == 0 {
+		return nil, ErrNoKeys
+	}
+
+	primary := os.Getenv("ENCRYPT_PRIMARY_KEY")
+	if len(primary) == 0 && len(k.keys) == 1 {
+		for id := range k.keys {
+			primary = id
+		}
+	}
+	if len(primary) == 0 {
+		return nil, ErrNoPrimaryKey
+	}
+	if err := k.SetPrimary(primary); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// AddSecret derives the key material from secret with HKDF-SHA256. The
+// first 32 chars of its hex sha256, which is how ENCRYPT_KEY always was
+// derived, are kept to decrypt the legacy cipher texts
+func (k *Keyring) AddSecret(id, secret string, state KeyState) error {
+	material, err := deriveKey(secret)
+	if err != nil {
+		return err
+	}
+	hashedKey, err := hash(secret)
+	if err != nil {
+		return err
+	}
+	return k.add(id, material, []byte(hashedKey[:KeySize]), state)
+}
+
+func (k *Keyring) Add(id string, material []byte, state KeyState) error {
+	return k.add(id, material, nil, state)
+}
+
+func (k *Keyring) add(id string, material, legacy []byte, state KeyState) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.lock.wiped {
+		return ErrKeyringWiped
+	}
+	if len(id) == 0 || len(id) > 255 {
+		return ErrInvalidKeyId
+	}
+	if len(material) != KeySize || (legacy != nil && len(legacy) != KeySize) {
+		return ErrInvalidKey
+	}
+	if _, ok := k.keys[id]; ok {
+		return fmt.Errorf("%w: %v", ErrDuplicatedKey, id)
+	}
+
+	k.keys[id] = &Key{Id: id, State: state, material: material, legacy: legacy}
+	return nil
+}
+
+func (k *Keyring) SetPrimary(id string) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.lock.wiped {
+		return ErrKeyringWiped
+	}
+	key, err := k.key(id)
+	if err != nil {
+		return err
+	}
+	if key.State != KeyActive {
+		return fmt.Errorf("%w: %v", ErrKeyNotActive, id)
+	}
+
+	k.primary = id
+	return nil
+}
+
+func (k *Keyring) Primary() (*Key, error) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	if k.lock.wiped {
+		return nil, ErrKeyringWiped
+	}
+	return k.primaryKey()
+}
+
+func (k *Keyring) Key(id string) (*Key, error) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	if k.lock.wiped {
+		return nil, ErrKeyringWiped
+	}
+	return k.key(id)
+}
+
+// primaryKey and key must be called holding the lock
+func (k *Keyring) primaryKey() (*Key, error) {
+	if len(k.primary) == 0 {
+		return nil, ErrNoPrimaryKey
+	}
+	return k.key(k.primary)
+}
+
+func (k *Keyring) key(id string) (*Key, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownKey, id)
+	}
+	return key, nil
+}
+
+// Clone returns a copy of the keyring that can get more keys without
+// changing k
+func (k *Keyring) Clone() *Keyring {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	clone := &Keyring{keys: make(map[string]*Key), lock: k.lock}
+	for id, key := range k.keys {
+		clone.keys[id] = key
+	}
+	clone.primary = k.primary
+	return clone
+}
+
+// NeedsReencrypt reports whether cipherText was not encrypted with the
+// primary key or is a legacy cipher text
+func (k *Keyring) NeedsReencrypt(cipherText string) (bool, error) {
+	id, _, sealed, err := parseEnvelope(cipherText)
+	if err != nil {
+		return false, err
+	}
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return id != k.primary || sealed == nil, nil
+}
+
+// Wipe overwrites the key material once the running encryptions are
+// done, the keyring is unusable afterwards. Clones share the material and
+// are wiped as well
+func (k *Keyring) Wipe() {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.lock.wiped = true
+	for _, key := range k.keys {
+		for i := range key.material {
+			key.material[i] = 0
+		}
+		for i := range key.legacy {
+			key.legacy[i] = 0
+		}
+	}
+	k.keys = make(map[string]*Key)
+	k.primary = ""
+}
+
+func (k *Keyring) toFile() *keystoreFile {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	file := &keystoreFile{Primary: k.primary}
+	for _, key := range k.keys {
+		file.Keys = append(file.Keys, keystoreFileKey{
+			Id:      key.Id,
+			Key:     key.material,
+			Legacy:  key.legacy,
+			Retired: key.State == KeyRetired,
+		})
+	}
+	return file
+}
+
+func splitList(list string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,141 @@
+package encrypt
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestKeyringRotation(t *testing.T) {
+	t.Setenv("ENCRYPT_KEY", "")
+	t.Setenv("ENCRYPT_KEYS", "k1:first secret")
+	t.Setenv("ENCRYPT_PRIMARY_KEY", "k1")
+	t.Setenv("ENCRYPT_RETIRED_KEYS", "")
+	oldKeyring, err := LoadKeyring()
+	if err != nil {
+		t.Fatalf("Err should when loading the keyring be nil %v\n", err)
+	}
+
+	ad := AssociatedData("master-id", "github")
+	crypted, err := NewEncrypt(oldKeyring).EncryptMessage("hold back the river", ad)
+	if err != nil {
+		t.Fatalf("Err should when encrypting be nil %v\n", err)
+	}
+
+	t.Setenv("ENCRYPT_KEYS", "k1:first secret,k2:second secret")
+	t.Setenv("ENCRYPT_PRIMARY_KEY", "k2")
+	t.Setenv("ENCRYPT_RETIRED_KEYS", "k1")
+	keyring, err := LoadKeyring()
+	if err != nil {
+		t.Fatalf("Err should when loading the keyring be nil %v\n", err)
+	}
+
+	decrypted, err := NewDecrypt(keyring).DecryptMessage(crypted, ad)
+	if err != nil {
+		t.Fatalf("Err should when decrypting with a retired key be nil %v\n", err)
+	}
+	if decrypted != "hold back the river" {
+		t.Fatalf("Wrong output expected %v got %v\n", "hold back the river", decrypted)
+	}
+
+	needs, err := keyring.NeedsReencrypt(crypted)
+	if err != nil || !needs {
+		t.Fatalf("Cipher text under a retired key should need re-encryption %v %v\n", needs, err)
+	}
+
+	recrypted, err := NewEncrypt(keyring).EncryptMessage(decrypted, ad)
+	if err != nil {
+		t.Fatalf("Err should when encrypting be nil %v\n", err)
+	}
+	if keyId, _ := KeyIdOf(recrypted); keyId != "k2" {
+		t.Fatalf("New cipher texts should use the primary key, got %v\n", keyId)
+	}
+
+	if _, err := NewDecrypt(oldKeyring).DecryptMessage(recrypted, ad); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Err should be %v got %v\n", ErrUnknownKey, err)
+	}
+}
+
+func TestKeyringRetiredKeyCanNotBePrimary(t *testing.T) {
+	t.Setenv("ENCRYPT_KEY", "")
+	t.Setenv("ENCRYPT_KEYS", "k1:first secret")
+	t.Setenv("ENCRYPT_PRIMARY_KEY", "k1")
+	t.Setenv("ENCRYPT_RETIRED_KEYS", "k1")
+	if _, err := LoadKeyring(); !errors.Is(err, ErrKeyNotActive) {
+		t.Fatalf("Err should be %v got %v\n", ErrKeyNotActive, err)
+	}
+}
+
+func TestLegacyCipherTextNeedsReencrypt(t *testing.T) {
+	t.Setenv("ENCRYPT_KEY", "this_is_a_ver_secret_key_that_will_be_used_for_encryption")
+	t.Setenv("ENCRYPT_KEYS", "")
+	t.Setenv("ENCRYPT_PRIMARY_KEY", "")
+	t.Setenv("ENCRYPT_RETIRED_KEYS", "")
+	keyring, err := LoadKeyring()
+	if err != nil {
+		t.Fatalf("Err should when loading the keyring be nil %v\n", err)
+	}
+
+	legacy := "a36e37c2e9ab5656605b0cdadcb6317bd41e0e7e627405948a1330fbf999198d"
+	decrypted, err := NewDecrypt(keyring).DecryptMessage(legacy, nil)
+	if err != nil {
+		t.Fatalf("Err should when decrypting be nil %v\n", err)
+	}
+	if decrypted != "hold back the river" {
+		t.Fatalf("Wrong output expected %v got %v\n", "hold back the river", decrypted)
+	}
+
+	needs, err := keyring.NeedsReencrypt(legacy)
+	if err != nil || !needs {
+		t.Fatalf("Legacy cipher text should need re-encryption %v %v\n", needs, err)
+	}
+	recrypted, err := NewEncrypt(keyring).EncryptMessage(decrypted, nil)
+	if err != nil {
+		t.Fatalf("Err should when encrypting be nil %v\n", err)
+	}
+	if needs, _ := keyring.NeedsReencrypt(recrypted); needs {
+		t.Fatalf("New cipher texts should not need re-encryption\n")
+	}
+}
+
+func TestKeyringWipe(t *testing.T) {
+	keyring := NewKeyring()
+	if err := keyring.AddSecret("k1", "first secret", KeyActive); err != nil {
+		t.Fatalf("Err should when adding the key be nil %v\n", err)
+	}
+	if err := keyring.SetPrimary("k1"); err != nil {
+		t.Fatalf("Err should when setting the primary be nil %v\n", err)
+	}
+	clone := keyring.Clone()
+	crypted, err := NewEncrypt(keyring).EncryptMessage("hold back the river", nil)
+	if err != nil {
+		t.Fatalf("Err should when encrypting be nil %v\n", err)
+	}
+
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			// the messages encrypted before the wipe are intact, the
+			// later ones fail
+			decrypted, err := NewDecrypt(clone).DecryptMessage(crypted, nil)
+			if err == nil && decrypted != "hold back the river" {
+				t.Errorf("Wrong output expected %v got %v\n", "hold back the river", decrypted)
+			} else if err != nil && !errors.Is(err, ErrKeyringWiped) {
+				t.Errorf("Err should be %v got %v\n", ErrKeyringWiped, err)
+			}
+		}()
+	}
+	keyring.Wipe()
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+
+	for _, k := range []*Keyring{keyring, clone} {
+		if _, err := NewEncrypt(k).EncryptMessage("hold back the river", nil); !errors.Is(err, ErrKeyringWiped) {
+			t.Fatalf("Err should when encrypting after the wipe be %v got %v\n", ErrKeyringWiped, err)
+		}
+		if _, err := NewDecrypt(k).DecryptMessage(crypted, nil); !errors.Is(err, ErrKeyringWiped) {
+			t.Fatalf("Err should when decrypting after the wipe be %v got %v\n", ErrKeyringWiped, err)
+		}
+	}
+}
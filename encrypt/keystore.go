@@ -0,0 +1,186 @@
+package encrypt
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidKeystore = errors.New("Invalid keystore file")
+	ErrNoKeystore      = errors.New("The keystore file does not exist, it must be created first")
+	ErrKeystoreExists  = errors.New("The keystore file already exists")
+)
+
+// the layout of the keystore file, also used for the keyrings in the seal
+// file
+type keystoreFile struct {
+	Primary string            `json:"primary"`
+	Keys    []keystoreFileKey `json:"keys"`
+}
+
+type keystoreFileKey struct {
+	Id      string `json:"id"`
+	Key     []byte `json:"key"` // base64 in the file
+	Legacy  []byte `json:"legacy,omitempty"`
+	Retired bool   `json:"retired,omitempty"`
+}
+
+// LocalKeystore is a KeyProvider that keeps the key encryption keys in a
+// json file on the server, or only in memory when it was read from the
+// seal file
+type LocalKeystore struct {
+	path string // empty when in memory
+
+	mu       sync.RWMutex
+	file     keystoreFile
+	provider *keyringProvider
+}
+
+// LoadLocalKeystore reads the keystore at path. A missing file is an
+// error, a new key made up here could not unwrap the data keys wrapped
+// before. See CreateLocalKeystore
+func LoadLocalKeystore(path string) (*LocalKeystore, error) {
+	ks := &LocalKeystore{path: path}
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %v", ErrNoKeystore, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(content, &ks.file); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKeystore, err)
+	}
+	if err := ks.load(); err != nil {
+		return nil, err
+	}
+
+	return ks, nil
+}
+
+// CreateLocalKeystore creates the keystore at path with a new random key,
+// an existing keystore is never replaced
+func CreateLocalKeystore(path string) (*LocalKeystore, error) {
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("%w: %v", ErrKeystoreExists, path)
+	}
+
+	ks := &LocalKeystore{path: path}
+	if _, err := ks.Rotate(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// Rotate generates a new key encryption key, makes it the primary key and
+// retires the previous ones. The data keys must be rewrapped afterwards.
+// An in memory keystore is only changed in memory, see RekeySealFile
+func (ks *LocalKeystore) Rotate() (string, error) {
+	material, err := NewDataKey()
+	if err != nil {
+		return "", err
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	id := fmt.Sprintf("kek-%v-%x", time.Now().UTC().Format("20060102"), suffix)
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	previous := ks.file
+	ks.file.Keys = append([]keystoreFileKey{}, previous.Keys...)
+	for i := range ks.file.Keys {
+		ks.file.Keys[i].Retired = true
+	}
+	ks.file.Keys = append(ks.file.Keys, keystoreFileKey{Id: id, Key: material})
+	ks.file.Primary = id
+	if err := ks.load(); err != nil {
+		ks.file = previous
+		return "", err
+	}
+	if len(ks.path) == 0 {
+		return id, nil
+	}
+
+	return id, ks.save()
+}
+
+func (ks *LocalKeystore) WrapKey(dek, associatedData []byte) (string, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.provider.WrapKey(dek, associatedData)
+}
+
+func (ks *LocalKeystore) UnwrapKey(wrapped string, associatedData []byte) ([]byte, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.provider.UnwrapKey(wrapped, associatedData)
+}
+
+func (ks *LocalKeystore) NeedsRewrap(wrapped string) (bool, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.provider.NeedsRewrap(wrapped)
+}
+
+// Wipe overwrites the key encryption keys
+func (ks *LocalKeystore) Wipe() {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.provider.keyring.Wipe()
+	ks.file = keystoreFile{}
+}
+
+// builds the keyring from the file contents
+func (ks *LocalKeystore) load() error {
+	keyring, err := ks.file.keyring()
+	if err != nil {
+		return err
+	}
+
+	ks.provider = &keyringProvider{keyring: keyring}
+	return nil
+}
+
+func (ks *LocalKeystore) save() error {
+	content, err := json.MarshalIndent(ks.file, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ks.path, content)
+}
+
+// written aside and renamed so a crash never leaves a truncated file
+func writeFileAtomic(path string, content []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (f *keystoreFile) keyring() (*Keyring, error) {
+	keyring := NewKeyring()
+	for _, key := range f.Keys {
+		state := KeyActive
+		if key.Retired {
+			state = KeyRetired
+		}
+		if err := keyring.add(key.Id, key.Key, key.Legacy, state); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidKeystore, err)
+		}
+	}
+	if err := keyring.SetPrimary(f.Primary); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKeystore, err)
+	}
+	return keyring, nil
+}
@@ -0,0 +1,236 @@
+package encrypt
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalKeystoreRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keystore.json")
+	keystore, err := CreateLocalKeystore(path)
+	if err != nil {
+		t.Fatalf("Err should when creating the keystore be nil %v\n", err)
+	}
+
+	dek, _ := NewDataKey()
+	ad := []byte("master-id")
+	wrapped, err := keystore.WrapKey(dek, ad)
+	if err != nil {
+		t.Fatalf("Err should when wrapping be nil %v\n", err)
+	}
+
+	if _, err := keystore.Rotate(); err != nil {
+		t.Fatalf("Err should when rotating be nil %v\n", err)
+	}
+
+	// the rotated keystore must be read back from the file
+	keystore, err = LoadLocalKeystore(path)
+	if err != nil {
+		t.Fatalf("Err should when loading the keystore be nil %v\n", err)
+	}
+	needs, err := keystore.NeedsRewrap(wrapped)
+	if err != nil || !needs {
+		t.Fatalf("Key wrapped with a retired kek should need rewrap %v %v\n", needs, err)
+	}
+
+	unwrapped, err := keystore.UnwrapKey(wrapped, ad)
+	if err != nil {
+		t.Fatalf("Err should when unwrapping be nil %v\n", err)
+	}
+	if !bytes.Equal(unwrapped, dek) {
+		t.Fatalf("Unwrapped key should be the original key\n")
+	}
+
+	if _, err := keystore.UnwrapKey(wrapped, []byte("other-master-id")); err != ErrAuthentication {
+		t.Fatalf("Err should be %v got %v\n", ErrAuthentication, err)
+	}
+}
+
+func TestLocalKeystoreCreation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keystore.json")
+	if _, err := LoadLocalKeystore(path); !errors.Is(err, ErrNoKeystore) {
+		t.Fatalf("Err should without a keystore file be %v got %v\n", ErrNoKeystore, err)
+	}
+
+	keystore, err := CreateLocalKeystore(path)
+	if err != nil {
+		t.Fatalf("Err should when creating the keystore be nil %v\n", err)
+	}
+	dek, _ := NewDataKey()
+	wrapped, err := keystore.WrapKey(dek, nil)
+	if err != nil {
+		t.Fatalf("Err should when wrapping be nil %v\n", err)
+	}
+
+	// the key the data keys were wrapped with is never replaced
+	if _, err := CreateLocalKeystore(path); !errors.Is(err, ErrKeystoreExists) {
+		t.Fatalf("Err should with a keystore file be %v got %v\n", ErrKeystoreExists, err)
+	}
+	keystore, err = LoadLocalKeystore(path)
+	if err != nil {
+		t.Fatalf("Err should when loading the keystore be nil %v\n", err)
+	}
+	if unwrapped, err := keystore.UnwrapKey(wrapped, nil); err != nil || !bytes.Equal(unwrapped, dek) {
+		t.Fatalf("Unwrapped key should be the original key %v\n", err)
+	}
+}
+
+// answers every unwrap with a key of the wrong size
+type shortKeyProvider struct {
+	KeyProvider
+}
+
+func (p shortKeyProvider) UnwrapKey(wrapped string, associatedData []byte) ([]byte, error) {
+	return make([]byte, KeySize/2), nil
+}
+
+func TestKMSProvider(t *testing.T) {
+	keystore, err := CreateLocalKeystore(filepath.Join(t.TempDir(), "keystore.json"))
+	if err != nil {
+		t.Fatalf("Err should when creating the keystore be nil %v\n", err)
+	}
+
+	socket := filepath.Join(t.TempDir(), "kms.sock")
+	lis, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Err should when listening be nil %v\n", err)
+	}
+	defer lis.Close()
+	go ServeKMS(lis, keystore)
+
+	kms := NewKMSProvider(socket)
+	dek, _ := NewDataKey()
+	ad := []byte("master-id")
+	wrapped, err := kms.WrapKey(dek, ad)
+	if err != nil {
+		t.Fatalf("Err should when wrapping be nil %v\n", err)
+	}
+	unwrapped, err := kms.UnwrapKey(wrapped, ad)
+	if err != nil {
+		t.Fatalf("Err should when unwrapping be nil %v\n", err)
+	}
+	if !bytes.Equal(unwrapped, dek) {
+		t.Fatalf("Unwrapped key should be the original key\n")
+	}
+
+	if _, err := kms.UnwrapKey(wrapped, []byte("other-master-id")); err == nil {
+		t.Fatalf("Err should not be nil when unwrapping with another owner\n")
+	}
+
+	shortSocket := filepath.Join(t.TempDir(), "short.sock")
+	shortLis, err := net.Listen("unix", shortSocket)
+	if err != nil {
+		t.Fatalf("Err should when listening be nil %v\n", err)
+	}
+	defer shortLis.Close()
+	go ServeKMS(shortLis, shortKeyProvider{keystore})
+	if _, err := NewKMSProvider(shortSocket).UnwrapKey(wrapped, ad); err != ErrInvalidKey {
+		t.Fatalf("Err should when the kms returns a short key be %v got %v\n", ErrInvalidKey, err)
+	}
+}
+
+func TestSealFile(t *testing.T) {
+	keystore, err := CreateLocalKeystore(filepath.Join(t.TempDir(), "keystore.json"))
+	if err != nil {
+		t.Fatalf("Err should when creating the keystore be nil %v\n", err)
+	}
+	dek, _ := NewDataKey()
+	ad := []byte("master-id")
+	wrapped, err := keystore.WrapKey(dek, ad)
+	if err != nil {
+		t.Fatalf("Err should when wrapping be nil %v\n", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "seal.json")
+	rootKey, _ := NewDataKey()
+	if err := WriteSealFile(path, NewKeyBundle(nil, keystore), rootKey, 5, 3); err != nil {
+		t.Fatalf("Err should when writing the seal file be nil %v\n", err)
+	}
+	sealFile, err := ReadSealFile(path)
+	if err != nil {
+		t.Fatalf("Err should when reading the seal file be nil %v\n", err)
+	}
+
+	wrongKey, _ := NewDataKey()
+	if _, err := sealFile.Open(wrongKey); err != ErrAuthentication {
+		t.Fatalf("Err should be %v got %v\n", ErrAuthentication, err)
+	}
+
+	bundle, err := sealFile.Open(rootKey)
+	if err != nil {
+		t.Fatalf("Err should when opening the seal file be nil %v\n", err)
+	}
+	sealedKeystore, err := bundle.LocalKeystore()
+	if err != nil {
+		t.Fatalf("Err should when loading the keystore be nil %v\n", err)
+	}
+	unwrapped, err := sealedKeystore.UnwrapKey(wrapped, ad)
+	if err != nil {
+		t.Fatalf("Err should when unwrapping be nil %v\n", err)
+	}
+	if !bytes.Equal(unwrapped, dek) {
+		t.Fatalf("Unwrapped key should be the original key\n")
+	}
+}
+
+func TestRekeySealFile(t *testing.T) {
+	keystore, err := CreateLocalKeystore(filepath.Join(t.TempDir(), "keystore.json"))
+	if err != nil {
+		t.Fatalf("Err should when creating the keystore be nil %v\n", err)
+	}
+	dek, _ := NewDataKey()
+	ad := []byte("master-id")
+	wrapped, err := keystore.WrapKey(dek, ad)
+	if err != nil {
+		t.Fatalf("Err should when wrapping be nil %v\n", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "seal.json")
+	rootKey, _ := NewDataKey()
+	if err := WriteSealFile(path, NewKeyBundle(nil, keystore), rootKey, 5, 3); err != nil {
+		t.Fatalf("Err should when writing the seal file be nil %v\n", err)
+	}
+
+	wrongKey, _ := NewDataKey()
+	if _, err := RekeySealFile(path, wrongKey); err != ErrAuthentication {
+		t.Fatalf("Err should be %v got %v\n", ErrAuthentication, err)
+	}
+	id, err := RekeySealFile(path, rootKey)
+	if err != nil {
+		t.Fatalf("Err should when rekeying the seal file be nil %v\n", err)
+	}
+
+	// the same root key opens the rewritten seal file
+	sealFile, err := ReadSealFile(path)
+	if err != nil {
+		t.Fatalf("Err should when reading the seal file be nil %v\n", err)
+	}
+	if sealFile.Shares != 5 || sealFile.Threshold != 3 {
+		t.Fatalf("The shares should be kept, got %v of %v\n", sealFile.Threshold, sealFile.Shares)
+	}
+	bundle, err := sealFile.Open(rootKey)
+	if err != nil {
+		t.Fatalf("Err should when opening the seal file be nil %v\n", err)
+	}
+	if bundle.Keystore.Primary != id {
+		t.Fatalf("The new kek should be the primary key, expected %v got %v\n", id, bundle.Keystore.Primary)
+	}
+	sealedKeystore, err := bundle.LocalKeystore()
+	if err != nil {
+		t.Fatalf("Err should when loading the keystore be nil %v\n", err)
+	}
+	needs, err := sealedKeystore.NeedsRewrap(wrapped)
+	if err != nil || !needs {
+		t.Fatalf("Key wrapped with a retired kek should need rewrap %v %v\n", needs, err)
+	}
+	unwrapped, err := sealedKeystore.UnwrapKey(wrapped, ad)
+	if err != nil {
+		t.Fatalf("Err should when unwrapping be nil %v\n", err)
+	}
+	if !bytes.Equal(unwrapped, dek) {
+		t.Fatalf("Unwrapped key should be the original key\n")
+	}
+}
@@ -0,0 +1,137 @@
+package encrypt
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+// the kms stub runs as a separate process that owns the key encryption
+// keys, the server only talks to it over a unix socket. One json request
+// and one json response are exchanged per connection
+const (
+	kmsOpWrap        = "wrap"
+	kmsOpUnwrap      = "unwrap"
+	kmsOpNeedsRewrap = "needs_rewrap"
+
+	kmsTimeout = 5 * time.Second
+)
+
+type kmsRequest struct {
+	Op             string `json:"op"`
+	Key            []byte `json:"key,omitempty"`
+	Wrapped        string `json:"wrapped,omitempty"`
+	AssociatedData []byte `json:"associated_data,omitempty"`
+}
+
+type kmsResponse struct {
+	Key         []byte `json:"key,omitempty"`
+	Wrapped     string `json:"wrapped,omitempty"`
+	NeedsRewrap bool   `json:"needs_rewrap,omitempty"`
+	Err         string `json:"error,omitempty"`
+}
+
+// KMSProvider is a KeyProvider backed by the kms process listening on a
+// unix socket
+type KMSProvider struct {
+	socket string
+}
+
+func NewKMSProvider(socket string) *KMSProvider {
+	return &KMSProvider{socket: socket}
+}
+
+func (p *KMSProvider) WrapKey(dek, associatedData []byte) (string, error) {
+	response, err := p.call(&kmsRequest{Op: kmsOpWrap, Key: dek, AssociatedData: associatedData})
+	if err != nil {
+		return "", err
+	}
+	return response.Wrapped, nil
+}
+
+func (p *KMSProvider) UnwrapKey(wrapped string, associatedData []byte) ([]byte, error) {
+	response, err := p.call(&kmsRequest{Op: kmsOpUnwrap, Wrapped: wrapped, AssociatedData: associatedData})
+	if err != nil {
+		return nil, err
+	}
+	// the data keys are always KeySize, anything else is a kms gone wrong
+	if len(response.Key) != KeySize {
+		return nil, ErrInvalidKey
+	}
+	return response.Key, nil
+}
+
+func (p *KMSProvider) NeedsRewrap(wrapped string) (bool, error) {
+	response, err := p.call(&kmsRequest{Op: kmsOpNeedsRewrap, Wrapped: wrapped})
+	if err != nil {
+		return false, err
+	}
+	return response.NeedsRewrap, nil
+}
+
+func (p *KMSProvider) call(request *kmsRequest) (*kmsResponse, error) {
+	conn, err := net.DialTimeout("unix", p.socket, kmsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(kmsTimeout))
+
+	if err := json.NewEncoder(conn).Encode(request); err != nil {
+		return nil, err
+	}
+	response := &kmsResponse{}
+	if err := json.NewDecoder(conn).Decode(response); err != nil {
+		return nil, err
+	}
+	if len(response.Err) > 0 {
+		return nil, errors.New(response.Err)
+	}
+
+	return response, nil
+}
+
+// ServeKMS answers the KMSProvider requests with provider until lis is
+// closed
+func ServeKMS(lis net.Listener, provider KeyProvider) error {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return err
+		}
+		go handleKMSConn(conn, provider)
+	}
+}
+
+func handleKMSConn(conn net.Conn, provider KeyProvider) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(kmsTimeout))
+
+	request := &kmsRequest{}
+	if err := json.NewDecoder(conn).Decode(request); err != nil {
+		log.Printf("Error decoding kms request %v\n", err)
+		return
+	}
+
+	response := &kmsResponse{}
+	var err error
+	switch request.Op {
+	case kmsOpWrap:
+		response.Wrapped, err = provider.WrapKey(request.Key, request.AssociatedData)
+	case kmsOpUnwrap:
+		response.Key, err = provider.UnwrapKey(request.Wrapped, request.AssociatedData)
+	case kmsOpNeedsRewrap:
+		response.NeedsRewrap, err = provider.NeedsRewrap(request.Wrapped)
+	default:
+		err = errors.New("Unknown kms operation")
+	}
+	if err != nil {
+		response.Err = err.Error()
+	}
+
+	if err := json.NewEncoder(conn).Encode(response); err != nil {
+		log.Printf("Error encoding kms response %v\n", err)
+	}
+}
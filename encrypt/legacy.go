@@ -0,0 +1,80 @@
+package encrypt
+
+import (
+	"crypto/aes"
+	"encoding/hex"
+	"math"
+	"strings"
+)
+
+// legacy cipher texts were produced by encrypting each 16 bytes block
+// with aes and hex encoding the result. They are only decrypted, new
+// messages are always sealed with VersionGCM
+const (
+	CipherTextPartSize = 32
+)
+
+// a legacy cipher text is lower case hex with a whole number of blocks
+func isLegacyCipherText(cipherText string) bool {
+	if len(cipherText) == 0 || len(cipherText)%CipherTextPartSize != 0 {
+		return false
+	}
+	for _, c := range cipherText {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func decryptLegacy(key []byte, cipherText string) (string, error) {
+	parts, err := parseCipherText(cipherText)
+	if err != nil {
+		return "", err
+	}
+
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	decryptedMessage := make([]byte, 0)
+	for _, part := range parts {
+		cipherText, err := hex.DecodeString(part)
+		if err != nil {
+			return "", err
+		}
+		dst := make([]byte, len(cipherText))
+		c.Decrypt(dst, cipherText)
+		decryptedMessage = append(decryptedMessage, dst...)
+	}
+	out := string(decryptedMessage[:])
+	out = strings.TrimRight(out, "\x00") // removing the zero padding
+
+	return out, nil
+}
+
+// returns the cipherText as blocks of 32 chars
+func parseCipherText(cipherText string) ([]string, error) {
+	cipherTextSize := len(cipherText)
+	if cipherTextSize < CipherTextPartSize {
+		return nil, ErrInvalidCipherText
+	}
+
+	start := 0
+	end := CipherTextPartSize
+	parts := make([]string, 0)
+	partsSize := int(math.Ceil(float64(cipherTextSize) / float64(CipherTextPartSize)))
+	for i := 0; i < partsSize; i++ {
+		part := cipherText[start:end]
+		parts = append(parts, part)
+
+		start += CipherTextPartSize
+		end += CipherTextPartSize
+		if end > cipherTextSize {
+			end = cipherTextSize
+		}
+	}
+
+	return parts, nil
+}
@@ -0,0 +1,82 @@
+package encrypt
+
+import (
+	"crypto/rand"
+	"errors"
+	"os"
+)
+
+var (
+	ErrUnknownKeyProvider = errors.New("Unknown KEY_PROVIDER")
+)
+
+// KeyProvider wraps the per master data encryption keys (DEK) with a key
+// encryption key (KEK) it never hands out. Rotating the KEK only requires
+// rewrapping the DEKs, the passwords encrypted with them are left alone
+type KeyProvider interface {
+	// returns the dek encrypted with the primary kek. The associatedData
+	// binds the wrapped key to its owner
+	WrapKey(dek, associatedData []byte) (string, error)
+	UnwrapKey(wrapped string, associatedData []byte) ([]byte, error)
+	// reports whether wrapped was not wrapped by the primary kek
+	NeedsRewrap(wrapped string) (bool, error)
+}
+
+// NewDataKey returns a random data encryption key
+func NewDataKey() ([]byte, error) {
+	dek := make([]byte, KeySize)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, err
+	}
+	return dek, nil
+}
+
+// keyringProvider wraps the data keys with the keys of a keyring
+type keyringProvider struct {
+	keyring *Keyring
+}
+
+func (p *keyringProvider) WrapKey(dek, associatedData []byte) (string, error) {
+	return NewEncrypt(p.keyring).EncryptMessage(string(dek), associatedData)
+}
+
+func (p *keyringProvider) UnwrapKey(wrapped string, associatedData []byte) ([]byte, error) {
+	dek, err := NewDecrypt(p.keyring).DecryptMessage(wrapped, associatedData)
+	if err != nil {
+		return nil, err
+	}
+	if len(dek) != KeySize {
+		return nil, ErrInvalidKey
+	}
+	return []byte(dek), nil
+}
+
+func (p *keyringProvider) NeedsRewrap(wrapped string) (bool, error) {
+	return p.keyring.NeedsReencrypt(wrapped)
+}
+
+// KEY_PROVIDER values
+const (
+	KeyProviderLocal = "local"
+	KeyProviderKMS   = "kms"
+)
+
+// LoadKeyProvider returns the provider chosen by KEY_PROVIDER. The local
+// keystore is read from KEYSTORE_PATH and the kms is reached at KMS_SOCKET
+func LoadKeyProvider() (KeyProvider, error) {
+	switch os.Getenv("KEY_PROVIDER") {
+	case "", KeyProviderLocal:
+		return LoadLocalKeystore(getEnv("KEYSTORE_PATH", "keystore.json"))
+	case KeyProviderKMS:
+		return NewKMSProvider(getEnv("KMS_SOCKET", "secretumkms.sock")), nil
+	default:
+		return nil, ErrUnknownKeyProvider
+	}
+}
+
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); len(value) > 0 {
+		return value
+	}
+	return fallback
+}
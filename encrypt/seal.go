@@ -0,0 +1,177 @@
+package encrypt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var (
+	ErrInvalidSealFile  = errors.New("Invalid seal file")
+	ErrSealFileExists   = errors.New("Seal file already exists")
+	ErrNoSealedKeystore = errors.New("The seal file has no keystore, the key encryption keys are kept by the kms")
+)
+
+const rootKeyId = "root"
+
+// SealFile holds the server keys encrypted with the root key. The root key
+// itself is never stored, it is split in shares handed to the operators
+type SealFile struct {
+	Shares    int    `json:"shares"`
+	Threshold int    `json:"threshold"`
+	Keys      string `json:"keys"` // the KeyBundle sealed with the root key
+}
+
+// KeyBundle is every key the server would otherwise read from the
+// environment or from the local keystore file
+type KeyBundle struct {
+	Legacy   *keystoreFile `json:"legacy,omitempty"`
+	Keystore *keystoreFile `json:"keystore,omitempty"`
+}
+
+func NewKeyBundle(legacy *Keyring, keystore *LocalKeystore) *KeyBundle {
+	bundle := &KeyBundle{}
+	if legacy != nil {
+		bundle.Legacy = legacy.toFile()
+	}
+	bundle.setKeystore(keystore)
+	return bundle
+}
+
+func (b *KeyBundle) setKeystore(keystore *LocalKeystore) {
+	if keystore == nil {
+		return
+	}
+	keystore.mu.RLock()
+	b.Keystore = keystore.provider.keyring.toFile()
+	keystore.mu.RUnlock()
+}
+
+// LegacyKeyring returns nil when the bundle has no legacy keys
+func (b *KeyBundle) LegacyKeyring() (*Keyring, error) {
+	if b.Legacy == nil {
+		return nil, nil
+	}
+	return b.Legacy.keyring()
+}
+
+// LocalKeystore returns an in memory keystore, nil when the keys are kept
+// by the kms
+func (b *KeyBundle) LocalKeystore() (*LocalKeystore, error) {
+	if b.Keystore == nil {
+		return nil, nil
+	}
+	ks := &LocalKeystore{file: *b.Keystore}
+	if err := ks.load(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// WriteSealFile seals bundle with rootKey and writes it to path, which
+// must not exist yet
+func WriteSealFile(path string, bundle *KeyBundle, rootKey []byte, shares, threshold int) error {
+	if _, err := os.Stat(path); err == nil {
+		return ErrSealFileExists
+	}
+
+	sealFile := &SealFile{Shares: shares, Threshold: threshold}
+	return sealFile.write(path, bundle, rootKey)
+}
+
+// RekeySealFile adds a new primary key encryption key to the keystore of
+// the seal file at path and writes it back. The root key, and so its
+// shares, stay the same. The data keys must be rewrapped afterwards
+func RekeySealFile(path string, rootKey []byte) (string, error) {
+	sealFile, err := ReadSealFile(path)
+	if err != nil {
+		return "", err
+	}
+	bundle, err := sealFile.Open(rootKey)
+	if err != nil {
+		return "", err
+	}
+	keystore, err := bundle.LocalKeystore()
+	if err != nil {
+		return "", err
+	}
+	if keystore == nil {
+		return "", ErrNoSealedKeystore
+	}
+	defer keystore.Wipe()
+
+	id, err := keystore.Rotate()
+	if err != nil {
+		return "", err
+	}
+	bundle.setKeystore(keystore)
+	if err := sealFile.write(path, bundle, rootKey); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// seals bundle with rootKey and writes the seal file to path
+func (s *SealFile) write(path string, bundle *KeyBundle, rootKey []byte) error {
+	content, err := json.Marshal(bundle)
+	if err != nil {
+		return err
+	}
+	keyring, err := rootKeyring(rootKey)
+	if err != nil {
+		return err
+	}
+	sealed, err := NewEncrypt(keyring).EncryptMessage(string(content), []byte(rootKeyId))
+	if err != nil {
+		return err
+	}
+
+	s.Keys = sealed
+	content, err = json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, content)
+}
+
+func ReadSealFile(path string) (*SealFile, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sealFile := &SealFile{}
+	if err := json.Unmarshal(content, sealFile); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSealFile, err)
+	}
+	return sealFile, nil
+}
+
+// Open returns the key bundle. ErrAuthentication means rootKey is wrong
+func (s *SealFile) Open(rootKey []byte) (*KeyBundle, error) {
+	keyring, err := rootKeyring(rootKey)
+	if err != nil {
+		return nil, err
+	}
+	content, err := NewDecrypt(keyring).DecryptMessage(s.Keys, []byte(rootKeyId))
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := &KeyBundle{}
+	if err := json.Unmarshal([]byte(content), bundle); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSealFile, err)
+	}
+	return bundle, nil
+}
+
+func rootKeyring(rootKey []byte) (*Keyring, error) {
+	keyring := NewKeyring()
+	if err := keyring.Add(rootKeyId, rootKey, KeyActive); err != nil {
+		return nil, err
+	}
+	if err := keyring.SetPrimary(rootKeyId); err != nil {
+		return nil, err
+	}
+	return keyring, nil
+}
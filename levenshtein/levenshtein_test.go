@@ -0,0 +1,27 @@
+package levenshtein
+
+import "testing"
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		a        string
+		b        string
+		distance int
+	}{
+		{"", "", 0},
+		{"github", "", 6},
+		{"", "github", 6},
+		{"github", "github", 0},
+		{"github", "gihtub", 2},
+		{"github", "githb", 1},
+		{"github", "gitlab", 2},
+		{"kitten", "sitting", 3},
+		{"senha", "señha", 1},
+	}
+
+	for _, test := range tests {
+		if distance := Distance([]rune(test.a), []rune(test.b)); distance != test.distance {
+			t.Fatalf("Wrong distance between %v and %v expected %v got %v\n", test.a, test.b, test.distance, distance)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package mail
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileMailer writes each message to an .eml file instead of sending it
+type FileMailer struct {
+	dir  string
+	from string
+}
+
+func NewFileMailer(dir, from string) *FileMailer {
+	return &FileMailer{dir: dir, from: from}
+}
+
+func (m *FileMailer) Send(msg *Message) error {
+	content, err := msg.bytes(m.from)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.dir, 0700); err != nil {
+		return err
+	}
+	// the messages may carry tokens, only the server user reads them
+	name := fmt.Sprintf("%v-%v.eml", time.Now().UTC().Format("20060102T150405"), messageId())
+	return os.WriteFile(filepath.Join(m.dir, name), content, 0600)
+}
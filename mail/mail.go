@@ -0,0 +1,96 @@
+// Package mail sends the transactional emails of the server
+package mail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	DriverSMTP = "smtp"
+	DriverFile = "file"
+)
+
+var (
+	ErrUnknownDriver = errors.New("Unknown mail driver")
+	ErrInvalidHeader = errors.New("Invalid mail header")
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(*Message) error
+}
+
+// LoadMailer returns the mailer selected by MAIL_DRIVER
+//
+//	smtp  sends through SMTP_ADDR, authenticating with SMTP_USERNAME and
+//	      SMTP_PASSWORD when they are set
+//	file  writes every message to a file in MAIL_DIR, the default. Meant
+//	      for development and tests
+//
+// MAIL_FROM is the sender of both
+func LoadMailer() (Mailer, error) {
+	from := getEnv("MAIL_FROM", "secretum@localhost")
+	switch getEnv("MAIL_DRIVER", DriverFile) {
+	case DriverSMTP:
+		return NewSMTPMailer(os.Getenv("SMTP_ADDR"), from, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD")), nil
+	case DriverFile:
+		return NewFileMailer(getEnv("MAIL_DIR", "outbox"), from), nil
+	default:
+		return nil, ErrUnknownDriver
+	}
+}
+
+// the message with its headers, as it goes over the wire
+func (m *Message) bytes(from string) ([]byte, error) {
+	for _, header := range []string{from, m.To, m.Subject} {
+		if strings.ContainsAny(header, "\r\n") {
+			return nil, ErrInvalidHeader
+		}
+	}
+
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "From: %v\r\n", from)
+	fmt.Fprintf(b, "To: %v\r\n", m.To)
+	fmt.Fprintf(b, "Subject: %v\r\n", m.Subject)
+	fmt.Fprintf(b, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(b, "Message-Id: <%v@%v>\r\n", messageId(), domainOf(from))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	// the body lines end with crlf like the headers
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(m.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return b.Bytes(), nil
+}
+
+func messageId() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func domainOf(address string) string {
+	if _, domain, found := strings.Cut(address, "@"); found {
+		return strings.Trim(domain, "> ")
+	}
+	return "localhost"
+}
+
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); len(value) > 0 {
+		return value
+	}
+	return fallback
+}
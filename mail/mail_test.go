@@ -0,0 +1,91 @@
+package mail
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	mailer := NewFileMailer(dir, "secretum@example.com")
+	msg := &Message{To: "john@example.com", Subject: "Verify", Body: "code 1234\n"}
+	if err := mailer.Send(msg); err != nil {
+		t.Fatalf("Err should when sending be nil %v\n", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("There should be a single message got %v %v\n", entries, err)
+	}
+	content, _ := os.ReadFile(dir + "/" + entries[0].Name())
+	if !strings.Contains(string(content), "To: john@example.com\r\n") || !strings.HasSuffix(string(content), "code 1234\r\n") {
+		t.Fatalf("Wrong message content %q\n", content)
+	}
+
+	msg.Subject = "Verify\r\nBcc: eve@example.com"
+	if err := mailer.Send(msg); err != ErrInvalidHeader {
+		t.Fatalf("Err should be %v got %v\n", ErrInvalidHeader, err)
+	}
+}
+
+// a smtp stand-in that accepts a single message
+func TestSMTPMailer(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Err should when listening be nil %v\n", err)
+	}
+	defer lis.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		reply("220 localhost")
+		data := &strings.Builder{}
+		inData := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if inData {
+				if line == ".\r\n" {
+					inData = false
+					received <- data.String()
+					reply("250 ok")
+					continue
+				}
+				data.WriteString(line)
+				continue
+			}
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 localhost")
+			case cmd == "DATA":
+				inData = true
+				reply("354 go on")
+			case cmd == "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+
+	mailer := NewSMTPMailer(lis.Addr().String(), "secretum@example.com", "", "")
+	if err := mailer.Send(&Message{To: "john@example.com", Subject: "Verify", Body: "code 1234"}); err != nil {
+		t.Fatalf("Err should when sending be nil %v\n", err)
+	}
+	if data := <-received; !strings.Contains(data, "Subject: Verify\r\n") {
+		t.Fatalf("Wrong message received %q\n", data)
+	}
+}
@@ -0,0 +1,32 @@
+package mail
+
+import (
+	"net"
+	"net/smtp"
+)
+
+// SMTPMailer sends through a smtp server, upgrading to tls when the server
+// offers STARTTLS
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// without a username the messages are sent unauthenticated
+func NewSMTPMailer(addr, from, username, password string) *SMTPMailer {
+	m := &SMTPMailer{addr: addr, from: from}
+	if len(username) > 0 {
+		host, _, _ := net.SplitHostPort(addr)
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m
+}
+
+func (m *SMTPMailer) Send(msg *Message) error {
+	content, err := msg.bytes(m.from)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, content)
+}
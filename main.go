@@ -1,8 +1,17 @@
 package main
 
 import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
 	"log"
+	"os"
+	"strings"
 
+	"github.com/danilomarques1/secretumserver/encrypt"
+	"github.com/danilomarques1/secretumserver/service"
+	"github.com/danilomarques1/secretumserver/token"
 	"github.com/joho/godotenv"
 )
 
@@ -10,9 +19,145 @@ func main() {
 	if err := godotenv.Load(); err != nil {
 		log.Fatal(err)
 	}
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	server, err := NewServer()
 	if err != nil {
 		log.Fatal(err)
 	}
 	server.Run()
 }
+
+func runCommand(command string, args []string) error {
+	switch command {
+	case "init-keystore":
+		return initKeystore()
+	case "init":
+		return initSeal(args)
+	case "rotate-kek":
+		return rotateKek()
+	case "jwt-key":
+		return generateJwtKey(args)
+	default:
+		return fmt.Errorf("Unknown command %v", command)
+	}
+}
+
+// creates the local keystore with its first key encryption key. The server
+// does not start without it
+func initKeystore() error {
+	path := keystorePath()
+	if _, err := encrypt.CreateLocalKeystore(path); err != nil {
+		return err
+	}
+
+	fmt.Printf("Keystore created at %v\n", path)
+	return nil
+}
+
+// moves the encryption keys to the seal file and prints the shares of its
+// root key, one for each operator
+func initSeal(args []string) error {
+	flags := flag.NewFlagSet("init", flag.ContinueOnError)
+	shares := flags.Int("shares", 5, "number of root key shares")
+	threshold := flags.Int("threshold", 3, "number of shares needed to unseal")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	parts, err := service.InitSeal(*shares, *threshold)
+	if err != nil {
+		return err
+	}
+
+	for i, part := range parts {
+		fmt.Printf("Unseal share %v: %x\n", i+1, part)
+	}
+	fmt.Printf("The vault is sealed, %v of these shares are needed to unseal it.\n", *threshold)
+	fmt.Println("Remove ENCRYPT_KEY, ENCRYPT_KEYS and the local keystore file now.")
+	return nil
+}
+
+// adds a new primary key to the local keystore. The server must then be
+// started with KEK_REWRAP=true so the data keys get wrapped with it
+func rotateKek() error {
+	if _, err := os.Stat(service.SealPath()); err == nil {
+		return rotateSealedKek()
+	}
+	path := keystorePath()
+	keystore, err := encrypt.LoadLocalKeystore(path)
+	if err != nil {
+		return err
+	}
+	id, err := keystore.Rotate()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("New key encryption key %v added to %v\n", id, path)
+	fmt.Println("Start the server with KEK_REWRAP=true to rewrap the data keys")
+	return nil
+}
+
+// adds a new primary key to the keystore in the seal file, reading the
+// unseal shares from the standard input, one per line
+func rotateSealedKek() error {
+	sealFile, err := encrypt.ReadSealFile(service.SealPath())
+	if err != nil {
+		return err
+	}
+
+	shares := make([][]byte, 0, sealFile.Threshold)
+	scanner := bufio.NewScanner(os.Stdin)
+	for len(shares) < sealFile.Threshold {
+		fmt.Printf("Unseal share %v of %v: ", len(shares)+1, sealFile.Threshold)
+		if !scanner.Scan() {
+			return fmt.Errorf("Expected %v unseal shares", sealFile.Threshold)
+		}
+		share, err := hex.DecodeString(strings.TrimSpace(scanner.Text()))
+		if err != nil || len(share) == 0 {
+			return fmt.Errorf("Invalid unseal share")
+		}
+		shares = append(shares, share)
+	}
+
+	id, err := service.RekeySeal(shares)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("New key encryption key %v added to the seal file %v\n", id, service.SealPath())
+	fmt.Println("Restart and unseal the server with KEK_REWRAP=true to rewrap the data keys")
+	return nil
+}
+
+func keystorePath() string {
+	if path := os.Getenv("KEYSTORE_PATH"); len(path) > 0 {
+		return path
+	}
+	return "keystore.json"
+}
+
+// writes a new token signing key to JWT_KEYS_DIR. Tokens are signed with
+// it once JWT_ACTIVE_KID is set to its kid, the previous keys must be kept
+// until the tokens they signed expire
+func generateJwtKey(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: jwt-key <kid>")
+	}
+	dir := os.Getenv("JWT_KEYS_DIR")
+	if len(dir) == 0 {
+		return fmt.Errorf("JWT_KEYS_DIR is not set")
+	}
+
+	path, err := token.GenerateKey(dir, args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("New signing key written to %v\n", path)
+	return nil
+}
@@ -0,0 +1,21 @@
+package model
+
+import "time"
+
+// LoginAttempts are the recent failed logins of an email or of a client
+// address
+type LoginAttempts struct {
+	Id          string      `bson:"_id"`
+	Failures    []time.Time `bson:"failures"` // oldest first
+	LockedUntil time.Time   `bson:"locked_until"`
+	ExpiresAt   time.Time   `bson:"expires_at"`
+}
+
+type AttemptRepository interface {
+	// returns an empty record when the key has no failures
+	Find(key string) (*LoginAttempts, error)
+	// records a failure at, dropping the ones before since
+	AddFailure(key string, at, since, expiresAt time.Time) (*LoginAttempts, error)
+	Lock(key string, until time.Time) error
+	Reset(key string) error
+}
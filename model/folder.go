@@ -0,0 +1,22 @@
+package model
+
+import "time"
+
+// Folder organizes the passwords of a master. The folders at the root
+// have an empty parent id. Names are unique among the siblings
+type Folder struct {
+	Id       string `bson:"id"`
+	Name     string `bson:"name"`
+	ParentId string `bson:"parent_id"`
+}
+
+type FolderRepository interface {
+	FindAll(masterId string) ([]Folder, error)
+	// adds the folder, returning false when a sibling has its name
+	Add(masterId string, folder *Folder) (bool, error)
+	// moves the folder under parentId with the name, returning false
+	// when a sibling there has the name. Used to rename too
+	Move(masterId, id, parentId, name string) (bool, error)
+	// removes the folders and moves their passwords to the trash
+	Remove(masterId string, ids []string, deletedAt time.Time) error
+}
@@ -1,17 +1,147 @@
 package model
 
-import "time"
+import (
+	"errors"
+	"time"
+)
+
+// returned by the repositories when another master has the email
+var ErrDuplicatedEmail = errors.New("Email already used")
 
 type Master struct {
-	Id                string     `bson:"_id"`
-	Email             string     `bson:"email"`
-	Pwd               string     `bson:"password"`
-	PwdExpirationDate time.Time  `bson:"password_expiration_date"`
-	Passwords         []Password `bson:"passwords"`
+	Id                string             `bson:"_id"`
+	Email             string             `bson:"email"`
+	Pwd               string             `bson:"password"`
+	PwdExpirationDate time.Time          `bson:"password_expiration_date"`
+	PwdHistory        []string           `bson:"password_history,omitempty"` // previous hashes, newest first
+	PwdUpdatedAt      time.Time          `bson:"password_updated_at"`
+	GraceLoginsUsed   int                `bson:"grace_logins_used"`
+	Expiration        *ExpirationPolicy  `bson:"expiration_policy,omitempty"` // overrides the server policy
+	Passwords         []Password         `bson:"passwords"`
+	Folders           []Folder           `bson:"folders,omitempty"`
+	Vault             *VaultParams       `bson:"vault,omitempty"`
+	DataKey           *DataKey           `bson:"data_key,omitempty"`
+	TwoFactor         *TwoFactor         `bson:"two_factor,omitempty"`
+	Verification      *EmailVerification `bson:"email_verification,omitempty"`
+	RecoveryKey       string             `bson:"recovery_key,omitempty"` // sha256 of the key
+	EmailChange       *EmailChange       `bson:"email_change,omitempty"`
+	DeletedAt         *time.Time         `bson:"deleted_at,omitempty"`
+	PurgeAt           *time.Time         `bson:"purge_at,omitempty"` // when a deleted master is removed for good
+	TokenGeneration   int64              `bson:"token_generation"`   // bumped when every token of the master is revoked
+}
+
+// EmailChange is an email change waiting for the codes sent to both the
+// current and the new address
+type EmailChange struct {
+	NewEmail     string    `bson:"new_email"`
+	OldEmailCode string    `bson:"old_email_code"` // sha256 of the codes
+	NewEmailCode string    `bson:"new_email_code"`
+	Attempts     int       `bson:"attempts"`
+	ExpiresAt    time.Time `bson:"expires_at"`
+}
+
+// EmailVerification is only set on the masters created since the emails
+// are verified, the older ones count as verified
+type EmailVerification struct {
+	SentAt     time.Time  `bson:"sent_at"`
+	VerifiedAt *time.Time `bson:"verified_at,omitempty"`
+}
+
+func (m *Master) EmailVerified() bool {
+	return m.Verification == nil || m.Verification.VerifiedAt != nil
+}
+
+// TwoFactor is the totp enrollment of a master. It only applies once the
+// master confirms it with a first code
+type TwoFactor struct {
+	Secret        string    `bson:"secret"` // encrypted
+	Confirmed     bool      `bson:"confirmed"`
+	LastStep      int64     `bson:"last_step"`      // the last step a code was accepted for
+	RecoveryCodes []string  `bson:"recovery_codes"` // sha256 of the unused codes
+	EnrolledAt    time.Time `bson:"enrolled_at"`
+}
+
+const (
+	ExpireNever = "never"
+	ExpireDays  = "days"
+	ExpireDate  = "date"
+)
+
+// ExpirationPolicy sets when the master password expires: never, a number
+// of days after it is set or on a fixed date
+type ExpirationPolicy struct {
+	Mode string    `bson:"mode"`
+	Days int       `bson:"days,omitempty"`
+	Date time.Time `bson:"date,omitempty"`
+}
+
+// DataKey is the key the master passwords are encrypted with, stored
+// wrapped by the key provider. Removing it makes the passwords unreadable
+type DataKey struct {
+	Id        string    `bson:"id"`
+	Wrapped   string    `bson:"wrapped"`
+	CreatedAt time.Time `bson:"created_at"`
+}
+
+// VaultParams is only set in zero knowledge mode. The client derives a key
+// from the master password with the kdf parameters and uses it to unwrap
+// the vault key, the server never sees either of them
+type VaultParams struct {
+	KdfAlgorithm string    `bson:"kdf_algorithm"`
+	KdfSalt      []byte    `bson:"kdf_salt"`
+	KdfTime      uint32    `bson:"kdf_time"`
+	KdfMemory    uint32    `bson:"kdf_memory"`
+	KdfThreads   uint8     `bson:"kdf_threads"`
+	KdfKeyLength uint32    `bson:"kdf_key_length"`
+	WrappedKey   []byte    `bson:"wrapped_key"`
+	UpdatedAt    time.Time `bson:"updated_at"`
 }
 
 type MasterRepository interface {
 	Save(*Master) error
+	// the deleted masters are not found
 	FindByEmail(string) (*Master, error)
+	FindById(string) (*Master, error)
 	Update(*Master) error
+	FindDataKeys() ([]Master, error)
+	// sets the data key only if the master still has the given one (or
+	// none when wrapped is empty), returning false otherwise
+	CompareAndSetDataKey(string, string, *DataKey) (bool, error)
+	RemoveDataKey(string) error
+	SetTwoFactor(string, *TwoFactor) error
+	// moves the last step forward, returning false when the step was
+	// already used
+	UseTwoFactorStep(id string, step int64) (bool, error)
+	// removes the recovery code, returning false when it was not there
+	UseRecoveryCode(id, hashedCode string) (bool, error)
+	// nil goes back to the server policy. The password expiration date is
+	// set along with it, unless expiresAt is zero
+	SetExpirationPolicy(id string, policy *ExpirationPolicy, expiresAt time.Time) error
+	// counts a login after the password expired, returning false when the
+	// master already used max of them
+	UseGraceLogin(id string, max int) (bool, error)
+	SetVerificationSent(id string, sentAt time.Time) error
+	// marks the email verified only if it is still the master email,
+	// returning false otherwise
+	VerifyEmail(id, email string, verifiedAt time.Time) (bool, error)
+	SetRecoveryKey(id, hashedKey string) error
+	// updates the master like Update and sets its recovery key, only if
+	// the stored one is still hashedKey. Returns false otherwise
+	UpdateWithRecoveryKey(master *Master, hashedKey string) (bool, error)
+	SetEmailChange(string, *EmailChange) error
+	// counts a wrong code, returning the attempts so far
+	AddEmailChangeAttempt(string) (int, error)
+	// moves the master to the new email and verifies it, only if it still
+	// has the old one. Returns ErrDuplicatedEmail when the new email is
+	// taken
+	ChangeEmail(id, oldEmail, newEmail string, verifiedAt time.Time) (bool, error)
+	// marks the master deleted, returning false when it already was. The
+	// email is kept, so it can not sign up again until the master is purged
+	MarkDeleted(id string, deletedAt, purgeAt time.Time) (bool, error)
+	// returns the ids of the deleted masters due to be purged
+	FindPurgeable(time.Time) ([]string, error)
+	// removes a deleted master for good
+	Purge(string) error
+	// bumps the token generation, returning the new one
+	NextTokenGeneration(string) (int64, error)
 }
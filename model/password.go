@@ -1,15 +1,101 @@
 package model
 
+import "time"
+
+// Password is an entry of the vault. Besides the logins, holding a
+// password, it can be any of the item types, holding its data instead
 type Password struct {
-	Id  string `bson:"_id"`
-	Key string `bson:"key"`
-	Pwd string `bson:"password"`
+	Id        string            `bson:"_id"`
+	Key       string            `bson:"key"`
+	Type      string            `bson:"type,omitempty"` // empty for the logins saved before the types
+	Pwd       string            `bson:"password"`
+	Data      []ItemField       `bson:"data,omitempty"` // the sensitive values are encrypted
+	Username  string            `bson:"username,omitempty"`
+	URIs      []string          `bson:"uris,omitempty"`
+	Notes     string            `bson:"notes,omitempty"` // encrypted
+	Fields    []CustomField     `bson:"fields,omitempty"`
+	FolderId  string            `bson:"folder_id,omitempty"` // at the root when empty
+	Tags      []string          `bson:"tags,omitempty"`
+	Versions  []PasswordVersion `bson:"versions,omitempty"`   // newest first
+	DeletedAt *time.Time        `bson:"deleted_at,omitempty"` // set while it is in the trash
+}
+
+// PasswordVersion is a password as it was before an update, its secret
+// fields still encrypted. The key and the type never change
+type PasswordVersion struct {
+	Id         string        `bson:"id"`
+	Pwd        string        `bson:"password"`
+	Data       []ItemField   `bson:"data,omitempty"`
+	Username   string        `bson:"username,omitempty"`
+	URIs       []string      `bson:"uris,omitempty"`
+	Notes      string        `bson:"notes,omitempty"`
+	Fields     []CustomField `bson:"fields,omitempty"`
+	ReplacedAt time.Time     `bson:"replaced_at"`
+	SessionId  string        `bson:"session_id,omitempty"` // the session that replaced it
+}
+
+const (
+	ItemLogin    = "login"
+	ItemNote     = "note"
+	ItemCard     = "card"
+	ItemIdentity = "identity"
+	ItemSSHKey   = "ssh_key"
+)
+
+func (p *Password) ItemType() string {
+	if len(p.Type) == 0 {
+		return ItemLogin
+	}
+	return p.Type
+}
+
+// ItemField is a value of an item, its name comes from the item type
+type ItemField struct {
+	Name  string `bson:"name"`
+	Value string `bson:"value"`
+}
+
+const (
+	FieldText    = "text"
+	FieldHidden  = "hidden"
+	FieldBoolean = "boolean"
+)
+
+// CustomField is a named value of a password. Only the hidden values are
+// encrypted
+type CustomField struct {
+	Name  string `bson:"name"`
+	Type  string `bson:"type"`
+	Value string `bson:"value"`
 }
 
+// the passwords in the trash are only found by FindAll and the trash
+// methods
 type PasswordRepository interface {
 	Save(string, *Password) error
 	FindByKey(string, string) (*Password, error)
-	Remove(string, *Password) error
+	// moves the password with the id to the trash
+	Trash(masterId, id string, deletedAt time.Time) error
+	FindTrash(string) ([]Password, error)
+	// takes the password with the id out of the trash, returning false
+	// when it is not there or another password has its key
+	Restore(masterId, id, key string) (bool, error)
+	EmptyTrash(string) error
+	// removes for good the passwords trashed before the given time
+	PurgeTrash(time.Time) error
 	FindKeys(string) ([]string, error)
+	// updates the password, its data and its metadata
 	Update(string, *Password) error
+	// updates like Update and puts the version first in the versions,
+	// keeping at most keep of them
+	UpdateWithVersion(masterId string, password *Password, version *PasswordVersion, keep int) error
+	// removes the versions replaced before the given time from every
+	// password
+	PruneVersions(time.Time) error
+	FindMasterIds() ([]string, error)
+	FindAll(string) ([]Password, error)
+	// updates the encrypted fields, the versions included, only if the
+	// field at path of the password still holds the given cipher text,
+	// returning false when it was changed in the meantime
+	CompareAndUpdate(masterId string, password *Password, path, old string) (bool, error)
 }
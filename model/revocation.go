@@ -0,0 +1,24 @@
+package model
+
+import "time"
+
+// RevokedToken is an access token that must not be accepted anymore. When
+// MasterId is set it revokes every token of that master issued with an
+// older token generation, when SessionId is set every token of that
+// session. The entry is only needed until ExpiresAt, after that the tokens
+// it covers are expired anyway
+type RevokedToken struct {
+	Id         string    `bson:"_id"`
+	MasterId   string    `bson:"master_id,omitempty"`
+	SessionId  string    `bson:"session_id,omitempty"`
+	Generation int64     `bson:"generation,omitempty"`
+	RevokedAt  time.Time `bson:"revoked_at"`
+	ExpiresAt  time.Time `bson:"expires_at"`
+}
+
+type RevocationRepository interface {
+	Revoke(tokenId string, expiresAt time.Time) error
+	RevokeAllByMasterId(masterId string, generation int64, expiresAt time.Time) error
+	RevokeSession(sessionId string, expiresAt time.Time) error
+	IsRevoked(tokenId, sessionId, masterId string, generation int64) (bool, error)
+}
@@ -0,0 +1,39 @@
+package model
+
+import "time"
+
+// Session is a logged in device. Each refresh rotates its token id, only
+// the refresh token holding the current one can be used
+type Session struct {
+	Id         string    `bson:"_id"`
+	MasterId   string    `bson:"master_id"`
+	TokenId    string    `bson:"token_id"`
+	UserAgent  string    `bson:"user_agent"`
+	PeerAddr   string    `bson:"peer_addr"`
+	CreatedAt  time.Time `bson:"created_at"`
+	LastUsedAt time.Time `bson:"last_used_at"`
+	ExpiresAt  time.Time `bson:"expires_at"`
+	// the master token generation when the session started, its tokens
+	// carry it
+	TokenGeneration int64      `bson:"token_generation"`
+	RevokedAt       *time.Time `bson:"revoked_at,omitempty"`
+	RevokeReason    string     `bson:"revoke_reason,omitempty"`
+}
+
+func (s *Session) IsActive() bool {
+	return s.RevokedAt == nil && s.ExpiresAt.After(time.Now())
+}
+
+type SessionRepository interface {
+	Save(*Session) error
+	FindById(string) (*Session, error)
+	// returns the sessions that are neither revoked nor expired
+	FindActiveByMasterId(string) ([]Session, error)
+	// moves the session to the new token id only if it still holds the
+	// old one, returning false otherwise
+	Rotate(id, oldTokenId, newTokenId string, expiresAt time.Time) (bool, error)
+	Revoke(id, reason string) error
+	RevokeAllByMasterId(masterId, reason string) error
+	// removes every session of the master, used when it is purged
+	DeleteAllByMasterId(masterId string) error
+}
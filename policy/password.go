@@ -0,0 +1,223 @@
+// Package policy checks master passwords against the server password
+// policy
+package policy
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/danilomarques1/secretumserver/levenshtein"
+)
+
+// the rules a password can fail
+const (
+	RuleMinLength        = "min_length"
+	RuleCharacterClasses = "character_classes"
+	RuleStrength         = "strength"
+	RuleBannedWord       = "banned_word"
+	RuleEmailSimilarity  = "email_similarity"
+)
+
+// Violation is a rule the password failed
+type Violation struct {
+	Rule    string
+	Message string
+}
+
+// Policy is the password policy. Score goes from 0, guessed right away,
+// to 4, out of reach of an offline attack
+type Policy struct {
+	MinLength  int
+	MinClasses int // out of lowercase, uppercase, digits and symbols
+	MinScore   int
+	// lowercase words a password may not contain, like the company name.
+	// The common passwords already lower the score
+	BannedWords []string
+}
+
+func DefaultPolicy() *Policy {
+	return &Policy{
+		MinLength:  12,
+		MinClasses: 3,
+		MinScore:   3,
+	}
+}
+
+// LoadPolicy reads the policy from the environment, the variables not set
+// keep the defaults
+//
+//	PASSWORD_MIN_LENGTH   minimum length
+//	PASSWORD_MIN_CLASSES  character classes required
+//	PASSWORD_MIN_SCORE    minimum strength score, from 0 to 4
+//	PASSWORD_BANNED_WORDS file with a banned word per line
+func LoadPolicy() (*Policy, error) {
+	p := DefaultPolicy()
+	ints := map[string]*int{
+		"PASSWORD_MIN_LENGTH":  &p.MinLength,
+		"PASSWORD_MIN_CLASSES": &p.MinClasses,
+		"PASSWORD_MIN_SCORE":   &p.MinScore,
+	}
+	for name, value := range ints {
+		env := os.Getenv(name)
+		if len(env) == 0 {
+			continue
+		}
+		n, err := strconv.Atoi(env)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %v: %w", name, err)
+		}
+		*value = n
+	}
+
+	if path := os.Getenv("PASSWORD_BANNED_WORDS"); len(path) > 0 {
+		words, err := readWords(path)
+		if err != nil {
+			return nil, err
+		}
+		p.BannedWords = words
+	}
+
+	return p, nil
+}
+
+// Check returns every rule the password fails, none when it is accepted
+func (p *Policy) Check(password, email string) []Violation {
+	violations := make([]Violation, 0)
+	if length := len([]rune(password)); length < p.MinLength {
+		violations = append(violations, Violation{
+			Rule:    RuleMinLength,
+			Message: fmt.Sprintf("Must have at least %v characters", p.MinLength),
+		})
+	}
+	if classes := characterClasses(password); classes < p.MinClasses {
+		violations = append(violations, Violation{
+			Rule:    RuleCharacterClasses,
+			Message: fmt.Sprintf("Must mix at least %v of lowercase, uppercase, digits and symbols", p.MinClasses),
+		})
+	}
+	if word, found := p.bannedWord(password); found {
+		violations = append(violations, Violation{
+			Rule:    RuleBannedWord,
+			Message: fmt.Sprintf("Must not contain %q", word),
+		})
+	}
+	if similarToEmail(password, email) {
+		violations = append(violations, Violation{
+			Rule:    RuleEmailSimilarity,
+			Message: "Must not be similar to the email",
+		})
+	}
+	if score := Score(password, emailWords(email)...); score < p.MinScore {
+		violations = append(violations, Violation{
+			Rule:    RuleStrength,
+			Message: fmt.Sprintf("Too easy to guess, scored %v of the %v required", score, p.MinScore),
+		})
+	}
+	return violations
+}
+
+func characterClasses(password string) int {
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	classes := 0
+	for _, has := range []bool{lower, upper, digit, symbol} {
+		if has {
+			classes++
+		}
+	}
+	return classes
+}
+
+// the banned words are also looked for with the common substitutions
+// undone, p@ssw0rd contains password
+func (p *Policy) bannedWord(password string) (string, bool) {
+	lower := strings.ToLower(password)
+	unleeted := unleet(lower)
+	for _, word := range p.BannedWords {
+		if len(word) < 3 {
+			continue
+		}
+		if strings.Contains(lower, word) || strings.Contains(unleeted, word) {
+			return word, true
+		}
+	}
+	return "", false
+}
+
+// the password contains the name of the email, or is a few edits away
+// from it
+func similarToEmail(password, email string) bool {
+	if len(email) == 0 {
+		return false
+	}
+	password = unleet(strings.ToLower(password))
+	email = strings.ToLower(email)
+	for _, word := range emailWords(email) {
+		if len(word) >= 4 && strings.Contains(password, word) {
+			return true
+		}
+	}
+	name, _, _ := strings.Cut(email, "@")
+	for _, s := range []string{email, name} {
+		if levenshtein.Distance([]rune(password), []rune(s)) <= 3 {
+			return true
+		}
+	}
+	return false
+}
+
+// the parts of the email a password is likely to be built from
+func emailWords(email string) []string {
+	email = strings.ToLower(email)
+	name, domain, _ := strings.Cut(email, "@")
+	words := []string{name}
+	words = append(words, strings.FieldsFunc(name, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})...)
+	if host, _, found := strings.Cut(domain, "."); found {
+		words = append(words, host)
+	}
+	result := make([]string, 0, len(words))
+	for _, word := range words {
+		if len(word) >= 3 {
+			result = append(result, word)
+		}
+	}
+	return result
+}
+
+func readWords(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	words := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		word := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if len(word) > 0 && !strings.HasPrefix(word, "#") {
+			words = append(words, word)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return words, nil
+}
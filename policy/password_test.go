@@ -0,0 +1,53 @@
+package policy
+
+import "testing"
+
+func TestScore(t *testing.T) {
+	tests := []struct {
+		password string
+		maxScore int
+		minScore int
+	}{
+		{"password", 0, 0},
+		{"P@ssw0rd", 1, 0},
+		{"qwertyuiop", 1, 0},
+		{"abcdef123456", 1, 0},
+		{"Summer2023!", 2, 0},
+		{"Xk9#mQ2$vL7w", 4, 4},
+		{"tangerine-velvet-ostrich-42", 4, 4},
+	}
+
+	for _, test := range tests {
+		score := Score(test.password)
+		if score > test.maxScore || score < test.minScore {
+			t.Fatalf("Wrong score for %v expected between %v and %v got %v\n", test.password, test.minScore, test.maxScore, score)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	p := DefaultPolicy()
+	p.BannedWords = []string{"acme"}
+	tests := []struct {
+		password string
+		email    string
+		rules    []string
+	}{
+		{"Xk9#mQ2$vL7w", "john@mail.com", []string{}},
+		{"a", "john@mail.com", []string{RuleMinLength, RuleCharacterClasses, RuleStrength}},
+		{"Xk9#Acm3$vL7w", "john@mail.com", []string{RuleBannedWord}},
+		{"Xk9#Johnny$vL7w", "johnny@mail.com", []string{RuleEmailSimilarity}},
+	}
+
+	for _, test := range tests {
+		violations := p.Check(test.password, test.email)
+		if len(violations) != len(test.rules) {
+			t.Fatalf("Wrong violations for %v expected %v got %v\n", test.password, test.rules, violations)
+		}
+		for i, rule := range test.rules {
+			if violations[i].Rule != rule {
+				t.Fatalf("Wrong violation for %v expected %v got %v\n", test.password, rule, violations[i].Rule)
+			}
+		}
+	}
+}
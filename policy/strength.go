@@ -0,0 +1,250 @@
+package policy
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// the guesses, as bits, a character not part of any pattern adds. Same as
+// zxcvbn, an attacker that found no pattern still tries the likely
+// characters first
+const bruteforceBits = 3.32 // log2(10)
+
+// the scores start at 10^3, 10^6, 10^8 and 10^10 guesses
+var scoreBits = []float64{9.97, 19.93, 26.58, 33.22}
+
+// ranked by how often they show up in leaked passwords
+var commonWords = []string{
+	"password", "123456", "qwerty", "letmein", "welcome", "admin", "iloveyou",
+	"monkey", "dragon", "master", "secret", "login", "football", "baseball",
+	"sunshine", "princess", "shadow", "superman", "trustno", "abc123",
+	"starwars", "whatever", "freedom", "hello", "charlie", "michael",
+	"jordan", "hunter", "summer", "winter", "spring", "autumn", "secretum",
+	"changeme", "computer", "internet", "love", "pass", "test", "user",
+}
+
+var keyboardRows = []string{"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm"}
+
+var leet = strings.NewReplacer(
+	"@", "a", "4", "a", "8", "b", "3", "e", "6", "g", "1", "i", "!", "i",
+	"0", "o", "$", "s", "5", "s", "7", "t", "+", "t", "2", "z",
+)
+
+func unleet(s string) string {
+	return leet.Replace(s)
+}
+
+type match struct {
+	start, end int // runes
+	bits       float64
+}
+
+// Score estimates how hard the password is to guess, from 0 to 4. Like
+// zxcvbn it covers the password with the cheapest combination of known
+// patterns (common words, the user words, sequences, repeats, keyboard
+// rows and years) and counts the guesses that takes
+func Score(password string, userWords ...string) int {
+	bits := guessBits(password, userWords)
+	score := 0
+	for _, threshold := range scoreBits {
+		if bits >= threshold {
+			score++
+		}
+	}
+	return score
+}
+
+func guessBits(password string, userWords []string) float64 {
+	runes := []rune(password)
+	if len(runes) == 0 {
+		return 0
+	}
+	matches := make([]match, 0)
+	matches = append(matches, dictionaryMatches(runes, userWords)...)
+	matches = append(matches, sequenceMatches(runes)...)
+	matches = append(matches, repeatMatches(runes)...)
+	matches = append(matches, keyboardMatches(runes)...)
+	matches = append(matches, yearMatches(runes)...)
+
+	// best[i] is the cheapest way to guess the first i runes
+	best := make([]float64, len(runes)+1)
+	for i := 1; i <= len(runes); i++ {
+		best[i] = math.Inf(1)
+	}
+	for i := 0; i < len(runes); i++ {
+		if best[i]+bruteforceBits < best[i+1] {
+			best[i+1] = best[i] + bruteforceBits
+		}
+		for _, m := range matches {
+			// every extra pattern also has to be guessed
+			if m.start == i && best[i]+m.bits+1 < best[m.end] {
+				best[m.end] = best[i] + m.bits + 1
+			}
+		}
+	}
+	return best[len(runes)]
+}
+
+func dictionaryMatches(runes []rune, userWords []string) []match {
+	lower := []rune(strings.ToLower(string(runes)))
+	unleeted := []rune(unleet(string(lower)))
+	// the replacer maps single characters, so the positions line up
+	if len(unleeted) != len(lower) {
+		unleeted = lower
+	}
+
+	ranked := make(map[string]int)
+	for _, word := range userWords {
+		ranked[strings.ToLower(word)] = 1
+	}
+	for i, word := range commonWords {
+		if _, ok := ranked[word]; !ok {
+			ranked[word] = i + 1
+		}
+	}
+
+	matches := make([]match, 0)
+	for word, rank := range ranked {
+		w := []rune(word)
+		if len(w) < 3 {
+			continue
+		}
+		for start := 0; start+len(w) <= len(runes); start++ {
+			end := start + len(w)
+			plain := string(lower[start:end]) == word
+			if !plain && string(unleeted[start:end]) != word {
+				continue
+			}
+			bits := math.Log2(float64(rank + 1))
+			bits += capitalizationBits(runes[start:end])
+			if !plain {
+				bits++
+			}
+			matches = append(matches, match{start: start, end: end, bits: bits})
+		}
+	}
+	return matches
+}
+
+// all lowercase is free, a capital first letter or all caps are one bit,
+// anything else is a bit per capital
+func capitalizationBits(word []rune) float64 {
+	upper := 0
+	for _, r := range word {
+		if unicode.IsUpper(r) {
+			upper++
+		}
+	}
+	switch {
+	case upper == 0:
+		return 0
+	case upper == len(word), upper == 1 && unicode.IsUpper(word[0]):
+		return 1
+	default:
+		return float64(upper)
+	}
+}
+
+// abcd, 9876
+func sequenceMatches(runes []rune) []match {
+	matches := make([]match, 0)
+	for start := 0; start < len(runes)-2; {
+		delta := runes[start+1] - runes[start]
+		end := start + 1
+		if delta == 1 || delta == -1 {
+			for end < len(runes) && runes[end]-runes[end-1] == delta {
+				end++
+			}
+		}
+		if end-start >= 3 {
+			bits := math.Log2(float64(end-start)) + math.Log2(float64(cardinality(runes[start])))
+			if delta == -1 {
+				bits++
+			}
+			matches = append(matches, match{start: start, end: end, bits: bits})
+			start = end
+			continue
+		}
+		start++
+	}
+	return matches
+}
+
+// aaaa
+func repeatMatches(runes []rune) []match {
+	matches := make([]match, 0)
+	for start := 0; start < len(runes); {
+		end := start + 1
+		for end < len(runes) && runes[end] == runes[start] {
+			end++
+		}
+		if end-start >= 3 {
+			bits := math.Log2(float64(end-start)) + math.Log2(float64(cardinality(runes[start])))
+			matches = append(matches, match{start: start, end: end, bits: bits})
+		}
+		start = end
+	}
+	return matches
+}
+
+// qwer, lkjh
+func keyboardMatches(runes []rune) []match {
+	lower := strings.ToLower(string(runes))
+	lowerRunes := []rune(lower)
+	matches := make([]match, 0)
+	for _, row := range keyboardRows {
+		reversed := reverse(row)
+		for start := 0; start < len(lowerRunes); start++ {
+			for end := start + 4; end <= len(lowerRunes); end++ {
+				s := string(lowerRunes[start:end])
+				if !strings.Contains(row, s) && !strings.Contains(reversed, s) {
+					break
+				}
+				// any of the keys of the keyboard may start the pattern
+				bits := math.Log2(40) + math.Log2(float64(end-start))
+				matches = append(matches, match{start: start, end: end, bits: bits})
+			}
+		}
+	}
+	return matches
+}
+
+// 1900 to 2049
+func yearMatches(runes []rune) []match {
+	matches := make([]match, 0)
+	for start := 0; start+4 <= len(runes); start++ {
+		year := 0
+		digits := true
+		for _, r := range runes[start : start+4] {
+			if r < '0' || r > '9' {
+				digits = false
+				break
+			}
+			year = year*10 + int(r-'0')
+		}
+		if digits && year >= 1900 && year < 2050 {
+			matches = append(matches, match{start: start, end: start + 4, bits: math.Log2(150)})
+		}
+	}
+	return matches
+}
+
+func cardinality(r rune) int {
+	switch {
+	case unicode.IsDigit(r):
+		return 10
+	case unicode.IsLetter(r):
+		return 26
+	default:
+		return 33
+	}
+}
+
+func reverse(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
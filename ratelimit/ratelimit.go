@@ -0,0 +1,186 @@
+// Package ratelimit implements in memory token buckets
+package ratelimit
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInvalidRate = errors.New("Invalid rate, expected <requests>/<period> like 60/1m")
+
+// Rate allows Limit requests per Period. A client that was idle can spend
+// the whole Limit at once, after that it gets a token back every
+// Period/Limit
+type Rate struct {
+	Limit  int
+	Period time.Duration
+}
+
+// ParseRate parses "<requests>/<period>", "off" and "0" disable the limit
+func ParseRate(value string) (Rate, error) {
+	value = strings.TrimSpace(value)
+	if value == "off" || value == "0" {
+		return Rate{}, nil
+	}
+	limit, period, found := strings.Cut(value, "/")
+	if !found {
+		return Rate{}, ErrInvalidRate
+	}
+	n, err := strconv.Atoi(limit)
+	if err != nil || n < 0 {
+		return Rate{}, ErrInvalidRate
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return Rate{}, ErrInvalidRate
+	}
+	return Rate{Limit: n, Period: d}, nil
+}
+
+func (r Rate) Disabled() bool {
+	return r.Limit == 0
+}
+
+func (r Rate) interval() time.Duration {
+	return r.Period / time.Duration(r.Limit)
+}
+
+// Result is the budget of a key after a request
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// when the bucket is full again, or when the next request is allowed
+	// if this one was not
+	Reset time.Duration
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	period time.Duration // idle for a period the bucket is full again
+}
+
+// Limiter keeps a bucket per key. Buckets that refilled are dropped, a
+// full bucket is the same as no bucket
+type Limiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewLimiter() *Limiter {
+	return &Limiter{
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token from the bucket of the key
+func (l *Limiter) Allow(key string, rate Rate) Result {
+	if rate.Disabled() {
+		return Result{Allowed: true}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(rate.Limit), last: now}
+		l.buckets[key] = b
+	}
+	b.period = rate.Period
+	b.tokens += float64(now.Sub(b.last)) / float64(rate.interval())
+	if b.tokens > float64(rate.Limit) {
+		b.tokens = float64(rate.Limit)
+	}
+	b.last = now
+
+	result := Result{Limit: rate.Limit}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	}
+	result.Remaining = int(b.tokens)
+	if result.Allowed {
+		result.Reset = time.Duration((float64(rate.Limit) - b.tokens) * float64(rate.interval()))
+	} else {
+		result.Reset = time.Duration((1 - b.tokens) * float64(rate.interval()))
+	}
+	return result
+}
+
+const sweepInterval = time.Minute
+
+// drops the buckets idle for longer than their period
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= b.period {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Limits are the rate of every method, the ones without their own use the
+// default
+type Limits struct {
+	Default Rate
+	Methods map[string]Rate // by method name or service/method
+}
+
+const DefaultRate = "120/1m"
+
+// LoadLimits reads RATE_LIMIT_DEFAULT and RATE_LIMITS, a comma separated
+// list of method=rate like GeneratePassword=10/1m,pb.Password/FindKeys=30/1m
+func LoadLimits() (Limits, error) {
+	value := os.Getenv("RATE_LIMIT_DEFAULT")
+	if len(value) == 0 {
+		value = DefaultRate
+	}
+	defaultRate, err := ParseRate(value)
+	if err != nil {
+		return Limits{}, err
+	}
+
+	limits := Limits{Default: defaultRate, Methods: make(map[string]Rate)}
+	for _, spec := range strings.Split(os.Getenv("RATE_LIMITS"), ",") {
+		spec = strings.TrimSpace(spec)
+		if len(spec) == 0 {
+			continue
+		}
+		method, value, found := strings.Cut(spec, "=")
+		if !found {
+			return Limits{}, ErrInvalidRate
+		}
+		rate, err := ParseRate(value)
+		if err != nil {
+			return Limits{}, err
+		}
+		limits.Methods[strings.TrimSpace(method)] = rate
+	}
+	return limits, nil
+}
+
+// For returns the rate of the method, service/method wins over the bare
+// method name
+func (l Limits) For(service, method string) Rate {
+	if rate, ok := l.Methods[service+"/"+method]; ok {
+		return rate
+	}
+	if rate, ok := l.Methods[method]; ok {
+		return rate
+	}
+	return l.Default
+}
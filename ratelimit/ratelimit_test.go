@@ -0,0 +1,59 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		value string
+		rate  Rate
+		err   error
+	}{
+		{"60/1m", Rate{Limit: 60, Period: time.Minute}, nil},
+		{"5/1s", Rate{Limit: 5, Period: time.Second}, nil},
+		{"off", Rate{}, nil},
+		{"60", Rate{}, ErrInvalidRate},
+		{"a/1m", Rate{}, ErrInvalidRate},
+		{"60/0s", Rate{}, ErrInvalidRate},
+	}
+
+	for _, test := range tests {
+		rate, err := ParseRate(test.value)
+		if err != test.err {
+			t.Fatalf("Err should when parsing %v be %v got %v\n", test.value, test.err, err)
+		}
+		if rate != test.rate {
+			t.Fatalf("Wrong rate for %v expected %v got %v\n", test.value, test.rate, rate)
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := NewLimiter()
+	limiter.now = func() time.Time { return now }
+	rate := Rate{Limit: 3, Period: 3 * time.Second}
+
+	for i := 0; i < 3; i++ {
+		if result := limiter.Allow("client", rate); !result.Allowed || result.Remaining != 2-i {
+			t.Fatalf("Request %v should be allowed with %v remaining got %+v\n", i, 2-i, result)
+		}
+	}
+	result := limiter.Allow("client", rate)
+	if result.Allowed {
+		t.Fatalf("Request over the limit should not be allowed\n")
+	}
+	if result.Reset != time.Second {
+		t.Fatalf("Wrong reset expected %v got %v\n", time.Second, result.Reset)
+	}
+	if !limiter.Allow("other-client", rate).Allowed {
+		t.Fatalf("Other keys should have their own bucket\n")
+	}
+
+	now = now.Add(time.Second)
+	if !limiter.Allow("client", rate).Allowed {
+		t.Fatalf("Request should be allowed after the bucket refilled\n")
+	}
+}
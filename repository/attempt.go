@@ -0,0 +1,193 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/danilomarques1/secretumserver/database"
+	"github.com/danilomarques1/secretumserver/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrUnknownAttemptStore = errors.New("Unknown attempt store")
+
+// returns the store selected by ATTEMPT_STORE, mongo by default. The
+// memory store is only safe with a single server instance
+func NewAttemptRepository() (model.AttemptRepository, error) {
+	switch os.Getenv("ATTEMPT_STORE") {
+	case "", StoreMongo:
+		return NewAttemptRepositoryMongo()
+	case StoreMemory:
+		return NewAttemptRepositoryMemory(), nil
+	default:
+		return nil, ErrUnknownAttemptStore
+	}
+}
+
+type AttemptRepositoryMongo struct {
+	client     *mongo.Client
+	collection *mongo.Collection
+}
+
+func NewAttemptRepositoryMongo() (*AttemptRepositoryMongo, error) {
+	client, err := database.GetDatabaseConnection()
+	if err != nil {
+		return nil, err
+	}
+	collection := client.Database(os.Getenv("DATABASE")).Collection("login_attempt")
+	// mongo removes the records once the failures are out of the window
+	collection.Indexes().CreateOne(
+		context.Background(),
+		mongo.IndexModel{
+			Keys:    bson.M{"expires_at": 1},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	)
+
+	return &AttemptRepositoryMongo{
+		client:     client,
+		collection: collection,
+	}, nil
+}
+
+func (r *AttemptRepositoryMongo) Find(key string) (*model.LoginAttempts, error) {
+	attempts := &model.LoginAttempts{}
+	result := r.collection.FindOne(context.Background(), bson.M{"_id": key}, options.FindOne())
+	if err := result.Decode(attempts); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return &model.LoginAttempts{Id: key}, nil
+		}
+		return nil, err
+	}
+	return attempts, nil
+}
+
+// a single pipeline update, so concurrent failures are never lost
+func (r *AttemptRepositoryMongo) AddFailure(key string, at, since, expiresAt time.Time) (*model.LoginAttempts, error) {
+	recent := bson.M{"$filter": bson.M{
+		"input": bson.M{"$ifNull": bson.A{"$failures", bson.A{}}},
+		"as":    "failure",
+		"cond":  bson.M{"$gte": bson.A{"$$failure", since}},
+	}}
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"failures":   bson.M{"$concatArrays": bson.A{recent, bson.A{at}}},
+			"expires_at": bson.M{"$max": bson.A{"$expires_at", expiresAt}},
+		}}},
+	}
+	attempts := &model.LoginAttempts{}
+	result := r.collection.FindOneAndUpdate(
+		context.Background(),
+		bson.M{"_id": key},
+		update,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	)
+	if err := result.Decode(attempts); err != nil {
+		return nil, err
+	}
+	return attempts, nil
+}
+
+func (r *AttemptRepositoryMongo) Lock(key string, until time.Time) error {
+	update := bson.M{
+		"$set": bson.M{"locked_until": until},
+		"$max": bson.M{"expires_at": until},
+	}
+	_, err := r.collection.UpdateOne(context.Background(), bson.M{"_id": key}, update, options.Update().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *AttemptRepositoryMongo) Reset(key string) error {
+	if _, err := r.collection.DeleteOne(context.Background(), bson.M{"_id": key}); err != nil {
+		return err
+	}
+	return nil
+}
+
+type AttemptRepositoryMemory struct {
+	mu       sync.Mutex
+	attempts map[string]*model.LoginAttempts
+}
+
+func NewAttemptRepositoryMemory() *AttemptRepositoryMemory {
+	return &AttemptRepositoryMemory{
+		attempts: make(map[string]*model.LoginAttempts),
+	}
+}
+
+func (r *AttemptRepositoryMemory) Find(key string) (*model.LoginAttempts, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	attempts, ok := r.attempts[key]
+	if !ok || !attempts.ExpiresAt.After(time.Now()) {
+		return &model.LoginAttempts{Id: key}, nil
+	}
+	return copyAttempts(attempts), nil
+}
+
+func (r *AttemptRepositoryMemory) AddFailure(key string, at, since, expiresAt time.Time) (*model.LoginAttempts, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.removeExpired()
+	attempts, ok := r.attempts[key]
+	if !ok {
+		attempts = &model.LoginAttempts{Id: key}
+		r.attempts[key] = attempts
+	}
+	failures := make([]time.Time, 0, len(attempts.Failures)+1)
+	for _, failure := range attempts.Failures {
+		if !failure.Before(since) {
+			failures = append(failures, failure)
+		}
+	}
+	attempts.Failures = append(failures, at)
+	if expiresAt.After(attempts.ExpiresAt) {
+		attempts.ExpiresAt = expiresAt
+	}
+	return copyAttempts(attempts), nil
+}
+
+func (r *AttemptRepositoryMemory) Lock(key string, until time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	attempts, ok := r.attempts[key]
+	if !ok {
+		attempts = &model.LoginAttempts{Id: key}
+		r.attempts[key] = attempts
+	}
+	attempts.LockedUntil = until
+	if until.After(attempts.ExpiresAt) {
+		attempts.ExpiresAt = until
+	}
+	return nil
+}
+
+func (r *AttemptRepositoryMemory) Reset(key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.attempts, key)
+	return nil
+}
+
+func (r *AttemptRepositoryMemory) removeExpired() {
+	now := time.Now()
+	for key, attempts := range r.attempts {
+		if !attempts.ExpiresAt.After(now) {
+			delete(r.attempts, key)
+		}
+	}
+}
+
+func copyAttempts(attempts *model.LoginAttempts) *model.LoginAttempts {
+	c := *attempts
+	c.Failures = append([]time.Time(nil), attempts.Failures...)
+	return &c
+}
@@ -0,0 +1,111 @@
+package repository
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/danilomarques1/secretumserver/database"
+	"github.com/danilomarques1/secretumserver/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// the folders are kept in the master document along with the passwords
+type FolderRepositoryMongo struct {
+	client     *mongo.Client
+	collection *mongo.Collection
+}
+
+func NewFolderRepository() (*FolderRepositoryMongo, error) {
+	client, err := database.GetDatabaseConnection()
+	if err != nil {
+		return nil, err
+	}
+	collection := client.Database(os.Getenv("DATABASE")).Collection("master")
+
+	return &FolderRepositoryMongo{
+		client:     client,
+		collection: collection,
+	}, nil
+}
+
+func (r *FolderRepositoryMongo) FindAll(masterId string) ([]model.Folder, error) {
+	result := r.collection.FindOne(
+		context.Background(),
+		bson.M{"_id": masterId},
+		options.FindOne().SetProjection(bson.M{"folders": 1}),
+	)
+	master := &model.Master{}
+	if err := result.Decode(master); err != nil {
+		return nil, err
+	}
+
+	return master.Folders, nil
+}
+
+// the sibling check and the write are a single update, so two requests
+// can not create the same folder
+func (r *FolderRepositoryMongo) Add(masterId string, folder *model.Folder) (bool, error) {
+	filter := bson.M{"_id": masterId, "folders": bson.M{"$not": sibling(folder.ParentId, folder.Name)}}
+	update := bson.M{"$push": bson.M{"folders": folder}}
+	result, err := r.collection.UpdateOne(context.Background(), filter, update, options.Update())
+	if err != nil {
+		return false, err
+	}
+
+	return result.ModifiedCount == 1, nil
+}
+
+func (r *FolderRepositoryMongo) Move(masterId, id, parentId, name string) (bool, error) {
+	filter := bson.M{
+		"_id": masterId,
+		"$and": bson.A{
+			bson.M{"folders.id": id},
+			bson.M{"folders": bson.M{"$not": sibling(parentId, name)}},
+		},
+	}
+	update := bson.M{"$set": bson.M{
+		"folders.$[folder].parent_id": parentId,
+		"folders.$[folder].name":      name,
+	}}
+	opts := options.Update().SetArrayFilters(options.ArrayFilters{
+		Filters: []interface{}{bson.M{"folder.id": id}},
+	})
+	result, err := r.collection.UpdateOne(context.Background(), filter, update, opts)
+	if err != nil {
+		return false, err
+	}
+
+	return result.MatchedCount == 1, nil
+}
+
+// the passwords are trashed first, they lose their folder afterwards so
+// they are restored at the root
+func (r *FolderRepositoryMongo) Remove(masterId string, ids []string, deletedAt time.Time) error {
+	trash := bson.M{"$set": bson.M{"passwords.$[active].deleted_at": deletedAt}}
+	opts := options.Update().SetArrayFilters(options.ArrayFilters{
+		Filters: []interface{}{bson.M{"active.folder_id": bson.M{"$in": ids}, "active.deleted_at": bson.M{"$exists": false}}},
+	})
+	if _, err := r.collection.UpdateOne(context.Background(), bson.M{"_id": masterId}, trash, opts); err != nil {
+		return err
+	}
+
+	remove := bson.M{
+		"$unset": bson.M{"passwords.$[filed].folder_id": ""},
+		"$pull":  bson.M{"folders": bson.M{"id": bson.M{"$in": ids}}},
+	}
+	opts = options.Update().SetArrayFilters(options.ArrayFilters{
+		Filters: []interface{}{bson.M{"filed.folder_id": bson.M{"$in": ids}}},
+	})
+	if _, err := r.collection.UpdateOne(context.Background(), bson.M{"_id": masterId}, remove, opts); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func sibling(parentId, name string) bson.M {
+	return bson.M{"$elemMatch": bson.M{"parent_id": parentId, "name": name}}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"log"
 	"os"
+	"time"
 
 	"github.com/danilomarques1/secretumserver/database"
 	"github.com/danilomarques1/secretumserver/model"
@@ -40,6 +41,9 @@ func NewMasterRepository() (*MasterRepositoryMongo, error) {
 func (r *MasterRepositoryMongo) Save(master *model.Master) error {
 	if _, err := r.collection.InsertOne(context.Background(), master); err != nil {
 		log.Printf("Error when trying to insert %v\n", err)
+		if mongo.IsDuplicateKeyError(err) {
+			return model.ErrDuplicatedEmail
+		}
 		return err
 	}
 
@@ -48,7 +52,17 @@ func (r *MasterRepositoryMongo) Save(master *model.Master) error {
 
 func (r *MasterRepositoryMongo) FindByEmail(email string) (*model.Master, error) {
 	master := &model.Master{}
-	result := r.collection.FindOne(context.Background(), bson.M{"email": email}, options.FindOne())
+	result := r.collection.FindOne(context.Background(), bson.M{"email": email, "deleted_at": bson.M{"$exists": false}}, options.FindOne())
+	if err := result.Decode(master); err != nil {
+		return nil, err
+	}
+
+	return master, nil
+}
+
+func (r *MasterRepositoryMongo) FindById(id string) (*model.Master, error) {
+	master := &model.Master{}
+	result := r.collection.FindOne(context.Background(), bson.M{"_id": id, "deleted_at": bson.M{"$exists": false}}, options.FindOne())
 	if err := result.Decode(master); err != nil {
 		return nil, err
 	}
@@ -57,10 +71,276 @@ func (r *MasterRepositoryMongo) FindByEmail(email string) (*model.Master, error)
 }
 
 func (r *MasterRepositoryMongo) Update(master *model.Master) error {
-	filter := bson.M{"email": master.Email}
-	update := bson.M{"$set": master}
+	fields, err := updatableFields(master)
+	if err != nil {
+		return err
+	}
+
+	filter := bson.M{"_id": master.Id}
+	update := bson.M{"$set": fields}
+	if _, err := r.collection.UpdateOne(context.Background(), filter, update, options.Update()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *MasterRepositoryMongo) UpdateWithRecoveryKey(master *model.Master, hashedKey string) (bool, error) {
+	fields, err := updatableFields(master)
+	if err != nil {
+		return false, err
+	}
+	fields["recovery_key"] = master.RecoveryKey
+
+	filter := bson.M{"_id": master.Id, "recovery_key": hashedKey}
+	update := bson.M{"$set": fields}
+	result, err := r.collection.UpdateOne(context.Background(), filter, update, options.Update())
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+// the email, the passwords, the folders, the data key, the two factor, the
+// expiration policy, the email verification, the recovery key, the email
+// change and the deletion have their own updates, they are left out so a
+// stale copy of the master never overwrites them
+func updatableFields(master *model.Master) (bson.M, error) {
+	content, err := bson.Marshal(master)
+	if err != nil {
+		return nil, err
+	}
+	fields := bson.M{}
+	if err := bson.Unmarshal(content, &fields); err != nil {
+		return nil, err
+	}
+	for _, field := range []string{
+		"_id", "email", "passwords", "folders", "data_key", "two_factor",
+		"expiration_policy", "email_verification", "recovery_key", "email_change",
+		"deleted_at", "purge_at", "token_generation",
+	} {
+		delete(fields, field)
+	}
+	return fields, nil
+}
+
+// returns every master with only the id and the data key
+func (r *MasterRepositoryMongo) FindDataKeys() ([]model.Master, error) {
+	cursor, err := r.collection.Find(
+		context.Background(),
+		bson.M{"data_key": bson.M{"$exists": true}},
+		options.Find().SetProjection(bson.M{"_id": 1, "data_key": 1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	masters := make([]model.Master, 0)
+	if err := cursor.All(context.Background(), &masters); err != nil {
+		return nil, err
+	}
+
+	return masters, nil
+}
+
+func (r *MasterRepositoryMongo) CompareAndSetDataKey(id, wrapped string, dataKey *model.DataKey) (bool, error) {
+	filter := bson.M{"_id": id, "data_key": bson.M{"$exists": false}}
+	if len(wrapped) > 0 {
+		filter = bson.M{"_id": id, "data_key.wrapped": wrapped}
+	}
+	update := bson.M{"$set": bson.M{"data_key": dataKey}}
+	result, err := r.collection.UpdateOne(context.Background(), filter, update, options.Update())
+	if err != nil {
+		return false, err
+	}
+
+	return result.ModifiedCount == 1, nil
+}
+
+func (r *MasterRepositoryMongo) RemoveDataKey(id string) error {
+	update := bson.M{"$unset": bson.M{"data_key": ""}}
+	if _, err := r.collection.UpdateOne(context.Background(), bson.M{"_id": id}, update, options.Update()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *MasterRepositoryMongo) SetTwoFactor(id string, twoFactor *model.TwoFactor) error {
+	update := bson.M{"$set": bson.M{"two_factor": twoFactor}}
+	if _, err := r.collection.UpdateOne(context.Background(), bson.M{"_id": id}, update, options.Update()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *MasterRepositoryMongo) UseTwoFactorStep(id string, step int64) (bool, error) {
+	filter := bson.M{"_id": id, "two_factor.last_step": bson.M{"$lt": step}}
+	update := bson.M{"$set": bson.M{"two_factor.last_step": step}}
+	result, err := r.collection.UpdateOne(context.Background(), filter, update, options.Update())
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+func (r *MasterRepositoryMongo) UseRecoveryCode(id, hashedCode string) (bool, error) {
+	filter := bson.M{"_id": id, "two_factor.recovery_codes": hashedCode}
+	update := bson.M{"$pull": bson.M{"two_factor.recovery_codes": hashedCode}}
+	result, err := r.collection.UpdateOne(context.Background(), filter, update, options.Update())
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+func (r *MasterRepositoryMongo) SetExpirationPolicy(id string, policy *model.ExpirationPolicy, expiresAt time.Time) error {
+	set := bson.M{}
+	update := bson.M{}
+	if policy == nil {
+		update["$unset"] = bson.M{"expiration_policy": ""}
+	} else {
+		set["expiration_policy"] = policy
+	}
+	if !expiresAt.IsZero() {
+		set["password_expiration_date"] = expiresAt
+	}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if _, err := r.collection.UpdateOne(context.Background(), bson.M{"_id": id}, update, options.Update()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *MasterRepositoryMongo) UseGraceLogin(id string, max int) (bool, error) {
+	filter := bson.M{"_id": id, "grace_logins_used": bson.M{"$not": bson.M{"$gte": max}}}
+	update := bson.M{"$inc": bson.M{"grace_logins_used": 1}}
+	result, err := r.collection.UpdateOne(context.Background(), filter, update, options.Update())
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+func (r *MasterRepositoryMongo) SetVerificationSent(id string, sentAt time.Time) error {
+	filter := bson.M{"_id": id, "email_verification": bson.M{"$exists": true}}
+	update := bson.M{"$set": bson.M{"email_verification.sent_at": sentAt}}
 	if _, err := r.collection.UpdateOne(context.Background(), filter, update, options.Update()); err != nil {
 		return err
 	}
 	return nil
 }
+
+func (r *MasterRepositoryMongo) VerifyEmail(id, email string, verifiedAt time.Time) (bool, error) {
+	filter := bson.M{"_id": id, "email": email, "email_verification": bson.M{"$exists": true}}
+	update := bson.M{"$set": bson.M{"email_verification.verified_at": verifiedAt}}
+	result, err := r.collection.UpdateOne(context.Background(), filter, update, options.Update())
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+func (r *MasterRepositoryMongo) SetRecoveryKey(id, hashedKey string) error {
+	update := bson.M{"$set": bson.M{"recovery_key": hashedKey}}
+	if _, err := r.collection.UpdateOne(context.Background(), bson.M{"_id": id}, update, options.Update()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *MasterRepositoryMongo) SetEmailChange(id string, change *model.EmailChange) error {
+	update := bson.M{"$set": bson.M{"email_change": change}}
+	if change == nil {
+		update = bson.M{"$unset": bson.M{"email_change": ""}}
+	}
+	if _, err := r.collection.UpdateOne(context.Background(), bson.M{"_id": id}, update, options.Update()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *MasterRepositoryMongo) AddEmailChangeAttempt(id string) (int, error) {
+	master := &model.Master{}
+	result := r.collection.FindOneAndUpdate(
+		context.Background(),
+		bson.M{"_id": id, "email_change": bson.M{"$exists": true}},
+		bson.M{"$inc": bson.M{"email_change.attempts": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.M{"email_change": 1}),
+	)
+	if err := result.Decode(master); err != nil {
+		return 0, err
+	}
+	return master.EmailChange.Attempts, nil
+}
+
+// the unique email index settles two masters moving to the same email
+func (r *MasterRepositoryMongo) ChangeEmail(id, oldEmail, newEmail string, verifiedAt time.Time) (bool, error) {
+	filter := bson.M{"_id": id, "email": oldEmail}
+	update := bson.M{
+		"$set": bson.M{
+			"email":              newEmail,
+			"email_verification": model.EmailVerification{SentAt: verifiedAt, VerifiedAt: &verifiedAt},
+		},
+		"$unset": bson.M{"email_change": ""},
+	}
+	result, err := r.collection.UpdateOne(context.Background(), filter, update, options.Update())
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return false, model.ErrDuplicatedEmail
+		}
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+func (r *MasterRepositoryMongo) MarkDeleted(id string, deletedAt, purgeAt time.Time) (bool, error) {
+	filter := bson.M{"_id": id, "deleted_at": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{"deleted_at": deletedAt, "purge_at": purgeAt}}
+	result, err := r.collection.UpdateOne(context.Background(), filter, update, options.Update())
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+func (r *MasterRepositoryMongo) FindPurgeable(now time.Time) ([]string, error) {
+	cursor, err := r.collection.Find(
+		context.Background(),
+		bson.M{"deleted_at": bson.M{"$exists": true}, "purge_at": bson.M{"$lte": now}},
+		options.Find().SetProjection(bson.M{"_id": 1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	masters := make([]model.Master, 0)
+	if err := cursor.All(context.Background(), &masters); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(masters))
+	for _, master := range masters {
+		ids = append(ids, master.Id)
+	}
+	return ids, nil
+}
+
+func (r *MasterRepositoryMongo) Purge(id string) error {
+	filter := bson.M{"_id": id, "deleted_at": bson.M{"$exists": true}}
+	if _, err := r.collection.DeleteOne(context.Background(), filter); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *MasterRepositoryMongo) NextTokenGeneration(id string) (int64, error) {
+	update := bson.M{"$inc": bson.M{"token_generation": 1}}
+	opts := options.FindOneAndUpdate().
+		SetReturnDocument(options.After).
+		SetProjection(bson.M{"token_generation": 1})
+	master := &model.Master{}
+	result := r.collection.FindOneAndUpdate(context.Background(), bson.M{"_id": id}, update, opts)
+	if err := result.Decode(master); err != nil {
+		return 0, err
+	}
+	return master.TokenGeneration, nil
+}
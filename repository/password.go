@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"os"
+	"time"
 
 	"github.com/danilomarques1/secretumserver/database"
 	"github.com/danilomarques1/secretumserver/model"
@@ -52,8 +53,8 @@ func (r *PasswordRepositoryMongo) Save(masterId string, password *model.Password
 func (r *PasswordRepositoryMongo) FindByKey(masterId, key string) (*model.Password, error) {
 	result := r.collection.FindOne(
 		context.Background(),
-		bson.M{"_id": masterId, "passwords.key": key},
-		options.FindOne().SetProjection(bson.M{"passwords": bson.M{"$elemMatch": bson.M{"key": key}}}),
+		bson.M{"_id": masterId, "passwords": activeKey(key)},
+		options.FindOne().SetProjection(bson.M{"passwords": activeKey(key)}),
 	)
 	master := &model.Master{}
 	if err := result.Decode(master); err != nil {
@@ -67,14 +68,73 @@ func (r *PasswordRepositoryMongo) FindByKey(masterId, key string) (*model.Passwo
 	return password, nil
 }
 
-func (r *PasswordRepositoryMongo) Remove(masterId string, password *model.Password) error {
-	_, err := r.collection.UpdateOne(
-		context.Background(),
-		bson.M{"_id": masterId},
-		bson.M{"$pull": bson.M{"passwords": bson.M{"key": password.Key}}}, options.Update(),
-	)
+// matches the password with the key that is not in the trash, a trashed
+// one may have the same key
+func activeKey(key string) bson.M {
+	return bson.M{"$elemMatch": bson.M{"key": key, "deleted_at": bson.M{"$exists": false}}}
+}
+
+func (r *PasswordRepositoryMongo) Trash(masterId, id string, deletedAt time.Time) error {
+	filter := bson.M{"_id": masterId, "passwords": bson.M{"$elemMatch": bson.M{"_id": id, "deleted_at": bson.M{"$exists": false}}}}
+	update := bson.M{"$set": bson.M{"passwords.$.deleted_at": deletedAt}}
+	if _, err := r.collection.UpdateOne(context.Background(), filter, update, options.Update()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *PasswordRepositoryMongo) FindTrash(masterId string) ([]model.Password, error) {
+	passwords, err := r.FindAll(masterId)
+	if err != nil {
+		return nil, err
+	}
+
+	trash := make([]model.Password, 0)
+	for _, password := range passwords {
+		if password.DeletedAt != nil {
+			trash = append(trash, password)
+		}
+	}
+
+	return trash, nil
+}
 
+// the key check and the restore are a single update, so a password saved
+// in the meantime with the same key is never shadowed
+func (r *PasswordRepositoryMongo) Restore(masterId, id, key string) (bool, error) {
+	filter := bson.M{
+		"_id": masterId,
+		"$and": bson.A{
+			bson.M{"passwords": bson.M{"$elemMatch": bson.M{"_id": id, "deleted_at": bson.M{"$exists": true}}}},
+			bson.M{"passwords": bson.M{"$not": activeKey(key)}},
+		},
+	}
+	update := bson.M{"$unset": bson.M{"passwords.$[trashed].deleted_at": ""}}
+	opts := options.Update().SetArrayFilters(options.ArrayFilters{
+		Filters: []interface{}{bson.M{"trashed._id": id}},
+	})
+	result, err := r.collection.UpdateOne(context.Background(), filter, update, opts)
 	if err != nil {
+		return false, err
+	}
+
+	return result.ModifiedCount == 1, nil
+}
+
+func (r *PasswordRepositoryMongo) EmptyTrash(masterId string) error {
+	update := bson.M{"$pull": bson.M{"passwords": bson.M{"deleted_at": bson.M{"$exists": true}}}}
+	if _, err := r.collection.UpdateOne(context.Background(), bson.M{"_id": masterId}, update, options.Update()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *PasswordRepositoryMongo) PurgeTrash(before time.Time) error {
+	filter := bson.M{"passwords.deleted_at": bson.M{"$lt": before}}
+	update := bson.M{"$pull": bson.M{"passwords": bson.M{"deleted_at": bson.M{"$lt": before}}}}
+	if _, err := r.collection.UpdateMany(context.Background(), filter, update, options.Update()); err != nil {
 		return err
 	}
 
@@ -82,26 +142,125 @@ func (r *PasswordRepositoryMongo) Remove(masterId string, password *model.Passwo
 }
 
 func (r *PasswordRepositoryMongo) FindKeys(masterId string) ([]string, error) {
+	passwords, err := r.FindAll(masterId)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(passwords))
+	for _, password := range passwords {
+		if password.DeletedAt == nil {
+			keys = append(keys, password.Key)
+		}
+	}
+
+	return keys, nil
+}
+
+func (r *PasswordRepositoryMongo) FindAll(masterId string) ([]model.Password, error) {
 	result := r.collection.FindOne(context.Background(), bson.M{"_id": masterId}, options.FindOne())
 	master := &model.Master{}
 	if err := result.Decode(master); err != nil {
 		return nil, err
 	}
 
-	keys := make([]string, 0, len(master.Passwords))
-	for _, password := range master.Passwords {
-		keys = append(keys, password.Key)
+	return master.Passwords, nil
+}
+
+func (r *PasswordRepositoryMongo) FindMasterIds() ([]string, error) {
+	cursor, err := r.collection.Find(
+		context.Background(),
+		bson.M{},
+		options.Find().SetProjection(bson.M{"_id": 1}),
+	)
+	if err != nil {
+		return nil, err
 	}
+	defer cursor.Close(context.Background())
 
-	return keys, nil
+	ids := make([]string, 0)
+	for cursor.Next(context.Background()) {
+		master := &model.Master{}
+		if err := cursor.Decode(master); err != nil {
+			return nil, err
+		}
+		ids = append(ids, master.Id)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
 }
 
 func (r *PasswordRepositoryMongo) Update(masterId string, password *model.Password) error {
-	filter := bson.M{"_id": masterId, "passwords.key": password.Key}
-	update := bson.M{"$set": bson.M{"passwords.$.password": password.Pwd}}
+	filter := bson.M{"_id": masterId, "passwords": activeKey(password.Key)}
+	update := bson.M{"$set": passwordFields(password)}
 	if _, err := r.collection.UpdateOne(context.Background(), filter, update, options.Update()); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+func (r *PasswordRepositoryMongo) UpdateWithVersion(masterId string, password *model.Password, version *model.PasswordVersion, keep int) error {
+	filter := bson.M{"_id": masterId, "passwords": activeKey(password.Key)}
+	update := bson.M{
+		"$set": passwordFields(password),
+		"$push": bson.M{"passwords.$.versions": bson.M{
+			"$each":     []*model.PasswordVersion{version},
+			"$position": 0,
+			"$slice":    keep,
+		}},
+	}
+	if _, err := r.collection.UpdateOne(context.Background(), filter, update, options.Update()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// the fields an update of the password sets
+func passwordFields(password *model.Password) bson.M {
+	return bson.M{
+		"passwords.$.password":  password.Pwd,
+		"passwords.$.data":      password.Data,
+		"passwords.$.username":  password.Username,
+		"passwords.$.uris":      password.URIs,
+		"passwords.$.notes":     password.Notes,
+		"passwords.$.fields":    password.Fields,
+		"passwords.$.folder_id": password.FolderId,
+		"passwords.$.tags":      password.Tags,
+	}
+}
+
+func (r *PasswordRepositoryMongo) PruneVersions(before time.Time) error {
+	filter := bson.M{"passwords.versions.replaced_at": bson.M{"$lt": before}}
+	update := bson.M{"$pull": bson.M{"passwords.$[].versions": bson.M{"replaced_at": bson.M{"$lt": before}}}}
+	if _, err := r.collection.UpdateMany(context.Background(), filter, update, options.Update()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// path is relative to the password, like "notes" or "data.value"
+func (r *PasswordRepositoryMongo) CompareAndUpdate(masterId string, password *model.Password, path, old string) (bool, error) {
+	filter := bson.M{
+		"_id":       masterId,
+		"passwords": bson.M{"$elemMatch": bson.M{"key": password.Key, path: old}},
+	}
+	update := bson.M{"$set": bson.M{
+		"passwords.$.password": password.Pwd,
+		"passwords.$.data":     password.Data,
+		"passwords.$.notes":    password.Notes,
+		"passwords.$.fields":   password.Fields,
+		"passwords.$.versions": password.Versions,
+	}}
+	result, err := r.collection.UpdateOne(context.Background(), filter, update, options.Update())
+	if err != nil {
+		return false, err
+	}
+
+	return result.ModifiedCount == 1, nil
+}
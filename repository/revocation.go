@@ -0,0 +1,222 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/danilomarques1/secretumserver/database"
+	"github.com/danilomarques1/secretumserver/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// the stores that have an in memory implementation
+const (
+	StoreMongo  = "mongo"
+	StoreMemory = "memory"
+)
+
+var ErrUnknownRevocationStore = errors.New("Unknown revocation store")
+
+// returns the store selected by REVOCATION_STORE, mongo by default. The
+// memory store is only safe with a single server instance
+func NewRevocationRepository() (model.RevocationRepository, error) {
+	switch os.Getenv("REVOCATION_STORE") {
+	case "", StoreMongo:
+		return NewRevocationRepositoryMongo()
+	case StoreMemory:
+		return NewRevocationRepositoryMemory(), nil
+	default:
+		return nil, ErrUnknownRevocationStore
+	}
+}
+
+// the id of the entry revoking every token of a master
+func masterRevocationId(masterId string) string {
+	return "master:" + masterId
+}
+
+// the id of the entry revoking every token of a session
+func sessionRevocationId(sessionId string) string {
+	return "session:" + sessionId
+}
+
+// the tokens issued before the master token generation was bumped carry
+// an older one
+func revokedByMaster(entry *model.RevokedToken, generation int64) bool {
+	return generation < entry.Generation
+}
+
+type RevocationRepositoryMongo struct {
+	client     *mongo.Client
+	collection *mongo.Collection
+}
+
+func NewRevocationRepositoryMongo() (*RevocationRepositoryMongo, error) {
+	client, err := database.GetDatabaseConnection()
+	if err != nil {
+		return nil, err
+	}
+	collection := client.Database(os.Getenv("DATABASE")).Collection("revoked_token")
+	// mongo removes the entries once the tokens they cover have expired
+	collection.Indexes().CreateOne(
+		context.Background(),
+		mongo.IndexModel{
+			Keys:    bson.M{"expires_at": 1},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	)
+
+	return &RevocationRepositoryMongo{
+		client:     client,
+		collection: collection,
+	}, nil
+}
+
+func (r *RevocationRepositoryMongo) Revoke(tokenId string, expiresAt time.Time) error {
+	return r.upsert(&model.RevokedToken{
+		Id:        tokenId,
+		RevokedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	})
+}
+
+func (r *RevocationRepositoryMongo) RevokeAllByMasterId(masterId string, generation int64, expiresAt time.Time) error {
+	return r.upsert(&model.RevokedToken{
+		Id:         masterRevocationId(masterId),
+		MasterId:   masterId,
+		Generation: generation,
+		RevokedAt:  time.Now(),
+		ExpiresAt:  expiresAt,
+	})
+}
+
+func (r *RevocationRepositoryMongo) RevokeSession(sessionId string, expiresAt time.Time) error {
+	return r.upsert(&model.RevokedToken{
+		Id:        sessionRevocationId(sessionId),
+		SessionId: sessionId,
+		RevokedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	})
+}
+
+func (r *RevocationRepositoryMongo) upsert(revoked *model.RevokedToken) error {
+	_, err := r.collection.ReplaceOne(
+		context.Background(),
+		bson.M{"_id": revoked.Id},
+		revoked,
+		options.Replace().SetUpsert(true),
+	)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *RevocationRepositoryMongo) IsRevoked(tokenId, sessionId, masterId string, generation int64) (bool, error) {
+	ids := bson.A{masterRevocationId(masterId)}
+	if len(tokenId) > 0 {
+		ids = append(ids, tokenId)
+	}
+	if len(sessionId) > 0 {
+		ids = append(ids, sessionRevocationId(sessionId))
+	}
+	filter := bson.M{"_id": bson.M{"$in": ids}, "expires_at": bson.M{"$gt": time.Now()}}
+	cursor, err := r.collection.Find(context.Background(), filter, options.Find())
+	if err != nil {
+		return false, err
+	}
+	entries := make([]model.RevokedToken, 0)
+	if err := cursor.All(context.Background(), &entries); err != nil {
+		return false, err
+	}
+
+	for i := range entries {
+		if len(entries[i].MasterId) == 0 || revokedByMaster(&entries[i], generation) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type RevocationRepositoryMemory struct {
+	mu      sync.Mutex
+	entries map[string]model.RevokedToken
+}
+
+func NewRevocationRepositoryMemory() *RevocationRepositoryMemory {
+	return &RevocationRepositoryMemory{
+		entries: make(map[string]model.RevokedToken),
+	}
+}
+
+func (r *RevocationRepositoryMemory) Revoke(tokenId string, expiresAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.removeExpired()
+	r.entries[tokenId] = model.RevokedToken{
+		Id:        tokenId,
+		RevokedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}
+	return nil
+}
+
+func (r *RevocationRepositoryMemory) RevokeAllByMasterId(masterId string, generation int64, expiresAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.removeExpired()
+	id := masterRevocationId(masterId)
+	r.entries[id] = model.RevokedToken{
+		Id:         id,
+		MasterId:   masterId,
+		Generation: generation,
+		RevokedAt:  time.Now(),
+		ExpiresAt:  expiresAt,
+	}
+	return nil
+}
+
+func (r *RevocationRepositoryMemory) RevokeSession(sessionId string, expiresAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.removeExpired()
+	id := sessionRevocationId(sessionId)
+	r.entries[id] = model.RevokedToken{
+		Id:        id,
+		SessionId: sessionId,
+		RevokedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}
+	return nil
+}
+
+func (r *RevocationRepositoryMemory) IsRevoked(tokenId, sessionId, masterId string, generation int64) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if entry, ok := r.entries[tokenId]; ok && len(tokenId) > 0 && entry.ExpiresAt.After(now) {
+		return true, nil
+	}
+	if entry, ok := r.entries[sessionRevocationId(sessionId)]; ok && len(sessionId) > 0 && entry.ExpiresAt.After(now) {
+		return true, nil
+	}
+	if entry, ok := r.entries[masterRevocationId(masterId)]; ok && entry.ExpiresAt.After(now) {
+		return revokedByMaster(&entry, generation), nil
+	}
+	return false, nil
+}
+
+// the entries are dropped once the tokens they cover have expired
+func (r *RevocationRepositoryMemory) removeExpired() {
+	now := time.Now()
+	for id, entry := range r.entries {
+		if !entry.ExpiresAt.After(now) {
+			delete(r.entries, id)
+		}
+	}
+}
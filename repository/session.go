@@ -0,0 +1,115 @@
+package repository
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/danilomarques1/secretumserver/database"
+	"github.com/danilomarques1/secretumserver/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type SessionRepositoryMongo struct {
+	client     *mongo.Client
+	collection *mongo.Collection
+}
+
+func NewSessionRepository() (*SessionRepositoryMongo, error) {
+	client, err := database.GetDatabaseConnection()
+	if err != nil {
+		return nil, err
+	}
+	collection := client.Database(os.Getenv("DATABASE")).Collection("session")
+	collection.Indexes().CreateMany(
+		context.Background(),
+		[]mongo.IndexModel{
+			{Keys: bson.M{"master_id": 1}},
+			// mongo removes the sessions once they expire
+			{Keys: bson.M{"expires_at": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+	)
+
+	return &SessionRepositoryMongo{
+		client:     client,
+		collection: collection,
+	}, nil
+}
+
+func (r *SessionRepositoryMongo) Save(session *model.Session) error {
+	if _, err := r.collection.InsertOne(context.Background(), session); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *SessionRepositoryMongo) FindById(id string) (*model.Session, error) {
+	session := &model.Session{}
+	result := r.collection.FindOne(context.Background(), bson.M{"_id": id}, options.FindOne())
+	if err := result.Decode(session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (r *SessionRepositoryMongo) FindActiveByMasterId(masterId string) ([]model.Session, error) {
+	filter := bson.M{
+		"master_id":  masterId,
+		"revoked_at": bson.M{"$exists": false},
+		"expires_at": bson.M{"$gt": time.Now()},
+	}
+	cursor, err := r.collection.Find(
+		context.Background(),
+		filter,
+		options.Find().SetSort(bson.M{"last_used_at": -1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]model.Session, 0)
+	if err := cursor.All(context.Background(), &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (r *SessionRepositoryMongo) Rotate(id, oldTokenId, newTokenId string, expiresAt time.Time) (bool, error) {
+	filter := bson.M{"_id": id, "token_id": oldTokenId, "revoked_at": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{
+		"token_id":     newTokenId,
+		"expires_at":   expiresAt,
+		"last_used_at": time.Now(),
+	}}
+	result, err := r.collection.UpdateOne(context.Background(), filter, update, options.Update())
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+func (r *SessionRepositoryMongo) Revoke(id, reason string) error {
+	filter := bson.M{"_id": id, "revoked_at": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{"revoked_at": time.Now(), "revoke_reason": reason}}
+	if _, err := r.collection.UpdateOne(context.Background(), filter, update, options.Update()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *SessionRepositoryMongo) DeleteAllByMasterId(masterId string) error {
+	if _, err := r.collection.DeleteMany(context.Background(), bson.M{"master_id": masterId}); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *SessionRepositoryMongo) RevokeAllByMasterId(masterId, reason string) error {
+	filter := bson.M{"master_id": masterId, "revoked_at": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{"revoked_at": time.Now(), "revoke_reason": reason}}
+	if _, err := r.collection.UpdateMany(context.Background(), filter, update, options.Update()); err != nil {
+		return err
+	}
+	return nil
+}
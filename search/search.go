@@ -0,0 +1,182 @@
+package search
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/danilomarques1/secretumserver/levenshtein"
+)
+
+var ErrInvalidMode = errors.New("Invalid search mode")
+
+type Mode string
+
+const (
+	ModeAll       Mode = "" // the best of the three
+	ModePrefix    Mode = "prefix"
+	ModeSubstring Mode = "substring"
+	ModeFuzzy     Mode = "fuzzy"
+)
+
+func ParseMode(value string) (Mode, error) {
+	switch mode := Mode(strings.ToLower(value)); mode {
+	case ModeAll, ModePrefix, ModeSubstring, ModeFuzzy:
+		return mode, nil
+	default:
+		return "", ErrInvalidMode
+	}
+}
+
+// scores of each kind of match, the fuzzy ones go down with the typos
+const (
+	ScoreExact     = 1.0
+	ScorePrefix    = 0.9
+	ScoreWordStart = 0.8 // the query starts a word of the value
+	ScoreSubstring = 0.7
+	ScoreFuzzy     = 0.5
+)
+
+// queries shorter than this are not matched fuzzily, too much would match
+const MinFuzzyLength = 3
+
+// Score tells how well the query matches the value, from 0, no match, to
+// 1, the same text. Both are compared lowercased
+func Score(query, value string, mode Mode) float64 {
+	query = strings.ToLower(strings.TrimSpace(query))
+	value = strings.ToLower(value)
+	if len(query) == 0 || len(value) == 0 {
+		return 0
+	}
+
+	// a prefix is a substring and a match without typos, every mode
+	// takes it
+	if value == query {
+		return ScoreExact
+	}
+	if strings.HasPrefix(value, query) {
+		return ScorePrefix
+	}
+	if mode == ModeAll || mode == ModeSubstring {
+		for _, word := range words(value) {
+			if strings.HasPrefix(word, query) {
+				return ScoreWordStart
+			}
+		}
+		if strings.Contains(value, query) {
+			return ScoreSubstring
+		}
+	}
+	if mode == ModeAll || mode == ModeFuzzy {
+		return fuzzy(query, value)
+	}
+	return 0
+}
+
+// compares the query with the start of the value and of each word in it,
+// allowing a few typos
+func fuzzy(query, value string) float64 {
+	queryRunes := []rune(query)
+	if len(queryRunes) < MinFuzzyLength {
+		return 0
+	}
+	allowed := maxEdits(len(queryRunes))
+
+	best := -1
+	for _, candidate := range append([]string{value}, words(value)...) {
+		runes := []rune(candidate)
+		// a typo may make the query longer or shorter than the prefix
+		for _, size := range []int{len(queryRunes) - 1, len(queryRunes), len(queryRunes) + 1} {
+			if size <= 0 || size > len(runes) {
+				continue
+			}
+			distance := levenshtein.Distance(queryRunes, runes[:size])
+			if distance <= allowed && (best < 0 || distance < best) {
+				best = distance
+			}
+		}
+	}
+	if best < 0 {
+		return 0
+	}
+	return ScoreFuzzy * (1 - float64(best)/float64(len(queryRunes)+1))
+}
+
+func maxEdits(length int) int {
+	switch {
+	case length <= 6:
+		return 1
+	case length <= 10:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// the words of the value, split on anything that is not a letter or a
+// digit, like in "github-work" or "mail.google.com"
+func words(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Field is a searchable value of a document, its score is multiplied by
+// the weight
+type Field struct {
+	Name   string
+	Value  string
+	Weight float64
+}
+
+type Document struct {
+	Id     string
+	Name   string // used to order the documents with the same score
+	Fields []Field
+}
+
+type Result struct {
+	Id           string
+	Score        float64
+	MatchedField string
+}
+
+// Rank returns the documents matching the query, best first, at most limit
+// of them
+func Rank(query string, mode Mode, documents []Document, limit int) []Result {
+	type ranked struct {
+		Result
+		name string
+	}
+	matches := make([]ranked, 0)
+	for _, document := range documents {
+		best := ranked{Result: Result{Id: document.Id}, name: document.Name}
+		for _, field := range document.Fields {
+			score := Score(query, field.Value, mode) * field.Weight
+			if score > best.Score {
+				best.Score = score
+				best.MatchedField = field.Name
+			}
+		}
+		if best.Score > 0 {
+			matches = append(matches, best)
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].Score != matches[j].Score {
+			return matches[i].Score > matches[j].Score
+		}
+		return matches[i].name < matches[j].name
+	})
+	if limit > 0 && len(matches) > limit {
+		matches = matches[:limit]
+	}
+
+	results := make([]Result, 0, len(matches))
+	for _, match := range matches {
+		results = append(results, match.Result)
+	}
+	return results
+}
@@ -0,0 +1,64 @@
+package search
+
+import (
+	"math"
+	"testing"
+)
+
+func TestScore(t *testing.T) {
+	tests := []struct {
+		label    string
+		query    string
+		value    string
+		mode     Mode
+		expected float64
+	}{
+		{"Should match the same text", "github", "GitHub", ModeAll, ScoreExact},
+		{"Should match a prefix", "git", "github-work", ModeAll, ScorePrefix},
+		{"Should match the start of a word", "work", "github-work", ModeAll, ScoreWordStart},
+		{"Should match a substring", "hub", "github-work", ModeAll, ScoreSubstring},
+		{"Should not match a substring in prefix mode", "hub", "github-work", ModePrefix, 0},
+		{"Should not match a typo in substring mode", "githbu", "github-work", ModeSubstring, 0},
+		{"Should match a typo in fuzzy mode", "githbu", "github-work", ModeFuzzy, ScoreFuzzy * (1 - 1.0/7)},
+		{"Should match a missing letter", "gthub", "github", ModeAll, ScoreFuzzy * (1 - 1.0/6)},
+		{"Should not match short queries fuzzily", "gt", "github", ModeFuzzy, 0},
+		{"Should not match too many typos", "gitlab", "github", ModeAll, 0},
+		{"Should not match an empty query", " ", "github", ModeAll, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.label, func(t *testing.T) {
+			if score := Score(test.query, test.value, test.mode); math.Abs(score-test.expected) > 1e-9 {
+				t.Fatalf("Wrong score expected %v got %v\n", test.expected, score)
+			}
+		})
+	}
+}
+
+func TestRank(t *testing.T) {
+	documents := []Document{
+		{Id: "1", Name: "mail", Fields: []Field{{"key", "mail", 1}, {"host", "mail.google.com", 0.8}}},
+		{Id: "2", Name: "google", Fields: []Field{{"key", "google", 1}}},
+		{Id: "3", Name: "github", Fields: []Field{{"key", "github", 1}, {"tag", "work", 0.7}}},
+		{Id: "4", Name: "gmail", Fields: []Field{{"key", "gmail", 1}, {"username", "me@google.com", 0.8}}},
+	}
+
+	results := Rank("google", ModeAll, documents, 10)
+	// the ties are ordered by name
+	expected := []string{"2", "4", "1"}
+	if len(results) != len(expected) {
+		t.Fatalf("Wrong number of results expected %v got %v\n", len(expected), results)
+	}
+	for i, id := range expected {
+		if results[i].Id != id {
+			t.Fatalf("Wrong result at %v expected %v got %v\n", i, id, results[i].Id)
+		}
+	}
+	if results[2].MatchedField != "host" {
+		t.Fatalf("Wrong matched field expected host got %v\n", results[2].MatchedField)
+	}
+
+	if results := Rank("google", ModeAll, documents, 1); len(results) != 1 {
+		t.Fatalf("Results should be limited to 1 got %v\n", len(results))
+	}
+}
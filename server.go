@@ -1,35 +1,113 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"net"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/danilomarques1/secretumserver/pb"
+	"github.com/danilomarques1/secretumserver/ratelimit"
+	"github.com/danilomarques1/secretumserver/repository"
 	"github.com/danilomarques1/secretumserver/service"
+	"github.com/danilomarques1/secretumserver/token"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 )
 
 type Server struct {
-	gServer *grpc.Server
+	gServer      *grpc.Server
+	barrier      *service.Barrier
+	keyRotation  *service.KeyRotation
+	authPolicies map[string]service.AuthPolicy // by service name
+	limiter      *ratelimit.Limiter
+	limits       ratelimit.Limits
+	purger       *service.AccountPurger
+	pruner       *service.VersionPruner
+	trashPurger  *service.TrashPurger
 }
 
 func NewServer() (*Server, error) {
-	masterService, err := service.NewMasterService()
+	if err := token.LoadKeys(); err != nil {
+		return nil, err
+	}
+	revocationStore, err := repository.NewRevocationRepository()
+	if err != nil {
+		return nil, err
+	}
+	token.SetRevocationStore(revocationStore)
+	limits, err := ratelimit.LoadLimits()
+	if err != nil {
+		return nil, err
+	}
+	// in zero knowledge mode the server holds no encryption keys
+	var barrier *service.Barrier
+	var keyRotation *service.KeyRotation
+	if !service.IsZeroKnowledge() {
+		var err error
+		if barrier, err = service.NewBarrier(); err != nil {
+			return nil, err
+		}
+		if keyRotation, err = service.NewKeyRotation(barrier); err != nil {
+			return nil, err
+		}
+	}
+	masterService, err := service.NewMasterService(barrier)
+	if err != nil {
+		return nil, err
+	}
+	passwordService, err := service.NewPasswordService(barrier)
 	if err != nil {
 		return nil, err
 	}
-	passwordService, err := service.NewPasswordService()
+	purger, err := service.NewAccountPurger(barrier)
+	if err != nil {
+		return nil, err
+	}
+	pruner, err := service.NewVersionPruner()
+	if err != nil {
+		return nil, err
+	}
+	trashPurger, err := service.NewTrashPurger()
 	if err != nil {
 		return nil, err
 	}
-	gServer := grpc.NewServer()
-	pb.RegisterMasterServer(gServer, masterService)
-	pb.RegisterPasswordServer(gServer, passwordService)
 	s := &Server{
-		gServer: gServer,
+		barrier:     barrier,
+		keyRotation: keyRotation,
+		authPolicies: map[string]service.AuthPolicy{
+			pb.Master_ServiceDesc.ServiceName:   masterService,
+			pb.Password_ServiceDesc.ServiceName: passwordService,
+		},
+		limiter:     ratelimit.NewLimiter(),
+		limits:      limits,
+		purger:      purger,
+		pruner:      pruner,
+		trashPurger: trashPurger,
 	}
+	// the rate limit runs before the auth, so floods of bad tokens are
+	// throttled too
+	s.gServer = grpc.NewServer(
+		grpc.ChainUnaryInterceptor(s.unaryRateLimitInterceptor, s.unaryAuthInterceptor),
+		grpc.ChainStreamInterceptor(s.streamRateLimitInterceptor, s.streamAuthInterceptor),
+	)
+	pb.RegisterMasterServer(s.gServer, masterService)
+	pb.RegisterPasswordServer(s.gServer, passwordService)
+	adminService, err := service.NewAdminService(barrier, keyRotation)
+	if err != nil {
+		return nil, err
+	}
+	s.authPolicies[pb.Admin_ServiceDesc.ServiceName] = adminService
+	pb.RegisterAdminServer(s.gServer, adminService)
 
 	return s, nil
 }
@@ -42,6 +120,22 @@ func (s *Server) Run() error {
 	}
 	defer lis.Close()
 
+	// the key jobs need the keys, they run once the vault is unsealed
+	if s.barrier != nil {
+		s.barrier.OnUnseal(s.runKeyJobs)
+	}
+
+	// removes the deleted masters once their purge delay is over
+	go s.purger.Run(context.Background())
+	// removes the password versions older than the retention
+	go s.pruner.Run(context.Background())
+	// removes the passwords that stayed in the trash too long
+	go s.trashPurger.Run(context.Background())
+
+	if addr := os.Getenv("JWKS_ADDR"); len(addr) > 0 {
+		go serveJWKS(addr)
+	}
+
 	log.Printf("Starting grpc server on port %v\n", port)
 	if err := s.gServer.Serve(lis); err != nil {
 		return err
@@ -49,3 +143,192 @@ func (s *Server) Run() error {
 
 	return nil
 }
+
+func (s *Server) runKeyJobs(dataKeys *service.DataKeys) {
+	// rewraps the data keys after the key encryption key was rotated
+	if os.Getenv("KEK_REWRAP") == "true" {
+		if err := dataKeys.Rewrap(context.Background()); err != nil {
+			log.Printf("Error rewrapping data keys %v\n", err)
+		}
+	}
+
+	// re-encrypts the passwords that are not under the master data key
+	if os.Getenv("ENCRYPT_ROTATE") == "true" {
+		if err := s.keyRotation.Run(context.Background()); err != nil {
+			log.Printf("Error running key rotation %v\n", err)
+		}
+	}
+}
+
+// publishes the token public keys as a jwks document over http
+func serveJWKS(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/jwks.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "max-age=300")
+		if err := json.NewEncoder(w).Encode(token.PublicKeys()); err != nil {
+			log.Printf("Error encoding jwks %v\n", err)
+		}
+	})
+
+	log.Printf("Starting jwks server on %v\n", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("Error serving jwks %v\n", err)
+	}
+}
+
+// the request messages that still carry the deprecated access_token field
+type legacyAccessToken interface {
+	GetAccessToken() string
+}
+
+func (s *Server) unaryAuthInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, err := s.authenticate(ctx, info.FullMethod, req)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *Server) streamAuthInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	// streams only accept the authorization metadata
+	ctx, err := s.authenticate(ss.Context(), info.FullMethod, nil)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authServerStream{ServerStream: ss, ctx: ctx})
+}
+
+// validates the bearer token of the authorization metadata, falling back
+// to the access_token field of the request, and puts the claims in the
+// context. Methods of services without a policy always need a token
+func (s *Server) authenticate(ctx context.Context, fullMethod string, req any) (context.Context, error) {
+	serviceName, method := splitFullMethod(fullMethod)
+	if policy, ok := s.authPolicies[serviceName]; ok && !policy.RequiresAuth(method) {
+		return ctx, nil
+	}
+
+	tokenStr, legacy := requestToken(ctx, req)
+	if legacy {
+		log.Printf("Deprecated access_token field used on %v\n", fullMethod)
+	}
+	if len(tokenStr) == 0 {
+		return nil, status.Errorf(codes.Unauthenticated, service.ErrUnauthenticated)
+	}
+
+	claims, err := token.ValidateAccessToken(tokenStr)
+	if err != nil {
+		log.Printf("Error validating token %v\n", err)
+		return nil, status.Errorf(codes.Unauthenticated, service.ErrUnauthenticated)
+	}
+
+	return token.NewContext(ctx, claims), nil
+}
+
+// returns the bearer token, or the access_token field of the request
+// while it is allowed and whether that field was used
+func requestToken(ctx context.Context, req any) (string, bool) {
+	if tokenStr := bearerToken(ctx); len(tokenStr) > 0 {
+		return tokenStr, false
+	}
+	if allowLegacyAccessToken() {
+		if legacy, ok := req.(legacyAccessToken); ok && len(legacy.GetAccessToken()) > 0 {
+			return legacy.GetAccessToken(), true
+		}
+	}
+	return "", false
+}
+
+func bearerToken(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	for _, value := range md.Get("authorization") {
+		scheme, tokenStr, found := strings.Cut(value, " ")
+		if found && strings.EqualFold(scheme, "bearer") {
+			return strings.TrimSpace(tokenStr)
+		}
+	}
+	return ""
+}
+
+// the access_token field is accepted until ALLOW_LEGACY_ACCESS_TOKEN is
+// set to false, so older clients keep working
+func allowLegacyAccessToken() bool {
+	return os.Getenv("ALLOW_LEGACY_ACCESS_TOKEN") != "false"
+}
+
+func (s *Server) unaryRateLimitInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	setTrailer := func(md metadata.MD) {
+		if err := grpc.SetTrailer(ctx, md); err != nil {
+			log.Printf("Error setting rate limit trailer %v\n", err)
+		}
+	}
+	if err := s.rateLimit(ctx, info.FullMethod, req, setTrailer); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *Server) streamRateLimitInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := s.rateLimit(ss.Context(), info.FullMethod, nil, ss.SetTrailer); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// takes a token from the bucket of the client for the method and reports
+// the budget left in the trailers
+func (s *Server) rateLimit(ctx context.Context, fullMethod string, req any, setTrailer func(metadata.MD)) error {
+	serviceName, method := splitFullMethod(fullMethod)
+	rate := s.limits.For(serviceName, method)
+	if rate.Disabled() {
+		return nil
+	}
+
+	result := s.limiter.Allow(fullMethod+" "+rateLimitClient(ctx, req), rate)
+	setTrailer(metadata.Pairs(
+		"x-ratelimit-limit", strconv.Itoa(result.Limit),
+		"x-ratelimit-remaining", strconv.Itoa(result.Remaining),
+		"x-ratelimit-reset", strconv.Itoa(int(math.Ceil(result.Reset.Seconds()))),
+	))
+	if !result.Allowed {
+		log.Printf("Rate limit exceeded on %v\n", fullMethod)
+		return service.RetryError(service.ErrRateLimited, result.Reset)
+	}
+	return nil
+}
+
+// requests with a signed access token are limited by master, the others
+// by address. Revoked tokens are only rejected afterwards by the auth
+func rateLimitClient(ctx context.Context, req any) string {
+	tokenStr, _ := requestToken(ctx, req)
+	if masterId, err := token.MasterIdOf(tokenStr); err == nil {
+		return "master:" + masterId
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		host, _, err := net.SplitHostPort(p.Addr.String())
+		if err != nil {
+			host = p.Addr.String()
+		}
+		return "ip:" + host
+	}
+	return "unknown"
+}
+
+// "/package.Service/Method" into "package.Service" and "Method"
+func splitFullMethod(fullMethod string) (string, string) {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	serviceName, method, _ := strings.Cut(fullMethod, "/")
+	return serviceName, method
+}
+
+type authServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authServerStream) Context() context.Context {
+	return s.ctx
+}
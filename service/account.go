@@ -0,0 +1,371 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/danilomarques1/secretumserver/encrypt"
+	"github.com/danilomarques1/secretumserver/model"
+	"github.com/danilomarques1/secretumserver/pb"
+	"github.com/danilomarques1/secretumserver/repository"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	ErrAccountDeleted = "The account was already deleted"
+)
+
+const (
+	DefaultPurgeDelay    = 30 * 24 * time.Hour
+	DefaultPurgeInterval = time.Hour
+)
+
+// version of the export format, changed when a field changes meaning
+const ExportFormat = 1
+
+const (
+	ExportProfileRecord  = "profile"
+	ExportPasswordRecord = "password"
+)
+
+// ExportRecord is one message of ExportAccount. The first record is the
+// profile of the master and every password follows in its own record, so
+// writing one record per line gives a json lines file:
+//
+//	{"type":"profile","format":1,"exported_at":"2023-01-31T10:00:00Z","profile":{...}}
+//	{"type":"password","password":{"id":"...","key":"github","type":"login","password":"...","username":"...","uris":["https://github.com"]}}
+//	{"type":"password","password":{"id":"...","key":"visa","type":"card","data":{"number":"...","expiration":"01/30"}}}
+//
+// In zero knowledge mode the passwords, notes and hidden fields are
+// exported as the client encrypted blobs they were saved as. A password
+// that fails the integrity check has only its id, key and an error
+type ExportRecord struct {
+	Type       string          `json:"type"`
+	Format     int             `json:"format,omitempty"`
+	ExportedAt *time.Time      `json:"exported_at,omitempty"`
+	Profile    *ExportProfile  `json:"profile,omitempty"`
+	Password   *ExportPassword `json:"password,omitempty"`
+}
+
+type ExportProfile struct {
+	Id                string          `json:"id"`
+	Email             string          `json:"email"`
+	EmailVerified     bool            `json:"email_verified"`
+	PasswordUpdatedAt time.Time       `json:"password_updated_at"`
+	PasswordExpiresAt *time.Time      `json:"password_expires_at,omitempty"`
+	TwoFactorEnabled  bool            `json:"two_factor_enabled"`
+	ZeroKnowledge     bool            `json:"zero_knowledge"`
+	Sessions          []ExportSession `json:"sessions"`
+	Folders           []ExportFolder  `json:"folders"`
+}
+
+// the folders at the root have no parent id
+type ExportFolder struct {
+	Id       string `json:"id"`
+	Name     string `json:"name"`
+	ParentId string `json:"parent_id,omitempty"`
+}
+
+type ExportSession struct {
+	Id         string    `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	PeerAddr   string    `json:"peer_addr"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+// the logins have a password, the other item types have their data
+type ExportPassword struct {
+	Id        string              `json:"id"`
+	Key       string              `json:"key"`
+	Type      string              `json:"type"`
+	Password  string              `json:"password,omitempty"`
+	Data      map[string]string   `json:"data,omitempty"`
+	Username  string              `json:"username,omitempty"`
+	URIs      []string            `json:"uris,omitempty"`
+	Notes     string              `json:"notes,omitempty"`
+	Fields    []ExportCustomField `json:"fields,omitempty"`
+	FolderId  string              `json:"folder_id,omitempty"`
+	Tags      []string            `json:"tags,omitempty"`
+	DeletedAt *time.Time          `json:"deleted_at,omitempty"` // set for the passwords in the trash
+	Error     string              `json:"error,omitempty"`
+}
+
+// the value of a boolean field is "true" or "false"
+type ExportCustomField struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// how long a deleted master is kept before it is purged
+func purgeDelay() time.Duration {
+	return getEnvDuration("ACCOUNT_PURGE_DELAY", DefaultPurgeDelay)
+}
+
+// soft deletes the master. It can no longer log in and is purged, data
+// key included, once the purge delay is over. Until then its email is
+// still taken and can not be used to sign up again
+func (ms *MasterService) DeleteMaster(ctx context.Context, in *pb.DeleteMasterRequest) (*pb.DeleteMasterResponse, error) {
+	if !hasCredential(in) {
+		log.Printf("Error validating delete master request\n")
+		return nil, status.Errorf(codes.InvalidArgument, ErrValidation)
+	}
+	master, err := ms.reauthenticate(ctx, in.GetPassword(), in.GetAuthHash())
+	if err != nil {
+		return nil, err
+	}
+	if err := ms.checkSecondFactor(ctx, master, in.GetCode(), in.GetRecoveryCode()); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	purgeAt := now.Add(purgeDelay())
+	deleted, err := ms.masterRepo.MarkDeleted(master.Id, now, purgeAt)
+	if err != nil {
+		log.Printf("Error deleting master %v\n", err)
+		return nil, err
+	}
+	if !deleted {
+		return nil, status.Errorf(codes.NotFound, ErrAccountDeleted)
+	}
+	if err := ms.revokeAll(master.Id, RevokedDeleted); err != nil {
+		return nil, err
+	}
+
+	return &pb.DeleteMasterResponse{OK: true, PurgeAt: purgeAt.Unix()}, nil
+}
+
+// streams the profile and every decrypted password of the master, see
+// ExportRecord for the format
+func (ms *MasterService) ExportAccount(in *pb.ExportAccountRequest, stream pb.Master_ExportAccountServer) error {
+	ctx := stream.Context()
+	if !hasCredential(in) {
+		log.Printf("Error validating export account request\n")
+		return status.Errorf(codes.InvalidArgument, ErrValidation)
+	}
+	master, err := ms.reauthenticate(ctx, in.GetPassword(), in.GetAuthHash())
+	if err != nil {
+		return err
+	}
+	if err := ms.checkSecondFactor(ctx, master, in.GetCode(), in.GetRecoveryCode()); err != nil {
+		return err
+	}
+
+	sessions, err := ms.sessionRepo.FindActiveByMasterId(master.Id)
+	if err != nil {
+		log.Printf("Error finding sessions %v\n", err)
+		return err
+	}
+	exportedAt := time.Now().UTC()
+	profile := &ExportProfile{
+		Id:                master.Id,
+		Email:             master.Email,
+		EmailVerified:     master.EmailVerified(),
+		PasswordUpdatedAt: master.PwdUpdatedAt,
+		TwoFactorEnabled:  master.TwoFactor != nil && master.TwoFactor.Confirmed,
+		ZeroKnowledge:     IsZeroKnowledge(),
+		Sessions:          make([]ExportSession, 0, len(sessions)),
+		Folders:           make([]ExportFolder, 0, len(master.Folders)),
+	}
+	for _, folder := range master.Folders {
+		profile.Folders = append(profile.Folders, ExportFolder(folder))
+	}
+	if expiresAt := ms.getPasswordExpirationDate(master); !expiresAt.IsZero() {
+		profile.PasswordExpiresAt = &expiresAt
+	}
+	for _, session := range sessions {
+		profile.Sessions = append(profile.Sessions, ExportSession{
+			Id:         session.Id,
+			UserAgent:  session.UserAgent,
+			PeerAddr:   session.PeerAddr,
+			CreatedAt:  session.CreatedAt,
+			LastUsedAt: session.LastUsedAt,
+		})
+	}
+	record := &ExportRecord{
+		Type:       ExportProfileRecord,
+		Format:     ExportFormat,
+		ExportedAt: &exportedAt,
+		Profile:    profile,
+	}
+	if err := sendExportRecord(stream, record); err != nil {
+		return err
+	}
+
+	for i := range master.Passwords {
+		password := &master.Passwords[i]
+		exported := &ExportPassword{
+			Id:        password.Id,
+			Key:       password.Key,
+			Type:      password.ItemType(),
+			FolderId:  password.FolderId,
+			Tags:      password.Tags,
+			DeletedAt: password.DeletedAt,
+		}
+		err := ms.openPassword(master.Id, password)
+		if errors.Is(err, encrypt.ErrAuthentication) {
+			log.Printf("Error decrypting exported password %v\n", err)
+			exported.Error = ErrPasswordCorrupt
+		} else if err != nil {
+			log.Printf("Error decrypting exported password %v\n", err)
+			return err
+		} else {
+			exported.Password = password.Pwd
+			if len(password.Data) > 0 {
+				exported.Data = make(map[string]string)
+				for _, field := range password.Data {
+					exported.Data[field.Name] = field.Value
+				}
+			}
+			exported.Username = password.Username
+			exported.URIs = password.URIs
+			exported.Notes = password.Notes
+			for _, field := range password.Fields {
+				exported.Fields = append(exported.Fields, ExportCustomField(field))
+			}
+		}
+
+		record := &ExportRecord{Type: ExportPasswordRecord, Password: exported}
+		if err := sendExportRecord(stream, record); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func sendExportRecord(stream pb.Master_ExportAccountServer, record *ExportRecord) error {
+	content, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Error encoding export record %v\n", err)
+		return err
+	}
+	if err := stream.Send(&pb.ExportAccountResponse{Record: content}); err != nil {
+		log.Printf("Error sending export record %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// masters with two factor need a code too
+func (ms *MasterService) checkSecondFactor(ctx context.Context, master *model.Master, code, recoveryCode string) error {
+	if master.TwoFactor == nil || !master.TwoFactor.Confirmed {
+		return nil
+	}
+	if len(code) == 0 && len(recoveryCode) == 0 {
+		return status.Errorf(codes.Unauthenticated, ErrInvalidTwoFactorCode)
+	}
+	used, err := ms.useSecondFactor(master, code, recoveryCode)
+	if err != nil {
+		return err
+	}
+	if !used {
+		ms.attempts.Failure(ctx, master.Email)
+		return status.Errorf(codes.Unauthenticated, ErrInvalidTwoFactorCode)
+	}
+	return nil
+}
+
+func (ms *MasterService) openPassword(masterId string, password *model.Password) error {
+	if ms.barrier == nil {
+		return nil
+	}
+	dataKeys, err := ms.barrier.DataKeys()
+	if err != nil {
+		return status.Errorf(codes.Unavailable, ErrVaultSealed)
+	}
+	keyring, err := dataKeys.Keyring(masterId)
+	if err != nil {
+		return err
+	}
+	return openPassword(keyring, masterId, password)
+}
+
+// AccountPurger removes the deleted masters and their sessions once their
+// purge delay is over. Their data key is shredded first, so the passwords
+// are unreadable even where a copy of the document survives
+type AccountPurger struct {
+	masterRepo  model.MasterRepository
+	sessionRepo model.SessionRepository
+	barrier     *Barrier // nil in zero knowledge mode
+	interval    time.Duration
+}
+
+func NewAccountPurger(barrier *Barrier) (*AccountPurger, error) {
+	masterRepo, err := repository.NewMasterRepository()
+	if err != nil {
+		log.Printf("Error creating account purger %v\n", err)
+		return nil, err
+	}
+	sessionRepo, err := repository.NewSessionRepository()
+	if err != nil {
+		log.Printf("Error creating account purger %v\n", err)
+		return nil, err
+	}
+
+	return &AccountPurger{
+		masterRepo:  masterRepo,
+		sessionRepo: sessionRepo,
+		barrier:     barrier,
+		interval:    getEnvDuration("ACCOUNT_PURGE_INTERVAL", DefaultPurgeInterval),
+	}, nil
+}
+
+// Run purges the due masters every interval until ctx is done
+func (ap *AccountPurger) Run(ctx context.Context) {
+	ticker := time.NewTicker(ap.interval)
+	defer ticker.Stop()
+	for {
+		if err := ap.Purge(time.Now()); err != nil {
+			log.Printf("Error purging deleted masters %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Purge removes every master whose purge date is before now
+func (ap *AccountPurger) Purge(now time.Time) error {
+	ids, err := ap.masterRepo.FindPurgeable(now)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := ap.shred(id); err != nil {
+			log.Printf("Error shredding data key of master %v %v\n", id, err)
+			continue
+		}
+		// the sessions go first, a failure leaves the master to retry later
+		if err := ap.sessionRepo.DeleteAllByMasterId(id); err != nil {
+			log.Printf("Error deleting sessions of master %v %v\n", id, err)
+			continue
+		}
+		if err := ap.masterRepo.Purge(id); err != nil {
+			log.Printf("Error purging master %v %v\n", id, err)
+			continue
+		}
+		log.Printf("Master %v purged\n", id)
+	}
+	return nil
+}
+
+// while sealed the data key is not cached, removing the document is
+// enough to destroy it
+func (ap *AccountPurger) shred(masterId string) error {
+	if ap.barrier == nil {
+		return nil
+	}
+	dataKeys, err := ap.barrier.DataKeys()
+	if err != nil {
+		return nil
+	}
+	return dataKeys.Shred(masterId)
+}
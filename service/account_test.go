@@ -0,0 +1,266 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/danilomarques1/secretumserver/model"
+	"github.com/danilomarques1/secretumserver/pb"
+	"github.com/danilomarques1/secretumserver/token"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// keeps the masters in memory, only what the account methods and the
+// purger use
+type accountRepository struct {
+	model.MasterRepository
+	masters map[string]*model.Master
+}
+
+func (r *accountRepository) FindById(id string) (*model.Master, error) {
+	master, ok := r.masters[id]
+	if !ok || master.DeletedAt != nil {
+		return nil, status.Errorf(codes.NotFound, ErrWrongPassword)
+	}
+	found := *master
+	return &found, nil
+}
+
+func (r *accountRepository) MarkDeleted(id string, deletedAt, purgeAt time.Time) (bool, error) {
+	master := r.masters[id]
+	if master.DeletedAt != nil {
+		return false, nil
+	}
+	master.DeletedAt = &deletedAt
+	master.PurgeAt = &purgeAt
+	return true, nil
+}
+
+func (r *accountRepository) NextTokenGeneration(id string) (int64, error) {
+	r.masters[id].TokenGeneration++
+	return r.masters[id].TokenGeneration, nil
+}
+
+func (r *accountRepository) FindPurgeable(now time.Time) ([]string, error) {
+	ids := make([]string, 0)
+	for id, master := range r.masters {
+		if master.PurgeAt != nil && master.PurgeAt.Before(now) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (r *accountRepository) Purge(id string) error {
+	delete(r.masters, id)
+	return nil
+}
+
+// collects the records sent by ExportAccount
+type exportStream struct {
+	pb.Master_ExportAccountServer
+	ctx     context.Context
+	records []ExportRecord
+}
+
+func (s *exportStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *exportStream) Send(response *pb.ExportAccountResponse) error {
+	var record ExportRecord
+	if err := json.Unmarshal(response.GetRecord(), &record); err != nil {
+		return err
+	}
+	s.records = append(s.records, record)
+	return nil
+}
+
+// returns the sessions of every master as active
+type activeSessionRepository struct {
+	revokedSessionRepository
+	sessions []model.Session
+}
+
+func (r *activeSessionRepository) FindActiveByMasterId(masterId string) ([]model.Session, error) {
+	return r.sessions, nil
+}
+
+func (r *activeSessionRepository) DeleteAllByMasterId(masterId string) error {
+	sessions := make([]model.Session, 0)
+	for _, session := range r.sessions {
+		if session.MasterId != masterId {
+			sessions = append(sessions, session)
+		}
+	}
+	r.sessions = sessions
+	return nil
+}
+
+func newAccountService(t *testing.T, master *model.Master) (*MasterService, *accountRepository, *activeSessionRepository) {
+	t.Setenv("VAULT_MODE", "")
+	pwd, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Err should when hashing be nil %v\n", err)
+	}
+	master.Pwd = string(pwd)
+	repo := &accountRepository{masters: map[string]*model.Master{master.Id: master}}
+	sessionRepo := &activeSessionRepository{}
+	ms := &MasterService{
+		masterRepo:  repo,
+		sessionRepo: sessionRepo,
+		attempts:    newTestAttemptTracker(),
+		expiration:  &ExpirationSettings{Default: &model.ExpirationPolicy{Mode: model.ExpireNever}},
+	}
+	return ms, repo, sessionRepo
+}
+
+func TestDeleteMaster(t *testing.T) {
+	t.Setenv("ACCOUNT_PURGE_DELAY", "48h")
+	deletedAt := time.Now().Add(-time.Hour)
+	tests := []struct {
+		label    string
+		master   *model.Master
+		password string
+		code     codes.Code
+	}{
+		{"deleted", &model.Master{Id: "id"}, "password", codes.OK},
+		{"wrong password", &model.Master{Id: "id"}, "wrong", codes.NotFound},
+		{"without the second factor", &model.Master{Id: "id", TwoFactor: &model.TwoFactor{Confirmed: true}}, "password", codes.Unauthenticated},
+		{"with an unconfirmed second factor", &model.Master{Id: "id", TwoFactor: &model.TwoFactor{}}, "password", codes.OK},
+		{"already deleted", &model.Master{Id: "id", DeletedAt: &deletedAt}, "password", codes.NotFound},
+	}
+
+	for _, test := range tests {
+		ms, repo, sessionRepo := newAccountService(t, test.master)
+		ctx := token.NewContext(context.Background(), &token.Claims{MasterId: "id"})
+
+		response, err := ms.DeleteMaster(ctx, &pb.DeleteMasterRequest{Password: test.password})
+		if code := status.Code(err); code != test.code {
+			t.Fatalf("Wrong code for %v expected %v got %v %v\n", test.label, test.code, code, err)
+		}
+		if test.code != codes.OK {
+			if len(sessionRepo.revoked) > 0 {
+				t.Fatalf("The sessions should not be revoked for %v\n", test.label)
+			}
+			continue
+		}
+
+		master := repo.masters["id"]
+		if master.DeletedAt == nil || master.PurgeAt == nil || master.PurgeAt.Unix() != response.GetPurgeAt() {
+			t.Fatalf("The master should be deleted for %v got %v %v\n", test.label, master.DeletedAt, master.PurgeAt)
+		}
+		if delay := master.PurgeAt.Sub(*master.DeletedAt); delay != 48*time.Hour {
+			t.Fatalf("Wrong purge delay for %v expected %v got %v\n", test.label, 48*time.Hour, delay)
+		}
+		if len(sessionRepo.revoked) != 1 || master.TokenGeneration != 1 {
+			t.Fatalf("The tokens should have been revoked for %v\n", test.label)
+		}
+	}
+}
+
+func TestExportAccount(t *testing.T) {
+	master := &model.Master{
+		Id:      "id",
+		Email:   "john@mail.com",
+		Folders: []model.Folder{{Id: "work", Name: "work"}},
+		Passwords: []model.Password{
+			{
+				Id: "1", Key: "github", Pwd: "secret", Username: "john",
+				URIs:   []string{"https://github.com"},
+				Fields: []model.CustomField{{Name: "pin", Type: model.FieldHidden, Value: "1234"}},
+			},
+			{
+				Id: "2", Key: "visa", Type: model.ItemCard, FolderId: "work", Tags: []string{"bank"},
+				Data: []model.ItemField{{Name: "number", Value: "4111111111111111"}},
+			},
+		},
+	}
+	ms, _, sessionRepo := newAccountService(t, master)
+	sessionRepo.sessions = []model.Session{{Id: "session", UserAgent: "cli"}}
+	stream := &exportStream{ctx: token.NewContext(context.Background(), &token.Claims{MasterId: "id"})}
+
+	if err := ms.ExportAccount(&pb.ExportAccountRequest{Password: "wrong"}, stream); status.Code(err) != codes.NotFound {
+		t.Fatalf("Wrong code with the wrong password expected %v got %v\n", codes.NotFound, status.Code(err))
+	}
+	if len(stream.records) > 0 {
+		t.Fatalf("Nothing should be exported with the wrong password got %v\n", stream.records)
+	}
+	if err := ms.ExportAccount(&pb.ExportAccountRequest{Password: "password"}, stream); err != nil {
+		t.Fatalf("Err should when exporting be nil %v\n", err)
+	}
+
+	if len(stream.records) != 3 {
+		t.Fatalf("Wrong number of records expected 3 got %v\n", len(stream.records))
+	}
+	profile := stream.records[0]
+	if profile.Type != ExportProfileRecord || profile.Format != ExportFormat || profile.Profile == nil {
+		t.Fatalf("The first record should be the profile got %v\n", profile)
+	}
+	if profile.Profile.Email != "john@mail.com" || len(profile.Profile.Sessions) != 1 || len(profile.Profile.Folders) != 1 {
+		t.Fatalf("Wrong profile got %v\n", profile.Profile)
+	}
+	tests := []struct {
+		label    string
+		record   ExportRecord
+		password ExportPassword
+	}{
+		{"login", stream.records[1], ExportPassword{
+			Id: "1", Key: "github", Type: model.ItemLogin, Password: "secret", Username: "john",
+			URIs:   []string{"https://github.com"},
+			Fields: []ExportCustomField{{Name: "pin", Type: model.FieldHidden, Value: "1234"}},
+		}},
+		{"card", stream.records[2], ExportPassword{
+			Id: "2", Key: "visa", Type: model.ItemCard, FolderId: "work", Tags: []string{"bank"},
+			Data: map[string]string{"number": "4111111111111111"},
+		}},
+	}
+	for _, test := range tests {
+		if test.record.Type != ExportPasswordRecord || !reflect.DeepEqual(*test.record.Password, test.password) {
+			t.Fatalf("Wrong %v record expected %v got %v\n", test.label, test.password, test.record.Password)
+		}
+	}
+}
+
+func TestAccountPurgerPurge(t *testing.T) {
+	now := time.Now()
+	at := func(d time.Duration) *time.Time {
+		date := now.Add(d)
+		return &date
+	}
+	repo := &accountRepository{masters: map[string]*model.Master{
+		"due":      {Id: "due", DeletedAt: at(-48 * time.Hour), PurgeAt: at(-time.Hour)},
+		"also due": {Id: "also due", DeletedAt: at(-72 * time.Hour), PurgeAt: at(-24 * time.Hour)},
+		"not due":  {Id: "not due", DeletedAt: at(-time.Hour), PurgeAt: at(time.Hour)},
+		"active":   {Id: "active"},
+	}}
+	sessionRepo := &activeSessionRepository{sessions: []model.Session{
+		{Id: "1", MasterId: "due"},
+		{Id: "2", MasterId: "also due"},
+		{Id: "3", MasterId: "not due"},
+		{Id: "4", MasterId: "active"},
+	}}
+	ap := &AccountPurger{masterRepo: repo, sessionRepo: sessionRepo}
+
+	if err := ap.Purge(now); err != nil {
+		t.Fatalf("Err should when purging be nil %v\n", err)
+	}
+	ids := make([]string, 0)
+	for id := range repo.masters {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if !reflect.DeepEqual(ids, []string{"active", "not due"}) {
+		t.Fatalf("Wrong masters left expected %v got %v\n", []string{"active", "not due"}, ids)
+	}
+	if len(sessionRepo.sessions) != 2 || sessionRepo.sessions[0].Id != "3" || sessionRepo.sessions[1].Id != "4" {
+		t.Fatalf("Only the sessions of the purged masters should be deleted got %v\n", sessionRepo.sessions)
+	}
+}
@@ -0,0 +1,224 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"log"
+	"os"
+
+	"github.com/danilomarques1/secretumserver/model"
+	"github.com/danilomarques1/secretumserver/pb"
+	"github.com/danilomarques1/secretumserver/repository"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	ErrInvalidShare     = "Invalid unseal share"
+	ErrWrongAdminToken  = "The given admin token is invalid"
+	ErrUnsealFailed     = "The given shares do not unseal the vault"
+	ErrWrongUnsealNonce = "The given nonce is not the one of the current unseal"
+	ErrVaultNotSealable = "The vault has no seal file"
+	ErrMasterNotFound   = "Master not found"
+	ErrNoKeyRotation    = "The vault has no key rotation"
+)
+
+// AdminService lets the operators unseal and seal the vault and manage the
+// masters. Starting an unseal needs the admin token, its shares are then
+// given along with the nonce it returned
+type AdminService struct {
+	pb.UnimplementedAdminServer
+	barrier     *Barrier     // nil in zero knowledge mode
+	keyRotation *KeyRotation // nil in zero knowledge mode
+	masterRepo  model.MasterRepository
+	expiration  *ExpirationSettings
+}
+
+func NewAdminService(barrier *Barrier, keyRotation *KeyRotation) (*AdminService, error) {
+	masterRepo, err := repository.NewMasterRepository()
+	if err != nil {
+		log.Printf("Error creating admin service %v\n", err)
+		return nil, err
+	}
+	expiration, err := LoadExpirationSettings()
+	if err != nil {
+		log.Printf("Error creating admin service %v\n", err)
+		return nil, err
+	}
+
+	return &AdminService{
+		barrier:     barrier,
+		keyRotation: keyRotation,
+		masterRepo:  masterRepo,
+		expiration:  expiration,
+	}, nil
+}
+
+// the admin methods are not used by masters, they check the admin token
+func (as *AdminService) RequiresAuth(method string) bool {
+	return false
+}
+
+// without a nonce a new unseal is started, which needs the admin token and
+// discards the shares given so far. The share is optional then
+func (as *AdminService) Unseal(ctx context.Context, in *pb.UnsealRequest) (*pb.UnsealResponse, error) {
+	if as.barrier == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, ErrVaultNotSealable)
+	}
+	nonce := in.GetNonce()
+	if len(nonce) == 0 {
+		if !isValidAdminToken(in.GetAdminToken()) {
+			log.Printf("Error validating admin token\n")
+			return nil, status.Errorf(codes.PermissionDenied, ErrWrongAdminToken)
+		}
+		var err error
+		if nonce, err = as.barrier.StartUnseal(); err != nil {
+			log.Printf("Error starting unseal %v\n", err)
+			return nil, status.Errorf(codes.FailedPrecondition, ErrVaultNotSealable)
+		}
+	}
+
+	if len(in.GetShare()) > 0 || len(in.GetNonce()) > 0 {
+		share, err := hex.DecodeString(in.GetShare())
+		if err != nil || len(share) == 0 {
+			log.Printf("Error decoding unseal share\n")
+			return nil, status.Errorf(codes.InvalidArgument, ErrInvalidShare)
+		}
+		if err := as.barrier.Unseal(nonce, share); err != nil {
+			log.Printf("Error unsealing %v\n", err)
+			switch err {
+			case ErrUnsealNonce:
+				return nil, status.Errorf(codes.FailedPrecondition, ErrWrongUnsealNonce)
+			case ErrInvalidShares:
+				return nil, status.Errorf(codes.InvalidArgument, ErrUnsealFailed)
+			}
+			return nil, err
+		}
+	}
+
+	sealed, progress, threshold := as.barrier.Status()
+	return &pb.UnsealResponse{
+		Sealed:    sealed,
+		Progress:  int32(progress),
+		Threshold: int32(threshold),
+		Nonce:     nonce,
+	}, nil
+}
+
+func (as *AdminService) Seal(ctx context.Context, in *pb.SealRequest) (*pb.SealResponse, error) {
+	if !isValidAdminToken(in.GetAdminToken()) {
+		log.Printf("Error validating admin token\n")
+		return nil, status.Errorf(codes.PermissionDenied, ErrWrongAdminToken)
+	}
+
+	if as.barrier == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, ErrVaultNotSealable)
+	}
+	if err := as.barrier.Seal(); err != nil {
+		log.Printf("Error sealing %v\n", err)
+		return nil, status.Errorf(codes.FailedPrecondition, ErrVaultNotSealable)
+	}
+
+	return &pb.SealResponse{OK: true}, nil
+}
+
+func (as *AdminService) SealStatus(ctx context.Context, in *pb.SealStatusRequest) (*pb.SealStatusResponse, error) {
+	if as.barrier == nil {
+		return &pb.SealStatusResponse{}, nil
+	}
+	sealed, progress, threshold := as.barrier.Status()
+	return &pb.SealStatusResponse{
+		Sealed:    sealed,
+		Progress:  int32(progress),
+		Threshold: int32(threshold),
+	}, nil
+}
+
+// reports the progress of the last key rotation, all zero when it never ran
+func (as *AdminService) KeyRotationStatus(ctx context.Context, in *pb.KeyRotationStatusRequest) (*pb.KeyRotationStatusResponse, error) {
+	if !isValidAdminToken(in.GetAdminToken()) {
+		log.Printf("Error validating admin token\n")
+		return nil, status.Errorf(codes.PermissionDenied, ErrWrongAdminToken)
+	}
+	if as.keyRotation == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, ErrNoKeyRotation)
+	}
+
+	progress := as.keyRotation.Progress()
+	response := &pb.KeyRotationStatusResponse{
+		Running:       progress.Running,
+		Masters:       int32(progress.Masters),
+		MastersDone:   int32(progress.MastersDone),
+		Passwords:     int32(progress.Passwords),
+		Reencrypted:   int32(progress.Reencrypted),
+		Failed:        int32(progress.Failed),
+		CurrentMaster: progress.CurrentMaster,
+	}
+	if !progress.StartedAt.IsZero() {
+		response.StartedAt = progress.StartedAt.Unix()
+	}
+	if !progress.FinishedAt.IsZero() {
+		response.FinishedAt = progress.FinishedAt.Unix()
+	}
+	if progress.LastErr != nil {
+		response.LastError = progress.LastErr.Error()
+	}
+	return response, nil
+}
+
+// overrides the password expiration policy of a master, an empty policy
+// goes back to the server one
+func (as *AdminService) SetPasswordExpiration(ctx context.Context, in *pb.SetPasswordExpirationRequest) (*pb.SetPasswordExpirationResponse, error) {
+	if !isValidAdminToken(in.GetAdminToken()) {
+		log.Printf("Error validating admin token\n")
+		return nil, status.Errorf(codes.PermissionDenied, ErrWrongAdminToken)
+	}
+	if len(in.GetEmail()) == 0 {
+		log.Printf("Error validating set password expiration request\n")
+		return nil, status.Errorf(codes.InvalidArgument, ErrValidation)
+	}
+
+	var policy *model.ExpirationPolicy
+	if len(in.GetPolicy()) > 0 {
+		var err error
+		if policy, err = ParseExpirationPolicy(in.GetPolicy()); err != nil {
+			log.Printf("Error parsing expiration policy %v\n", err)
+			return nil, status.Errorf(codes.InvalidArgument, ErrExpirationPolicy)
+		}
+	}
+
+	master, err := as.masterRepo.FindByEmail(in.GetEmail())
+	if err != nil {
+		log.Printf("Error finding master %v\n", err)
+		return nil, status.Errorf(codes.NotFound, ErrMasterNotFound)
+	}
+
+	// the stored expiration date follows the new policy. The zero date of a
+	// password that never expires keeps the old one
+	master.Expiration = policy
+	expiresAt, expires := as.expiration.ExpiresAt(master)
+	if err := as.masterRepo.SetExpirationPolicy(master.Id, policy, expiresAt); err != nil {
+		log.Printf("Error setting expiration policy %v\n", err)
+		return nil, err
+	}
+
+	response := &pb.SetPasswordExpirationResponse{OK: true}
+	if expires {
+		response.ExpiresAt = expiresAt.Unix()
+	}
+	return response, nil
+}
+
+// the token is compared through its hash so the comparison takes the same
+// time whatever its size. Without ADMIN_TOKEN nobody can seal the vault
+func isValidAdminToken(adminToken string) bool {
+	expected := os.Getenv("ADMIN_TOKEN")
+	if len(expected) == 0 || len(adminToken) == 0 {
+		return false
+	}
+	expectedHash := sha256.Sum256([]byte(expected))
+	givenHash := sha256.Sum256([]byte(adminToken))
+	return subtle.ConstantTimeCompare(expectedHash[:], givenHash[:]) == 1
+}
@@ -0,0 +1,187 @@
+package service
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/danilomarques1/secretumserver/model"
+	"github.com/danilomarques1/secretumserver/repository"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+const (
+	ErrTooManyAttempts = "Too many failed attempts, try again later"
+	ErrAccountLocked   = "Account temporarily locked after too many failed attempts"
+	ErrRateLimited     = "Rate limit exceeded, try again later"
+)
+
+// LoginPolicy sets how failed logins are throttled. The failures are
+// counted over a sliding window, past FreeFailures every new attempt has
+// to wait twice as long as the previous one
+type LoginPolicy struct {
+	Window       time.Duration
+	FreeFailures int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	MaxFailures  int // failures of an email that lock the account
+	Lockout      time.Duration
+}
+
+// reads the policy from the environment, the variables not set keep their
+// defaults
+//
+//	LOGIN_WINDOW         15m
+//	LOGIN_FREE_FAILURES  3
+//	LOGIN_BACKOFF_BASE   1s
+//	LOGIN_BACKOFF_MAX    5m
+//	LOGIN_MAX_FAILURES   10
+//	LOGIN_LOCKOUT        15m
+func LoadLoginPolicy() LoginPolicy {
+	return LoginPolicy{
+		Window:       getEnvDuration("LOGIN_WINDOW", 15*time.Minute),
+		FreeFailures: getEnvInt("LOGIN_FREE_FAILURES", 3),
+		BaseDelay:    getEnvDuration("LOGIN_BACKOFF_BASE", time.Second),
+		MaxDelay:     getEnvDuration("LOGIN_BACKOFF_MAX", 5*time.Minute),
+		MaxFailures:  getEnvInt("LOGIN_MAX_FAILURES", 10),
+		Lockout:      getEnvDuration("LOGIN_LOCKOUT", 15*time.Minute),
+	}
+}
+
+// AttemptTracker throttles the logins of an email and of a client address
+type AttemptTracker struct {
+	attemptRepo model.AttemptRepository
+	policy      LoginPolicy
+}
+
+func NewAttemptTracker() (*AttemptTracker, error) {
+	attemptRepo, err := repository.NewAttemptRepository()
+	if err != nil {
+		return nil, err
+	}
+	return &AttemptTracker{
+		attemptRepo: attemptRepo,
+		policy:      LoadLoginPolicy(),
+	}, nil
+}
+
+// Check returns ResourceExhausted, with the time to wait in a RetryInfo
+// detail, when the email or the client have to wait before trying again
+func (at *AttemptTracker) Check(ctx context.Context, email string) error {
+	now := time.Now()
+	for _, key := range attemptKeys(ctx, email) {
+		attempts, err := at.attemptRepo.Find(key)
+		if err != nil {
+			log.Printf("Error finding login attempts %v\n", err)
+			return err
+		}
+		if attempts.LockedUntil.After(now) {
+			return RetryError(ErrAccountLocked, attempts.LockedUntil.Sub(now))
+		}
+		if wait := at.backoff(attempts, now); wait > 0 {
+			return RetryError(ErrTooManyAttempts, wait)
+		}
+	}
+	return nil
+}
+
+// Failure records a failed attempt and locks the account once the email
+// reaches MaxFailures inside the window
+func (at *AttemptTracker) Failure(ctx context.Context, email string) {
+	now := time.Now()
+	since := now.Add(-at.policy.Window)
+	expiresAt := now.Add(at.policy.Window)
+	for _, key := range attemptKeys(ctx, email) {
+		attempts, err := at.attemptRepo.AddFailure(key, now, since, expiresAt)
+		if err != nil {
+			log.Printf("Error recording login failure %v\n", err)
+			continue
+		}
+		if key == emailAttemptKey(email) && at.policy.MaxFailures > 0 && len(attempts.Failures) >= at.policy.MaxFailures {
+			log.Printf("Locking account after %v failed attempts\n", len(attempts.Failures))
+			if err := at.attemptRepo.Lock(key, now.Add(at.policy.Lockout)); err != nil {
+				log.Printf("Error locking account %v\n", err)
+			}
+		}
+	}
+}
+
+// Success forgets the failures of the email. The ones of the client are
+// kept, logging into an own account must not reset them
+func (at *AttemptTracker) Success(email string) {
+	if err := at.attemptRepo.Reset(emailAttemptKey(email)); err != nil {
+		log.Printf("Error resetting login attempts %v\n", err)
+	}
+}
+
+// how long to wait after the last failure
+func (at *AttemptTracker) backoff(attempts *model.LoginAttempts, now time.Time) time.Duration {
+	since := now.Add(-at.policy.Window)
+	recent := 0
+	for _, failure := range attempts.Failures {
+		if !failure.Before(since) {
+			recent++
+		}
+	}
+	if recent == 0 || recent <= at.policy.FreeFailures {
+		return 0
+	}
+
+	delay := at.policy.BaseDelay
+	for i := at.policy.FreeFailures + 1; i < recent && delay < at.policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > at.policy.MaxDelay {
+		delay = at.policy.MaxDelay
+	}
+	last := attempts.Failures[len(attempts.Failures)-1]
+	return last.Add(delay).Sub(now)
+}
+
+// RetryError returns a ResourceExhausted error telling the client how long
+// to wait in a RetryInfo detail
+func RetryError(message string, wait time.Duration) error {
+	st := status.New(codes.ResourceExhausted, message)
+	detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(wait.Round(time.Second))})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+func attemptKeys(ctx context.Context, email string) []string {
+	keys := []string{emailAttemptKey(email)}
+	if _, peerAddr := requestOrigin(ctx); len(peerAddr) > 0 {
+		if host, _, err := net.SplitHostPort(peerAddr); err == nil {
+			peerAddr = host
+		}
+		keys = append(keys, "ip:"+peerAddr)
+	}
+	return keys
+}
+
+func emailAttemptKey(email string) string {
+	return "email:" + email
+}
+
+func getEnvInt(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func getEnvDuration(name string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/danilomarques1/secretumserver/model"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// keeps the login attempts in memory
+type memoryAttemptRepository struct {
+	attempts map[string]*model.LoginAttempts
+}
+
+func newMemoryAttemptRepository() *memoryAttemptRepository {
+	return &memoryAttemptRepository{attempts: make(map[string]*model.LoginAttempts)}
+}
+
+func (r *memoryAttemptRepository) Find(key string) (*model.LoginAttempts, error) {
+	attempts, ok := r.attempts[key]
+	if !ok {
+		return &model.LoginAttempts{Id: key}, nil
+	}
+	found := *attempts
+	return &found, nil
+}
+
+func (r *memoryAttemptRepository) AddFailure(key string, at, since, expiresAt time.Time) (*model.LoginAttempts, error) {
+	attempts, _ := r.Find(key)
+	failures := make([]time.Time, 0, len(attempts.Failures)+1)
+	for _, failure := range attempts.Failures {
+		if !failure.Before(since) {
+			failures = append(failures, failure)
+		}
+	}
+	attempts.Failures = append(failures, at)
+	attempts.ExpiresAt = expiresAt
+	r.attempts[key] = attempts
+	return r.Find(key)
+}
+
+func (r *memoryAttemptRepository) Lock(key string, until time.Time) error {
+	attempts, _ := r.Find(key)
+	attempts.LockedUntil = until
+	r.attempts[key] = attempts
+	return nil
+}
+
+func (r *memoryAttemptRepository) Reset(key string) error {
+	delete(r.attempts, key)
+	return nil
+}
+
+func newTestAttemptTracker() *AttemptTracker {
+	return &AttemptTracker{
+		attemptRepo: newMemoryAttemptRepository(),
+		policy: LoginPolicy{
+			Window:       15 * time.Minute,
+			FreeFailures: 3,
+			BaseDelay:    time.Second,
+			MaxDelay:     8 * time.Second,
+			MaxFailures:  10,
+			Lockout:      15 * time.Minute,
+		},
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	at := newTestAttemptTracker()
+	now := time.Now()
+	failures := func(n int, last time.Time) []time.Time {
+		times := make([]time.Time, n)
+		for i := range times {
+			times[i] = last
+		}
+		return times
+	}
+	tests := []struct {
+		label    string
+		failures []time.Time
+		wait     time.Duration
+	}{
+		{"no failures", nil, 0},
+		{"free failures", failures(3, now), 0},
+		{"first delayed failure", failures(4, now), time.Second},
+		{"second delayed failure", failures(5, now), 2 * time.Second},
+		{"third delayed failure", failures(6, now), 4 * time.Second},
+		{"over the max delay", failures(10, now), 8 * time.Second},
+		{"failures out of the window", failures(6, now.Add(-20*time.Minute)), 0},
+		{"delay already waited", failures(4, now.Add(-2*time.Second)), -time.Second},
+	}
+
+	for _, test := range tests {
+		wait := at.backoff(&model.LoginAttempts{Failures: test.failures}, now)
+		if wait != test.wait {
+			t.Fatalf("Wrong wait for %v expected %v got %v\n", test.label, test.wait, wait)
+		}
+	}
+}
+
+func TestAttemptTrackerLockout(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		label    string
+		failures int
+		success  bool
+		code     codes.Code
+		message  string
+	}{
+		{"free failures", 3, false, codes.OK, ""},
+		{"backoff", 4, false, codes.ResourceExhausted, ErrTooManyAttempts},
+		{"lockout", 10, false, codes.ResourceExhausted, ErrAccountLocked},
+		{"success resets", 5, true, codes.OK, ""},
+	}
+
+	for _, test := range tests {
+		at := newTestAttemptTracker()
+		for i := 0; i < test.failures; i++ {
+			at.Failure(ctx, "john@mail.com")
+		}
+		if test.success {
+			at.Success("john@mail.com")
+		}
+		st := status.Convert(at.Check(ctx, "john@mail.com"))
+		if st.Code() != test.code || st.Message() != test.message {
+			t.Fatalf("Wrong check for %v expected %v %v got %v %v\n", test.label, test.code, test.message, st.Code(), st.Message())
+		}
+		// other emails are not throttled
+		if err := at.Check(ctx, "jane@mail.com"); err != nil {
+			t.Fatalf("Err should for another email be nil %v\n", err)
+		}
+	}
+}
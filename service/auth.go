@@ -0,0 +1,30 @@
+package service
+
+import (
+	"context"
+	"log"
+
+	"github.com/danilomarques1/secretumserver/token"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	ErrUnauthenticated = "Missing or invalid access token"
+)
+
+// AuthPolicy is implemented by every service. The auth interceptor asks it
+// whether a method needs an authenticated master before calling it
+type AuthPolicy interface {
+	RequiresAuth(method string) bool
+}
+
+// returns the claims the auth interceptor put in the context
+func getClaims(ctx context.Context) (*token.Claims, error) {
+	claims, err := token.FromContext(ctx)
+	if err != nil {
+		log.Printf("Error getting token claims %v\n", err)
+		return nil, status.Errorf(codes.Unauthenticated, ErrUnauthenticated)
+	}
+	return claims, nil
+}
@@ -0,0 +1,316 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/danilomarques1/secretumserver/encrypt"
+	"github.com/danilomarques1/secretumserver/shamir"
+)
+
+var (
+	ErrSealed        = errors.New("The vault is sealed")
+	ErrNotSealable   = errors.New("The vault has no seal file and can not be sealed")
+	ErrInvalidShares = errors.New("The unseal shares do not rebuild the root key")
+	ErrUnsealNonce   = errors.New("The nonce is not the one of the current unseal")
+)
+
+const unsealNonceSize = 16
+
+// Barrier keeps the encryption keys. When a seal file exists the server
+// starts sealed, without any key, until enough shares of the root key are
+// given to Unseal. Without a seal file the keys are read from the
+// environment and the barrier is always unsealed
+type Barrier struct {
+	sealFile *encrypt.SealFile // nil when the vault can not be sealed
+
+	mu       sync.Mutex
+	nonce    string // of the current unseal, empty until one is started
+	shares   [][]byte
+	dataKeys *DataKeys
+	onUnseal []func(*DataKeys)
+}
+
+func NewBarrier() (*Barrier, error) {
+	sealFile, err := encrypt.ReadSealFile(SealPath())
+	if err == nil {
+		log.Printf("Seal file found, starting sealed\n")
+		return &Barrier{sealFile: sealFile}, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	legacy, err := encrypt.LoadKeyring()
+	if err != nil && !errors.Is(err, encrypt.ErrNoKeys) {
+		return nil, err
+	}
+	provider, err := encrypt.LoadKeyProvider()
+	if err != nil {
+		return nil, err
+	}
+	dataKeys, err := NewDataKeys(provider, legacy)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Barrier{dataKeys: dataKeys}, nil
+}
+
+// DataKeys returns ErrSealed until the barrier is unsealed
+func (b *Barrier) DataKeys() (*DataKeys, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.dataKeys == nil {
+		return nil, ErrSealed
+	}
+	return b.dataKeys, nil
+}
+
+// OnUnseal registers fn to run every time the barrier is unsealed, right
+// away when it already is
+func (b *Barrier) OnUnseal(fn func(*DataKeys)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.onUnseal = append(b.onUnseal, fn)
+	if b.dataKeys != nil {
+		go fn(b.dataKeys)
+	}
+}
+
+// Status returns whether the barrier is sealed, how many shares were
+// given so far and how many are needed
+func (b *Barrier) Status() (bool, int, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	threshold := 0
+	if b.sealFile != nil {
+		threshold = b.sealFile.Threshold
+	}
+	return b.dataKeys == nil, len(b.shares), threshold
+}
+
+// StartUnseal discards the shares given so far and returns the nonce the
+// shares of the new unseal must come with, so nobody without it can mix
+// shares into the unseal of the operators. The caller checks the admin
+// token
+func (b *Barrier) StartUnseal() (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.sealFile == nil {
+		return "", ErrNotSealable
+	}
+	nonce := make([]byte, unsealNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	b.discardShares()
+	b.nonce = hex.EncodeToString(nonce)
+	return b.nonce, nil
+}
+
+// Unseal adds a share of the root key to the unseal started with nonce.
+// Once the threshold is reached the root key is rebuilt and the keys are
+// opened. A wrong share only fails the sets it is part of: the shares are
+// kept and every set with the following shares is tried, until the seal
+// file shares were all given
+func (b *Barrier) Unseal(nonce string, share []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.dataKeys != nil {
+		return nil
+	}
+	if len(b.nonce) == 0 || subtle.ConstantTimeCompare([]byte(nonce), []byte(b.nonce)) != 1 {
+		return ErrUnsealNonce
+	}
+	for _, given := range b.shares {
+		if shamir.Equal(given, share) {
+			return nil
+		}
+	}
+	if len(b.shares) >= b.sealFile.Shares {
+		return ErrInvalidShares
+	}
+	b.shares = append(b.shares, share)
+	if len(b.shares) < b.sealFile.Threshold {
+		return nil
+	}
+
+	bundle, err := b.openSealFile()
+	if err != nil {
+		return err
+	}
+	dataKeys, err := newBundleDataKeys(bundle)
+	if err != nil {
+		return err
+	}
+	b.discardShares()
+	b.dataKeys = dataKeys
+	for _, fn := range b.onUnseal {
+		go fn(dataKeys)
+	}
+	log.Printf("Vault unsealed\n")
+
+	return nil
+}
+
+// tries every threshold sized set of the shares with the last one given,
+// the sets without it were already tried
+func (b *Barrier) openSealFile() (*encrypt.KeyBundle, error) {
+	last := b.shares[len(b.shares)-1]
+	var bundle *encrypt.KeyBundle
+	eachCombination(len(b.shares)-1, b.sealFile.Threshold-1, func(indexes []int) bool {
+		shares := make([][]byte, 0, len(indexes)+1)
+		for _, i := range indexes {
+			shares = append(shares, b.shares[i])
+		}
+		rootKey, err := shamir.Combine(append(shares, last))
+		if err != nil {
+			return true
+		}
+		defer wipe(rootKey)
+		if bundle, err = b.sealFile.Open(rootKey); err != nil {
+			log.Printf("Error opening the seal file %v\n", err)
+			return true
+		}
+		return false
+	})
+	if bundle == nil {
+		return nil, ErrInvalidShares
+	}
+	return bundle, nil
+}
+
+func (b *Barrier) discardShares() {
+	for _, share := range b.shares {
+		wipe(share)
+	}
+	b.shares = nil
+	b.nonce = ""
+}
+
+// Seal wipes every key from memory
+func (b *Barrier) Seal() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.sealFile == nil {
+		return ErrNotSealable
+	}
+	b.discardShares()
+	if b.dataKeys != nil {
+		b.dataKeys.Wipe()
+		b.dataKeys = nil
+	}
+	log.Printf("Vault sealed\n")
+
+	return nil
+}
+
+// InitSeal moves the keys of the environment and of the local keystore to
+// a new seal file and returns the shares of its root key. Afterwards the
+// ENCRYPT_KEY variables and the keystore file must be removed
+func InitSeal(shares, threshold int) ([][]byte, error) {
+	legacy, err := encrypt.LoadKeyring()
+	if err != nil && !errors.Is(err, encrypt.ErrNoKeys) {
+		return nil, err
+	}
+	provider, err := encrypt.LoadKeyProvider()
+	if err != nil {
+		return nil, err
+	}
+	keystore, _ := provider.(*encrypt.LocalKeystore)
+
+	rootKey, err := encrypt.NewDataKey()
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(rootKey)
+	parts, err := shamir.Split(rootKey, shares, threshold)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := encrypt.NewKeyBundle(legacy, keystore)
+	if err := encrypt.WriteSealFile(SealPath(), bundle, rootKey, shares, threshold); err != nil {
+		return nil, err
+	}
+
+	return parts, nil
+}
+
+// RekeySeal adds a new key encryption key to the keystore of the seal
+// file, shares being enough shares of its root key. The server must then
+// be unsealed with KEK_REWRAP=true so the data keys get wrapped with it
+func RekeySeal(shares [][]byte) (string, error) {
+	rootKey, err := shamir.Combine(shares)
+	if err != nil {
+		return "", ErrInvalidShares
+	}
+	defer wipe(rootKey)
+
+	id, err := encrypt.RekeySealFile(SealPath(), rootKey)
+	if errors.Is(err, encrypt.ErrAuthentication) {
+		return "", ErrInvalidShares
+	}
+	return id, err
+}
+
+func newBundleDataKeys(bundle *encrypt.KeyBundle) (*DataKeys, error) {
+	legacy, err := bundle.LegacyKeyring()
+	if err != nil {
+		return nil, err
+	}
+	keystore, err := bundle.LocalKeystore()
+	if err != nil {
+		return nil, err
+	}
+
+	// without a keystore in the bundle the keks are kept by the kms
+	var provider encrypt.KeyProvider = keystore
+	if keystore == nil {
+		if provider, err = encrypt.LoadKeyProvider(); err != nil {
+			return nil, err
+		}
+	}
+
+	return NewDataKeys(provider, legacy)
+}
+
+func SealPath() string {
+	if path := os.Getenv("SEAL_PATH"); len(path) > 0 {
+		return path
+	}
+	return "seal.json"
+}
+
+// calls fn with every set of size indexes taken from 0..n-1, in order,
+// until it returns false
+func eachCombination(n, size int, fn func([]int) bool) {
+	indexes := make([]int, 0, size)
+	var next func(start int) bool
+	next = func(start int) bool {
+		if len(indexes) == size {
+			return fn(indexes)
+		}
+		for i := start; i <= n-(size-len(indexes)); i++ {
+			indexes = append(indexes, i)
+			if !next(i + 1) {
+				return false
+			}
+			indexes = indexes[:len(indexes)-1]
+		}
+		return true
+	}
+	next(0)
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,115 @@
+package service
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/danilomarques1/secretumserver/encrypt"
+	"github.com/danilomarques1/secretumserver/shamir"
+)
+
+// returns a sealed barrier and the shares of its root key
+func newSealedBarrier(t *testing.T) (*Barrier, [][]byte) {
+	path := filepath.Join(t.TempDir(), "seal.json")
+	rootKey, _ := encrypt.NewDataKey()
+	legacy := encrypt.NewKeyring()
+	if err := legacy.AddSecret(encrypt.DefaultKeyId, "hold back the river", encrypt.KeyActive); err != nil {
+		t.Fatalf("Err should when creating the keyring be nil %v\n", err)
+	}
+	if err := encrypt.WriteSealFile(path, encrypt.NewKeyBundle(legacy, nil), rootKey, 5, 3); err != nil {
+		t.Fatalf("Err should when writing the seal file be nil %v\n", err)
+	}
+	sealFile, err := encrypt.ReadSealFile(path)
+	if err != nil {
+		t.Fatalf("Err should when reading the seal file be nil %v\n", err)
+	}
+	shares, err := shamir.Split(rootKey, 5, 3)
+	if err != nil {
+		t.Fatalf("Err should when splitting be nil %v\n", err)
+	}
+	return &Barrier{sealFile: sealFile}, shares
+}
+
+func TestUnsealNonce(t *testing.T) {
+	barrier, shares := newSealedBarrier(t)
+	if err := barrier.Unseal("", shares[0]); err != ErrUnsealNonce {
+		t.Fatalf("Err should without an unseal be %v got %v\n", ErrUnsealNonce, err)
+	}
+
+	nonce, err := barrier.StartUnseal()
+	if err != nil {
+		t.Fatalf("Err should when starting the unseal be nil %v\n", err)
+	}
+	if err := barrier.Unseal("other nonce", shares[0]); err != ErrUnsealNonce {
+		t.Fatalf("Err should with another nonce be %v got %v\n", ErrUnsealNonce, err)
+	}
+	if err := barrier.Unseal(nonce, shares[0]); err != nil {
+		t.Fatalf("Err should when unsealing be nil %v\n", err)
+	}
+
+	// a new unseal discards the shares of the previous one
+	if _, err := barrier.StartUnseal(); err != nil {
+		t.Fatalf("Err should when starting the unseal be nil %v\n", err)
+	}
+	if err := barrier.Unseal(nonce, shares[1]); err != ErrUnsealNonce {
+		t.Fatalf("Err should with the previous nonce be %v got %v\n", ErrUnsealNonce, err)
+	}
+	if _, progress, _ := barrier.Status(); progress != 0 {
+		t.Fatalf("Wrong progress expected 0 got %v\n", progress)
+	}
+}
+
+func TestUnsealKeepsSharesOnFailure(t *testing.T) {
+	barrier, shares := newSealedBarrier(t)
+	nonce, _ := barrier.StartUnseal()
+
+	junk := append([]byte{}, shares[0]...)
+	junk[0] ^= 0xff
+	for _, share := range [][]byte{shares[1], junk} {
+		if err := barrier.Unseal(nonce, share); err != nil {
+			t.Fatalf("Err should below the threshold be nil %v\n", err)
+		}
+	}
+	if err := barrier.Unseal(nonce, shares[2]); err != ErrInvalidShares {
+		t.Fatalf("Err should with a junk share be %v got %v\n", ErrInvalidShares, err)
+	}
+	if sealed, progress, _ := barrier.Status(); !sealed || progress != 3 {
+		t.Fatalf("The shares should be kept, sealed %v progress %v\n", sealed, progress)
+	}
+
+	// the next share is tried with the good shares, leaving the junk out
+	barrier.shares = append(barrier.shares, shares[3])
+	if _, err := barrier.openSealFile(); err != nil {
+		t.Fatalf("Err should when opening without the junk share be nil %v\n", err)
+	}
+}
+
+func TestEachCombination(t *testing.T) {
+	cases := []struct {
+		label    string
+		n        int
+		size     int
+		expected int
+	}{
+		{"Should list every pair of four", 4, 2, 6},
+		{"Should list the only set", 3, 3, 1},
+		{"Should list the empty set", 3, 0, 1},
+		{"Should list nothing when the size is over n", 2, 3, 0},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.label, func(t *testing.T) {
+			count := 0
+			eachCombination(tc.n, tc.size, func(indexes []int) bool {
+				if len(indexes) != tc.size {
+					t.Fatalf("Wrong set size expected %v got %v\n", tc.size, len(indexes))
+				}
+				count++
+				return true
+			})
+			if count != tc.expected {
+				t.Fatalf("Wrong count expected %v got %v\n", tc.expected, count)
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/danilomarques1/secretumserver/encrypt"
+	"github.com/danilomarques1/secretumserver/model"
+	"github.com/danilomarques1/secretumserver/repository"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrDataKeyChanged = errors.New("Data key changed while it was being set")
+)
+
+// DataKeys hands out the keyring each master passwords are encrypted
+// with. Every master has its own data key, wrapped by the key provider.
+// The legacy keyring, when configured, is kept in every master keyring so
+// passwords written before data keys existed can still be decrypted
+type DataKeys struct {
+	masterRepo model.MasterRepository
+	provider   encrypt.KeyProvider
+	legacy     *encrypt.Keyring
+
+	mu       sync.Mutex
+	keyrings map[string]*encrypt.Keyring
+}
+
+func NewDataKeys(provider encrypt.KeyProvider, legacy *encrypt.Keyring) (*DataKeys, error) {
+	masterRepo, err := repository.NewMasterRepository()
+	if err != nil {
+		log.Printf("Error creating data keys %v\n", err)
+		return nil, err
+	}
+
+	return &DataKeys{
+		masterRepo: masterRepo,
+		provider:   provider,
+		legacy:     legacy,
+		keyrings:   make(map[string]*encrypt.Keyring),
+	}, nil
+}
+
+// Keyring returns the master keyring, whose primary key is the master data
+// key. The data key is created on first use
+func (dk *DataKeys) Keyring(masterId string) (*encrypt.Keyring, error) {
+	dk.mu.Lock()
+	keyring, ok := dk.keyrings[masterId]
+	dk.mu.Unlock()
+	if ok {
+		return keyring, nil
+	}
+
+	master, err := dk.masterRepo.FindById(masterId)
+	if err != nil {
+		return nil, err
+	}
+	dataKey := master.DataKey
+	if dataKey == nil {
+		if dataKey, err = dk.create(masterId); err != nil {
+			return nil, err
+		}
+	}
+
+	dek, err := dk.provider.UnwrapKey(dataKey.Wrapped, dataKeyAssociatedData(masterId))
+	if err != nil {
+		return nil, err
+	}
+	if dk.legacy != nil {
+		keyring = dk.legacy.Clone()
+	} else {
+		keyring = encrypt.NewKeyring()
+	}
+	if err := keyring.Add(dataKey.Id, dek, encrypt.KeyActive); err != nil {
+		return nil, err
+	}
+	if err := keyring.SetPrimary(dataKey.Id); err != nil {
+		return nil, err
+	}
+
+	dk.mu.Lock()
+	dk.keyrings[masterId] = keyring
+	dk.mu.Unlock()
+
+	return keyring, nil
+}
+
+// Shred destroys the master data key. Every password encrypted with it
+// becomes unreadable, for good
+func (dk *DataKeys) Shred(masterId string) error {
+	if err := dk.masterRepo.RemoveDataKey(masterId); err != nil {
+		return err
+	}
+	dk.forget(masterId)
+	log.Printf("Data key of master %v destroyed\n", masterId)
+	return nil
+}
+
+// Rewrap wraps again every data key that was not wrapped by the primary
+// key encryption key. Used after the provider kek was rotated
+func (dk *DataKeys) Rewrap(ctx context.Context) error {
+	masters, err := dk.masterRepo.FindDataKeys()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Starting data keys rewrap of %v masters\n", len(masters))
+	rewrapped := 0
+	for _, master := range masters {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		ok, err := dk.rewrap(&master)
+		if err != nil {
+			log.Printf("Error rewrapping data key of master %v %v\n", master.Id, err)
+			continue
+		}
+		if ok {
+			rewrapped++
+		}
+	}
+	log.Printf("Data keys rewrap finished: %v of %v rewrapped\n", rewrapped, len(masters))
+
+	return nil
+}
+
+func (dk *DataKeys) rewrap(master *model.Master) (bool, error) {
+	needs, err := dk.provider.NeedsRewrap(master.DataKey.Wrapped)
+	if err != nil || !needs {
+		return false, err
+	}
+
+	ad := dataKeyAssociatedData(master.Id)
+	dek, err := dk.provider.UnwrapKey(master.DataKey.Wrapped, ad)
+	if err != nil {
+		return false, err
+	}
+	wrapped, err := dk.provider.WrapKey(dek, ad)
+	if err != nil {
+		return false, err
+	}
+
+	dataKey := *master.DataKey
+	dataKey.Wrapped = wrapped
+	return dk.masterRepo.CompareAndSetDataKey(master.Id, master.DataKey.Wrapped, &dataKey)
+}
+
+func (dk *DataKeys) create(masterId string) (*model.DataKey, error) {
+	dek, err := encrypt.NewDataKey()
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := dk.provider.WrapKey(dek, dataKeyAssociatedData(masterId))
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey := &model.DataKey{
+		Id:        "dek-" + uuid.NewString(),
+		Wrapped:   wrapped,
+		CreatedAt: time.Now(),
+	}
+	ok, err := dk.masterRepo.CompareAndSetDataKey(masterId, "", dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		// another request created it first, that one must be used
+		master, err := dk.masterRepo.FindById(masterId)
+		if err != nil {
+			return nil, err
+		}
+		if master.DataKey == nil {
+			return nil, ErrDataKeyChanged
+		}
+		return master.DataKey, nil
+	}
+
+	return dataKey, nil
+}
+
+// Wipe overwrites every key held in memory, used when the vault is sealed
+func (dk *DataKeys) Wipe() {
+	dk.mu.Lock()
+	defer dk.mu.Unlock()
+	for _, keyring := range dk.keyrings {
+		keyring.Wipe()
+	}
+	dk.keyrings = make(map[string]*encrypt.Keyring)
+	if dk.legacy != nil {
+		dk.legacy.Wipe()
+	}
+	if wiper, ok := dk.provider.(interface{ Wipe() }); ok {
+		wiper.Wipe()
+	}
+}
+
+func (dk *DataKeys) forget(masterId string) {
+	dk.mu.Lock()
+	defer dk.mu.Unlock()
+	delete(dk.keyrings, masterId)
+}
+
+func dataKeyAssociatedData(masterId string) []byte {
+	return encrypt.AssociatedData(masterId, "data_key")
+}
@@ -0,0 +1,189 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/danilomarques1/secretumserver/mail"
+	"github.com/danilomarques1/secretumserver/model"
+	"github.com/danilomarques1/secretumserver/pb"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	ErrNoEmailChange      = "There is no pending email change"
+	ErrWrongEmailCodes    = "The given confirmation codes are invalid"
+	ErrSameEmail          = "The new email is the current one"
+	ErrEmailChangeExpired = "The email change expired, request it again"
+)
+
+const (
+	EmailChangeExpiresIn   = 15 * time.Minute
+	EmailChangeMaxAttempts = 5
+	EmailCodeSize          = 5 // bytes, encoded in base32 as 8 chars
+)
+
+// starts an email change by mailing a code to the current and to the new
+// address. ChangeEmail needs both
+func (ms *MasterService) RequestEmailChange(ctx context.Context, in *pb.RequestEmailChangeRequest) (*pb.RequestEmailChangeResponse, error) {
+	if !hasCredential(in) || len(in.GetNewEmail()) == 0 {
+		log.Printf("Error validating request email change request\n")
+		return nil, status.Errorf(codes.InvalidArgument, ErrValidation)
+	}
+	master, err := ms.reauthenticate(ctx, in.GetPassword(), in.GetAuthHash())
+	if err != nil {
+		return nil, err
+	}
+	if in.GetNewEmail() == master.Email {
+		return nil, status.Errorf(codes.InvalidArgument, ErrSameEmail)
+	}
+	if _, err := ms.masterRepo.FindByEmail(in.GetNewEmail()); err == nil {
+		log.Printf("There was a master registered with the given email already\n")
+		return nil, status.Errorf(codes.AlreadyExists, ErrEmailAlreadyUsed)
+	}
+
+	oldEmailCode, err := generateEmailCode()
+	if err != nil {
+		log.Printf("Error generating email code %v\n", err)
+		return nil, err
+	}
+	newEmailCode, err := generateEmailCode()
+	if err != nil {
+		log.Printf("Error generating email code %v\n", err)
+		return nil, err
+	}
+	change := &model.EmailChange{
+		NewEmail:     in.GetNewEmail(),
+		OldEmailCode: hashRecoveryCode(oldEmailCode),
+		NewEmailCode: hashRecoveryCode(newEmailCode),
+		ExpiresAt:    time.Now().Add(EmailChangeExpiresIn),
+	}
+	if err := ms.masterRepo.SetEmailChange(master.Id, change); err != nil {
+		log.Printf("Error saving email change %v\n", err)
+		return nil, err
+	}
+
+	messages := []*mail.Message{
+		{
+			To:      master.Email,
+			Subject: "Confirm the email change of your secretum account",
+			Body: fmt.Sprintf(
+				"Someone asked to move your secretum account to %v.\n\nThe code for this address is %v\n\nIf it was not you, change your master password.\n",
+				change.NewEmail, oldEmailCode,
+			),
+		},
+		{
+			To:      change.NewEmail,
+			Subject: "Confirm your new secretum email",
+			Body:    fmt.Sprintf("The code for this address is %v\n\nIt expires in 15 minutes.\n", newEmailCode),
+		},
+	}
+	for _, msg := range messages {
+		if err := ms.mailer.Send(msg); err != nil {
+			log.Printf("Error sending email change code %v\n", err)
+			return nil, err
+		}
+	}
+
+	return &pb.RequestEmailChangeResponse{OK: true}, nil
+}
+
+// moves the master to the new email once both codes are given. After
+// EmailChangeMaxAttempts wrong codes the change has to be requested again
+func (ms *MasterService) ChangeEmail(ctx context.Context, in *pb.ChangeEmailRequest) (*pb.ChangeEmailResponse, error) {
+	if !hasCredential(in) || len(in.GetOldEmailCode()) == 0 || len(in.GetNewEmailCode()) == 0 {
+		log.Printf("Error validating change email request\n")
+		return nil, status.Errorf(codes.InvalidArgument, ErrValidation)
+	}
+	master, err := ms.reauthenticate(ctx, in.GetPassword(), in.GetAuthHash())
+	if err != nil {
+		return nil, err
+	}
+	change := master.EmailChange
+	if change == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, ErrNoEmailChange)
+	}
+	if !change.ExpiresAt.After(time.Now()) || change.Attempts >= EmailChangeMaxAttempts {
+		ms.cancelEmailChange(master.Id)
+		return nil, status.Errorf(codes.FailedPrecondition, ErrEmailChangeExpired)
+	}
+
+	oldMatches := subtle.ConstantTimeCompare([]byte(hashRecoveryCode(in.GetOldEmailCode())), []byte(change.OldEmailCode))
+	newMatches := subtle.ConstantTimeCompare([]byte(hashRecoveryCode(in.GetNewEmailCode())), []byte(change.NewEmailCode))
+	if oldMatches&newMatches != 1 {
+		attempts, err := ms.masterRepo.AddEmailChangeAttempt(master.Id)
+		if err != nil {
+			log.Printf("Error counting email change attempt %v\n", err)
+			return nil, err
+		}
+		if attempts >= EmailChangeMaxAttempts {
+			ms.cancelEmailChange(master.Id)
+		}
+		return nil, status.Errorf(codes.InvalidArgument, ErrWrongEmailCodes)
+	}
+
+	changed, err := ms.masterRepo.ChangeEmail(master.Id, master.Email, change.NewEmail, time.Now())
+	if errors.Is(err, model.ErrDuplicatedEmail) {
+		ms.cancelEmailChange(master.Id)
+		return nil, status.Errorf(codes.AlreadyExists, ErrEmailAlreadyUsed)
+	}
+	if err != nil {
+		log.Printf("Error changing email %v\n", err)
+		return nil, err
+	}
+	// the email changed in between, the codes were for the old one
+	if !changed {
+		return nil, status.Errorf(codes.FailedPrecondition, ErrNoEmailChange)
+	}
+
+	return &pb.ChangeEmailResponse{OK: true}, nil
+}
+
+func (ms *MasterService) cancelEmailChange(masterId string) {
+	if err := ms.masterRepo.SetEmailChange(masterId, nil); err != nil {
+		log.Printf("Error removing email change %v\n", err)
+	}
+}
+
+// returns the master of the token after checking its password, or auth
+// hash, again
+func (ms *MasterService) reauthenticate(ctx context.Context, password string, authHash []byte) (*model.Master, error) {
+	credential, ok := masterCredential(password, authHash)
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, ErrValidation)
+	}
+	claims, err := getClaims(ctx)
+	if err != nil {
+		return nil, err
+	}
+	master, err := ms.masterRepo.FindById(claims.MasterId)
+	if err != nil {
+		log.Printf("Error finding master %v\n", err)
+		return nil, err
+	}
+	if err := ms.attempts.Check(ctx, master.Email); err != nil {
+		return nil, err
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(master.Pwd), []byte(credential)); err != nil {
+		log.Printf("Error comparing master password %v\n", err)
+		ms.attempts.Failure(ctx, master.Email)
+		return nil, status.Errorf(codes.NotFound, ErrWrongPassword)
+	}
+	return master, nil
+}
+
+func generateEmailCode() (string, error) {
+	b := make([]byte, EmailCodeSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return strings.ToLower(recoveryCodeEncoding.EncodeToString(b)), nil
+}
@@ -0,0 +1,114 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/danilomarques1/secretumserver/model"
+	"github.com/danilomarques1/secretumserver/pb"
+	"github.com/danilomarques1/secretumserver/token"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// keeps a single master in memory, only what ChangeEmail uses
+type emailChangeRepository struct {
+	model.MasterRepository
+	master *model.Master
+	taken  string // an email used by another master
+}
+
+func (r *emailChangeRepository) FindById(id string) (*model.Master, error) {
+	found := *r.master
+	if found.EmailChange != nil {
+		change := *found.EmailChange
+		found.EmailChange = &change
+	}
+	return &found, nil
+}
+
+func (r *emailChangeRepository) SetEmailChange(id string, change *model.EmailChange) error {
+	r.master.EmailChange = change
+	return nil
+}
+
+func (r *emailChangeRepository) AddEmailChangeAttempt(id string) (int, error) {
+	r.master.EmailChange.Attempts++
+	return r.master.EmailChange.Attempts, nil
+}
+
+func (r *emailChangeRepository) ChangeEmail(id, oldEmail, newEmail string, verifiedAt time.Time) (bool, error) {
+	if newEmail == r.taken {
+		return false, model.ErrDuplicatedEmail
+	}
+	if r.master.Email != oldEmail {
+		return false, nil
+	}
+	r.master.Email = newEmail
+	r.master.EmailChange = nil
+	return true, nil
+}
+
+func TestChangeEmail(t *testing.T) {
+	t.Setenv("VAULT_MODE", "")
+	pwd, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	change := func(attempts int, expiresAt time.Time) *model.EmailChange {
+		return &model.EmailChange{
+			NewEmail:     "john@new.com",
+			OldEmailCode: hashRecoveryCode("old-code"),
+			NewEmailCode: hashRecoveryCode("new-code"),
+			Attempts:     attempts,
+			ExpiresAt:    expiresAt,
+		}
+	}
+	later := time.Now().Add(EmailChangeExpiresIn)
+	tests := []struct {
+		label        string
+		change       *model.EmailChange
+		taken        string
+		password     string
+		oldEmailCode string
+		newEmailCode string
+		code         codes.Code
+		email        string
+		pending      bool // the change is still there afterwards
+	}{
+		{"changed", change(0, later), "", "password", "old-code", "new-code", codes.OK, "john@new.com", false},
+		{"codes in upper case", change(0, later), "", "password", "OLD-CODE", "NEW-CODE", codes.OK, "john@new.com", false},
+		{"wrong password", change(0, later), "", "wrong", "old-code", "new-code", codes.NotFound, "john@mail.com", true},
+		{"no change", nil, "", "password", "old-code", "new-code", codes.FailedPrecondition, "john@mail.com", false},
+		{"only the old code", change(0, later), "", "password", "old-code", "wrong", codes.InvalidArgument, "john@mail.com", true},
+		{"only the new code", change(0, later), "", "password", "wrong", "new-code", codes.InvalidArgument, "john@mail.com", true},
+		{"codes swapped", change(0, later), "", "password", "new-code", "old-code", codes.InvalidArgument, "john@mail.com", true},
+		{"last attempt", change(EmailChangeMaxAttempts-1, later), "", "password", "wrong", "wrong", codes.InvalidArgument, "john@mail.com", false},
+		{"too many attempts", change(EmailChangeMaxAttempts, later), "", "password", "old-code", "new-code", codes.FailedPrecondition, "john@mail.com", false},
+		{"expired", change(0, time.Now().Add(-time.Minute)), "", "password", "old-code", "new-code", codes.FailedPrecondition, "john@mail.com", false},
+		{"email taken meanwhile", change(0, later), "john@new.com", "password", "old-code", "new-code", codes.AlreadyExists, "john@mail.com", false},
+	}
+
+	for _, test := range tests {
+		repo := &emailChangeRepository{
+			master: &model.Master{Id: "id", Email: "john@mail.com", Pwd: string(pwd), EmailChange: test.change},
+			taken:  test.taken,
+		}
+		ms := &MasterService{masterRepo: repo, attempts: newTestAttemptTracker()}
+		ctx := token.NewContext(context.Background(), &token.Claims{MasterId: "id"})
+
+		_, err := ms.ChangeEmail(ctx, &pb.ChangeEmailRequest{
+			Password:     test.password,
+			OldEmailCode: test.oldEmailCode,
+			NewEmailCode: test.newEmailCode,
+		})
+		if code := status.Code(err); code != test.code {
+			t.Fatalf("Wrong code for %v expected %v got %v %v\n", test.label, test.code, code, err)
+		}
+		if repo.master.Email != test.email {
+			t.Fatalf("Wrong email for %v expected %v got %v\n", test.label, test.email, repo.master.Email)
+		}
+		if pending := repo.master.EmailChange != nil; pending != test.pending {
+			t.Fatalf("Wrong pending change for %v expected %v got %v\n", test.label, test.pending, pending)
+		}
+	}
+}
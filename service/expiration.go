@@ -0,0 +1,133 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/danilomarques1/secretumserver/model"
+	"github.com/danilomarques1/secretumserver/pb"
+)
+
+const (
+	ErrExpirationPolicy = "Invalid password expiration policy"
+)
+
+const (
+	DefaultExpirationDays = 30
+	DefaultWarningDays    = 7
+	DefaultGraceLogins    = 3
+)
+
+// ExpirationSettings are the server password expiration policy, how many
+// days before the expiration the masters are warned and how many logins
+// they get after it
+type ExpirationSettings struct {
+	Default     *model.ExpirationPolicy
+	WarningDays int
+	GraceLogins int
+}
+
+// reads the settings from the environment
+//
+//	PASSWORD_EXPIRATION          never, a number of days or a date, 30 by default
+//	PASSWORD_EXPIRATION_WARNING  days before the expiration the warnings start
+//	PASSWORD_GRACE_LOGINS        logins allowed after the expiration
+func LoadExpirationSettings() (*ExpirationSettings, error) {
+	policy := &model.ExpirationPolicy{Mode: model.ExpireDays, Days: DefaultExpirationDays}
+	if value := os.Getenv("PASSWORD_EXPIRATION"); len(value) > 0 {
+		var err error
+		if policy, err = ParseExpirationPolicy(value); err != nil {
+			return nil, err
+		}
+	}
+	return &ExpirationSettings{
+		Default:     policy,
+		WarningDays: getEnvInt("PASSWORD_EXPIRATION_WARNING", DefaultWarningDays),
+		GraceLogins: getEnvInt("PASSWORD_GRACE_LOGINS", DefaultGraceLogins),
+	}, nil
+}
+
+// ParseExpirationPolicy accepts "never", a number of days like 90 or 90d
+// and a date like 2027-01-31
+func ParseExpirationPolicy(value string) (*model.ExpirationPolicy, error) {
+	value = strings.TrimSpace(strings.ToLower(value))
+	if value == model.ExpireNever {
+		return &model.ExpirationPolicy{Mode: model.ExpireNever}, nil
+	}
+	if days, err := strconv.Atoi(strings.TrimSuffix(value, "d")); err == nil {
+		if days <= 0 {
+			return nil, errors.New(ErrExpirationPolicy)
+		}
+		return &model.ExpirationPolicy{Mode: model.ExpireDays, Days: days}, nil
+	}
+	date, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return nil, errors.New(ErrExpirationPolicy)
+	}
+	return &model.ExpirationPolicy{Mode: model.ExpireDate, Date: date}, nil
+}
+
+// ExpiresAt returns when the master password expires, false when it never
+// does. The master policy wins over the server one
+func (es *ExpirationSettings) ExpiresAt(master *model.Master) (time.Time, bool) {
+	policy := es.Default
+	if master.Expiration != nil {
+		policy = master.Expiration
+	}
+
+	switch policy.Mode {
+	case model.ExpireNever:
+		return time.Time{}, false
+	case model.ExpireDate:
+		// a password changed after the date is not forced to change again
+		if master.PwdUpdatedAt.After(policy.Date) {
+			return time.Time{}, false
+		}
+		return policy.Date, true
+	default:
+		updatedAt := master.PwdUpdatedAt
+		// passwords set before the policy existed expired in 30 days
+		if updatedAt.IsZero() {
+			updatedAt = master.PwdExpirationDate.AddDate(0, 0, -DefaultExpirationDays)
+		}
+		return updatedAt.AddDate(0, 0, policy.Days), true
+	}
+}
+
+func (es *ExpirationSettings) Expired(master *model.Master, now time.Time) bool {
+	expiresAt, expires := es.ExpiresAt(master)
+	return expires && !expiresAt.After(now)
+}
+
+// sets when the password expires and warns the master when it is close
+// to it or already in the grace logins
+func (es *ExpirationSettings) setNotice(response *pb.AuthMasterResponse, master *model.Master) {
+	expiresAt, expires := es.ExpiresAt(master)
+	if !expires {
+		return
+	}
+	now := time.Now()
+	response.PasswordExpiresAt = expiresAt.Unix()
+
+	if !expiresAt.After(now) {
+		left := es.GraceLogins - master.GraceLoginsUsed
+		if left < 0 {
+			left = 0
+		}
+		response.GraceLoginsLeft = int32(left)
+		response.Warnings = append(response.Warnings, fmt.Sprintf(
+			"The master password has expired, %v logins left before it has to be updated", left,
+		))
+		return
+	}
+	if expiresAt.Before(now.AddDate(0, 0, es.WarningDays)) {
+		days := int(expiresAt.Sub(now).Hours()/24) + 1
+		response.Warnings = append(response.Warnings, fmt.Sprintf(
+			"The master password expires in %v days", days,
+		))
+	}
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/danilomarques1/secretumserver/model"
+)
+
+func TestExpiresAt(t *testing.T) {
+	settings := &ExpirationSettings{
+		Default: &model.ExpirationPolicy{Mode: model.ExpireDays, Days: 90},
+	}
+	updatedAt := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	date := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		label     string
+		master    *model.Master
+		expiresAt time.Time
+		expires   bool
+	}{
+		{"server policy", &model.Master{PwdUpdatedAt: updatedAt}, updatedAt.AddDate(0, 0, 90), true},
+		{"master days", &model.Master{
+			PwdUpdatedAt: updatedAt,
+			Expiration:   &model.ExpirationPolicy{Mode: model.ExpireDays, Days: 10},
+		}, updatedAt.AddDate(0, 0, 10), true},
+		{"master date", &model.Master{
+			PwdUpdatedAt: updatedAt,
+			Expiration:   &model.ExpirationPolicy{Mode: model.ExpireDate, Date: date},
+		}, date, true},
+		{"changed after the date", &model.Master{
+			PwdUpdatedAt: date.AddDate(0, 0, 1),
+			Expiration:   &model.ExpirationPolicy{Mode: model.ExpireDate, Date: date},
+		}, time.Time{}, false},
+		{"master never", &model.Master{
+			PwdUpdatedAt: updatedAt,
+			Expiration:   &model.ExpirationPolicy{Mode: model.ExpireNever},
+		}, time.Time{}, false},
+		// set before the policy, it was updated 30 days before the stored date
+		{"legacy master", &model.Master{PwdExpirationDate: updatedAt.AddDate(0, 0, DefaultExpirationDays)}, updatedAt.AddDate(0, 0, 90), true},
+	}
+
+	for _, test := range tests {
+		expiresAt, expires := settings.ExpiresAt(test.master)
+		if expires != test.expires || !expiresAt.Equal(test.expiresAt) {
+			t.Fatalf("Wrong expiration for %v expected %v %v got %v %v\n", test.label, test.expiresAt, test.expires, expiresAt, expires)
+		}
+		expired := settings.Expired(test.master, test.expiresAt)
+		if expired != test.expires {
+			t.Fatalf("Wrong expired for %v at %v expected %v got %v\n", test.label, test.expiresAt, test.expires, expired)
+		}
+	}
+}
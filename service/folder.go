@@ -0,0 +1,250 @@
+package service
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/danilomarques1/secretumserver/model"
+	"github.com/danilomarques1/secretumserver/pb"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	ErrFolderNotFound  = "Folder not found"
+	ErrFolderNameUsed  = "Folder name already used"
+	ErrFolderCycle     = "A folder can not be moved inside itself"
+	ErrInvalidFolderId = "The password folder does not exist"
+)
+
+const MaxFolderNameLength = 100
+
+func (ps *PasswordService) ListFolders(ctx context.Context, in *pb.ListFoldersRequest) (*pb.ListFoldersResponse, error) {
+	claims, err := getClaims(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	folders, err := ps.folderRepo.FindAll(claims.MasterId)
+	if err != nil {
+		log.Printf("Error finding folders %v\n", err)
+		return nil, err
+	}
+
+	response := &pb.ListFoldersResponse{Folders: make([]*pb.Folder, 0, len(folders))}
+	for _, folder := range folders {
+		response.Folders = append(response.Folders, &pb.Folder{
+			Id:       folder.Id,
+			Name:     folder.Name,
+			ParentId: folder.ParentId,
+		})
+	}
+
+	return response, nil
+}
+
+// creates the folder inside the parent, at the root when there is none
+func (ps *PasswordService) CreateFolder(ctx context.Context, in *pb.CreateFolderRequest) (*pb.CreateFolderResponse, error) {
+	name := strings.TrimSpace(in.GetName())
+	if !isValidFolderName(name) {
+		log.Printf("Error validating create folder request\n")
+		return nil, status.Errorf(codes.InvalidArgument, ErrValidation)
+	}
+
+	claims, err := getClaims(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	folders, err := ps.folderRepo.FindAll(claims.MasterId)
+	if err != nil {
+		log.Printf("Error finding folders %v\n", err)
+		return nil, err
+	}
+	if len(in.GetParentId()) > 0 && findFolder(folders, in.GetParentId()) == nil {
+		return nil, status.Errorf(codes.NotFound, ErrFolderNotFound)
+	}
+
+	folder := &model.Folder{Id: uuid.NewString(), Name: name, ParentId: in.GetParentId()}
+	added, err := ps.folderRepo.Add(claims.MasterId, folder)
+	if err != nil {
+		log.Printf("Error adding folder %v\n", err)
+		return nil, err
+	}
+	if !added {
+		return nil, status.Errorf(codes.AlreadyExists, ErrFolderNameUsed)
+	}
+
+	return &pb.CreateFolderResponse{Id: folder.Id}, nil
+}
+
+// the passwords point to the folder by id, they follow the new name
+func (ps *PasswordService) RenameFolder(ctx context.Context, in *pb.RenameFolderRequest) (*pb.RenameFolderResponse, error) {
+	name := strings.TrimSpace(in.GetName())
+	if len(in.GetId()) == 0 || !isValidFolderName(name) {
+		log.Printf("Error validating rename folder request\n")
+		return nil, status.Errorf(codes.InvalidArgument, ErrValidation)
+	}
+
+	claims, err := getClaims(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	folders, err := ps.folderRepo.FindAll(claims.MasterId)
+	if err != nil {
+		log.Printf("Error finding folders %v\n", err)
+		return nil, err
+	}
+	folder := findFolder(folders, in.GetId())
+	if folder == nil {
+		return nil, status.Errorf(codes.NotFound, ErrFolderNotFound)
+	}
+	if err := ps.moveFolder(claims.MasterId, folder, folder.ParentId, name); err != nil {
+		return nil, err
+	}
+
+	return &pb.RenameFolderResponse{OK: true}, nil
+}
+
+// moves the folder, with everything inside it, under the parent or to the
+// root when there is none
+func (ps *PasswordService) MoveFolder(ctx context.Context, in *pb.MoveFolderRequest) (*pb.MoveFolderResponse, error) {
+	if len(in.GetId()) == 0 {
+		log.Printf("Error validating move folder request\n")
+		return nil, status.Errorf(codes.InvalidArgument, ErrValidation)
+	}
+
+	claims, err := getClaims(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	folders, err := ps.folderRepo.FindAll(claims.MasterId)
+	if err != nil {
+		log.Printf("Error finding folders %v\n", err)
+		return nil, err
+	}
+	folder := findFolder(folders, in.GetId())
+	if folder == nil {
+		return nil, status.Errorf(codes.NotFound, ErrFolderNotFound)
+	}
+	if err := checkFolderParent(folders, folder.Id, in.GetParentId()); err != nil {
+		return nil, err
+	}
+	if err := ps.moveFolder(claims.MasterId, folder, in.GetParentId(), folder.Name); err != nil {
+		return nil, err
+	}
+
+	return &pb.MoveFolderResponse{OK: true}, nil
+}
+
+// removes the folder and the ones inside it. Their passwords go to the
+// trash and come back at the root when restored
+func (ps *PasswordService) DeleteFolder(ctx context.Context, in *pb.DeleteFolderRequest) (*pb.DeleteFolderResponse, error) {
+	if err := ps.checkSealed(); err != nil {
+		return nil, err
+	}
+	if len(in.GetId()) == 0 {
+		log.Printf("Error validating delete folder request\n")
+		return nil, status.Errorf(codes.InvalidArgument, ErrValidation)
+	}
+
+	claims, err := getClaims(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	folders, err := ps.folderRepo.FindAll(claims.MasterId)
+	if err != nil {
+		log.Printf("Error finding folders %v\n", err)
+		return nil, err
+	}
+	if findFolder(folders, in.GetId()) == nil {
+		return nil, status.Errorf(codes.NotFound, ErrFolderNotFound)
+	}
+
+	if err := ps.folderRepo.Remove(claims.MasterId, folderTree(folders, in.GetId()), time.Now()); err != nil {
+		log.Printf("Error removing folder %v\n", err)
+		return nil, err
+	}
+
+	return &pb.DeleteFolderResponse{OK: true}, nil
+}
+
+func (ps *PasswordService) moveFolder(masterId string, folder *model.Folder, parentId, name string) error {
+	if folder.ParentId == parentId && folder.Name == name {
+		return nil
+	}
+	moved, err := ps.folderRepo.Move(masterId, folder.Id, parentId, name)
+	if err != nil {
+		log.Printf("Error moving folder %v\n", err)
+		return err
+	}
+	if !moved {
+		return status.Errorf(codes.AlreadyExists, ErrFolderNameUsed)
+	}
+	return nil
+}
+
+// the password folder has to exist
+func (ps *PasswordService) checkFolder(masterId, folderId string) error {
+	if len(folderId) == 0 {
+		return nil
+	}
+	folders, err := ps.folderRepo.FindAll(masterId)
+	if err != nil {
+		log.Printf("Error finding folders %v\n", err)
+		return err
+	}
+	if findFolder(folders, folderId) == nil {
+		return status.Errorf(codes.InvalidArgument, ErrInvalidFolderId)
+	}
+	return nil
+}
+
+func findFolder(folders []model.Folder, id string) *model.Folder {
+	for i := range folders {
+		if folders[i].Id == id {
+			return &folders[i]
+		}
+	}
+	return nil
+}
+
+// walks up from the new parent, reaching the folder means a cycle. A walk
+// longer than the folders is a cycle already stored, refused as well
+func checkFolderParent(folders []model.Folder, id, parentId string) error {
+	for steps := 0; len(parentId) > 0; steps++ {
+		if parentId == id || steps > len(folders) {
+			return status.Errorf(codes.InvalidArgument, ErrFolderCycle)
+		}
+		parent := findFolder(folders, parentId)
+		if parent == nil {
+			return status.Errorf(codes.NotFound, ErrFolderNotFound)
+		}
+		parentId = parent.ParentId
+	}
+	return nil
+}
+
+// returns the id and the ids of every folder inside it, each once even
+// when the folders hold a cycle
+func folderTree(folders []model.Folder, id string) []string {
+	ids := []string{id}
+	for i := 0; i < len(ids); i++ {
+		for _, folder := range folders {
+			if folder.ParentId == ids[i] && !contains(ids, folder.Id) {
+				ids = append(ids, folder.Id)
+			}
+		}
+	}
+	return ids
+}
+
+func isValidFolderName(name string) bool {
+	return len(name) > 0 && len(name) <= MaxFolderNameLength
+}
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/danilomarques1/secretumserver/model"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// work
+// ├── clients
+// │   └── acme
+// └── internal
+// home
+var testFolders = []model.Folder{
+	{Id: "work", Name: "work"},
+	{Id: "clients", Name: "clients", ParentId: "work"},
+	{Id: "acme", Name: "acme", ParentId: "clients"},
+	{Id: "internal", Name: "internal", ParentId: "work"},
+	{Id: "home", Name: "home"},
+}
+
+func TestFolderTree(t *testing.T) {
+	// a and b are inside each other
+	cycle := []model.Folder{
+		{Id: "a", Name: "a", ParentId: "b"},
+		{Id: "b", Name: "b", ParentId: "a"},
+	}
+	tests := []struct {
+		label   string
+		folders []model.Folder
+		id      string
+		ids     []string
+	}{
+		{"root with children", testFolders, "work", []string{"work", "clients", "internal", "acme"}},
+		{"inner folder", testFolders, "clients", []string{"clients", "acme"}},
+		{"leaf", testFolders, "acme", []string{"acme"}},
+		{"unknown folder", testFolders, "other", []string{"other"}},
+		{"cycle", cycle, "a", []string{"a", "b"}},
+	}
+
+	for _, test := range tests {
+		ids := folderTree(test.folders, test.id)
+		if !reflect.DeepEqual(ids, test.ids) {
+			t.Fatalf("Wrong tree for %v expected %v got %v\n", test.label, test.ids, ids)
+		}
+	}
+}
+
+func TestCheckFolderParent(t *testing.T) {
+	cycle := []model.Folder{
+		{Id: "a", Name: "a", ParentId: "b"},
+		{Id: "b", Name: "b", ParentId: "a"},
+		{Id: "c", Name: "c"},
+	}
+	tests := []struct {
+		label    string
+		folders  []model.Folder
+		id       string
+		parentId string
+		code     codes.Code
+	}{
+		{"to the root", testFolders, "acme", "", codes.OK},
+		{"under a sibling", testFolders, "internal", "clients", codes.OK},
+		{"under another tree", testFolders, "clients", "home", codes.OK},
+		{"under itself", testFolders, "work", "work", codes.InvalidArgument},
+		{"under its child", testFolders, "work", "clients", codes.InvalidArgument},
+		{"under its grandchild", testFolders, "work", "acme", codes.InvalidArgument},
+		{"under an unknown folder", testFolders, "work", "other", codes.NotFound},
+		{"under a stored cycle", cycle, "c", "a", codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		err := checkFolderParent(test.folders, test.id, test.parentId)
+		if code := status.Code(err); code != test.code {
+			t.Fatalf("Wrong code for %v expected %v got %v\n", test.label, test.code, code)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	netmail "net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/danilomarques1/secretumserver/model"
+	"github.com/danilomarques1/secretumserver/pb"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	ErrInvalidItem     = "The item is invalid"
+	ErrItemTypeChanged = "The type of an item can not change"
+	ErrNotAPassword    = "The key does not hold a password, use the item methods"
+	ErrUnknownItemType = "Unknown item type"
+)
+
+// itemField is a field of an item type. validate returns what is wrong
+// with the value, empty when it is valid
+type itemField struct {
+	name      string
+	required  bool
+	sensitive bool
+	validate  func(string) string
+}
+
+type itemSchema []itemField
+
+func (s itemSchema) field(name string) (itemField, bool) {
+	for _, field := range s {
+		if field.name == name {
+			return field, true
+		}
+	}
+	return itemField{}, false
+}
+
+func (s itemSchema) sensitive(name string) bool {
+	field, ok := s.field(name)
+	return ok && field.sensitive
+}
+
+// the fields of each item type. The password of a login is kept where the
+// passwords always were, so SavePassword and FindPassword still see it
+var itemSchemas = map[string]itemSchema{
+	model.ItemLogin: {
+		{name: "password", required: true, sensitive: true},
+	},
+	model.ItemNote: {
+		{name: "text", required: true, sensitive: true},
+	},
+	model.ItemCard: {
+		{name: "cardholder_name"},
+		{name: "brand"},
+		{name: "number", required: true, sensitive: true, validate: validateCardNumber},
+		{name: "expiration", required: true, validate: validateCardExpiration},
+		{name: "cvv", sensitive: true, validate: validateCVV},
+	},
+	model.ItemIdentity: {
+		{name: "full_name", required: true},
+		{name: "email", validate: validateEmail},
+		{name: "phone"},
+		{name: "address"},
+		{name: "birth_date", validate: validateDate},
+		{name: "document_number", sensitive: true},
+	},
+	model.ItemSSHKey: {
+		{name: "private_key", required: true, sensitive: true, validate: validatePrivateKey},
+		{name: "public_key", validate: validatePublicKey},
+		{name: "passphrase", sensitive: true},
+	},
+}
+
+func (ps *PasswordService) SaveItem(ctx context.Context, in *pb.SaveItemRequest) (*pb.SaveItemResponse, error) {
+	if err := ps.checkSealed(); err != nil {
+		return nil, err
+	}
+	if len(in.GetItem().GetKey()) == 0 {
+		log.Printf("Error validating save item request\n")
+		return nil, status.Errorf(codes.InvalidArgument, ErrValidation)
+	}
+
+	claims, err := getClaims(ctx)
+	if err != nil {
+		return nil, err
+	}
+	masterId := claims.MasterId
+
+	password, err := ps.itemFromPb(in.GetItem())
+	if err != nil {
+		return nil, err
+	}
+	if in.GetItem().GetMetadata() != nil {
+		if err := ps.setMetadata(claims.MasterId, password, in.GetItem().GetMetadata()); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := ps.passwordRepository.FindByKey(masterId, password.Key); err == nil {
+		log.Printf("Error because is already registered\n")
+		return nil, status.Errorf(codes.AlreadyExists, ErrKeyAlreadyUsed)
+	}
+	if err := ps.checkUnverifiedLimit(masterId); err != nil {
+		return nil, err
+	}
+
+	password.Id = uuid.NewString()
+	if err := ps.sealPassword(masterId, password); err != nil {
+		log.Printf("Error encrypting item %v\n", err)
+		return nil, err
+	}
+	if err := ps.passwordRepository.Save(masterId, password); err != nil {
+		log.Printf("Error saving item %v\n", err)
+		return nil, err
+	}
+
+	return &pb.SaveItemResponse{OK: true, Id: password.Id}, nil
+}
+
+// finds an item of any type, the passwords come as logins
+func (ps *PasswordService) FindItem(ctx context.Context, in *pb.FindItemRequest) (*pb.FindItemResponse, error) {
+	if err := ps.checkSealed(); err != nil {
+		return nil, err
+	}
+	if len(in.GetKey()) == 0 {
+		log.Printf("Error validating find item request\n")
+		return nil, status.Errorf(codes.InvalidArgument, ErrValidation)
+	}
+
+	claims, err := getClaims(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	password, err := ps.passwordRepository.FindByKey(claims.MasterId, in.GetKey())
+	if err != nil {
+		log.Printf("Error finding the item %v\n", err)
+		return nil, err
+	}
+	if err := ps.openPassword(claims.MasterId, password); err != nil {
+		log.Printf("Error decrypting item %v\n", err)
+		return nil, err
+	}
+
+	return &pb.FindItemResponse{Item: itemToPb(password)}, nil
+}
+
+// replaces the fields of the item, the metadata is kept when not given
+func (ps *PasswordService) UpdateItem(ctx context.Context, in *pb.UpdateItemRequest) (*pb.UpdateItemResponse, error) {
+	if err := ps.checkSealed(); err != nil {
+		return nil, err
+	}
+	if len(in.GetItem().GetKey()) == 0 {
+		log.Printf("Error validating update item request\n")
+		return nil, status.Errorf(codes.InvalidArgument, ErrValidation)
+	}
+
+	claims, err := getClaims(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	password, err := ps.passwordRepository.FindByKey(claims.MasterId, in.GetItem().GetKey())
+	if err != nil {
+		log.Printf("Error finding the item %v\n", err)
+		return nil, err
+	}
+	if password.ItemType() != in.GetItem().GetType() {
+		return nil, status.Errorf(codes.InvalidArgument, ErrItemTypeChanged)
+	}
+	updated, err := ps.itemFromPb(in.GetItem())
+	if err != nil {
+		return nil, err
+	}
+
+	version := newVersion(password, claims.SessionId)
+	if err := ps.openPassword(claims.MasterId, password); err != nil {
+		log.Printf("Error decrypting item %v\n", err)
+		return nil, err
+	}
+	password.Type = updated.Type
+	password.Pwd = updated.Pwd
+	password.Data = updated.Data
+	if in.GetItem().GetMetadata() != nil {
+		if err := ps.setMetadata(claims.MasterId, password, in.GetItem().GetMetadata()); err != nil {
+			return nil, err
+		}
+	}
+	if err := ps.sealPassword(claims.MasterId, password); err != nil {
+		log.Printf("Error encrypting item %v\n", err)
+		return nil, err
+	}
+	if err := ps.updateWithVersion(claims.MasterId, password, version); err != nil {
+		log.Printf("Error updating item %v\n", err)
+		return nil, err
+	}
+
+	return &pb.UpdateItemResponse{OK: true}, nil
+}
+
+func (ps *PasswordService) RemoveItem(ctx context.Context, in *pb.RemoveItemRequest) (*pb.RemoveItemResponse, error) {
+	if _, err := ps.RemovePassword(ctx, &pb.RemovePasswordRequest{Key: in.GetKey()}); err != nil {
+		return nil, err
+	}
+	return &pb.RemoveItemResponse{OK: true}, nil
+}
+
+// lists the items, only the ones of the type when it is given. Nothing is
+// decrypted
+func (ps *PasswordService) ListItems(ctx context.Context, in *pb.ListItemsRequest) (*pb.ListItemsResponse, error) {
+	if err := ps.checkSealed(); err != nil {
+		return nil, err
+	}
+	if _, ok := itemSchemas[in.GetType()]; len(in.GetType()) > 0 && !ok {
+		return nil, status.Errorf(codes.InvalidArgument, ErrUnknownItemType)
+	}
+
+	claims, err := getClaims(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	passwords, err := ps.passwordRepository.FindAll(claims.MasterId)
+	if err != nil {
+		log.Printf("Error finding items %v\n", err)
+		return nil, err
+	}
+
+	response := &pb.ListItemsResponse{Items: make([]*pb.ItemSummary, 0, len(passwords))}
+	for _, password := range passwords {
+		if password.DeletedAt != nil || (len(in.GetType()) > 0 && password.ItemType() != in.GetType()) {
+			continue
+		}
+		response.Items = append(response.Items, &pb.ItemSummary{
+			Id:   password.Id,
+			Key:  password.Key,
+			Type: password.ItemType(),
+		})
+	}
+
+	return response, nil
+}
+
+// checks the item against the schema of its type. In zero knowledge mode
+// the sensitive values are client encrypted and can not be checked
+func (ps *PasswordService) itemFromPb(item *pb.Item) (*model.Password, error) {
+	schema, ok := itemSchemas[item.GetType()]
+	if !ok {
+		log.Printf("Error validating item of type %v\n", item.GetType())
+		return nil, status.Errorf(codes.InvalidArgument, ErrUnknownItemType)
+	}
+
+	badRequest := &errdetails.BadRequest{}
+	violation := func(field, description string) {
+		badRequest.FieldViolations = append(badRequest.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       field,
+			Description: description,
+		})
+	}
+
+	values := make(map[string]string)
+	for i, field := range item.GetFields() {
+		name := fmt.Sprintf("item.fields[%v]", i)
+		schemaField, ok := schema.field(field.GetName())
+		if !ok {
+			violation(name+".name", fmt.Sprintf("not a field of %v items", item.GetType()))
+			continue
+		}
+		if _, ok := values[field.GetName()]; ok {
+			violation(name+".name", "given twice")
+			continue
+		}
+		values[field.GetName()] = field.GetValue()
+
+		skip := len(field.GetValue()) == 0 || schemaField.validate == nil || (ps.zeroKnowledge && schemaField.sensitive)
+		if skip {
+			continue
+		}
+		if problem := schemaField.validate(field.GetValue()); len(problem) > 0 {
+			violation(name+".value", problem)
+		}
+	}
+	for _, field := range schema {
+		if field.required && len(values[field.name]) == 0 {
+			violation("item.fields", field.name+" is required")
+		}
+	}
+	if len(badRequest.FieldViolations) > 0 {
+		log.Printf("Error validating item, %v violations\n", len(badRequest.FieldViolations))
+		return nil, invalidArgument(ErrInvalidItem, badRequest)
+	}
+
+	password := &model.Password{Key: item.GetKey(), Type: item.GetType()}
+	if password.Type == model.ItemLogin {
+		password.Pwd = values["password"]
+		return password, nil
+	}
+	// kept in the schema order
+	for _, field := range schema {
+		if value := values[field.name]; len(value) > 0 {
+			password.Data = append(password.Data, model.ItemField{Name: field.name, Value: value})
+		}
+	}
+	return password, nil
+}
+
+// the item of a decrypted password
+func itemToPb(password *model.Password) *pb.Item {
+	item := &pb.Item{
+		Id:       password.Id,
+		Key:      password.Key,
+		Type:     password.ItemType(),
+		Fields:   make([]*pb.ItemField, 0, len(password.Data)+1),
+		Metadata: metadataToPb(password),
+	}
+	if item.Type == model.ItemLogin {
+		item.Fields = append(item.Fields, &pb.ItemField{Name: "password", Value: password.Pwd})
+	}
+	for _, field := range password.Data {
+		item.Fields = append(item.Fields, &pb.ItemField{Name: field.Name, Value: field.Value})
+	}
+	return item
+}
+
+var (
+	cardExpirationRegexp = regexp.MustCompile(`^(0[1-9]|1[0-2])/([0-9]{2}|[0-9]{4})$`)
+	cvvRegexp            = regexp.MustCompile(`^[0-9]{3,4}$`)
+)
+
+// 12 to 19 digits passing the luhn check, spaces and dashes are allowed
+func validateCardNumber(value string) string {
+	digits := strings.NewReplacer(" ", "", "-", "").Replace(value)
+	if len(digits) < 12 || len(digits) > 19 {
+		return "12 to 19 digits"
+	}
+	sum := 0
+	for i := range digits {
+		digit := int(digits[len(digits)-1-i] - '0')
+		if digit < 0 || digit > 9 {
+			return "only digits"
+		}
+		if i%2 == 1 {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+	}
+	if sum%10 != 0 {
+		return "not a valid card number"
+	}
+	return ""
+}
+
+func validateCardExpiration(value string) string {
+	if !cardExpirationRegexp.MatchString(value) {
+		return "MM/YY or MM/YYYY"
+	}
+	return ""
+}
+
+func validateCVV(value string) string {
+	if !cvvRegexp.MatchString(value) {
+		return "3 or 4 digits"
+	}
+	return ""
+}
+
+func validateEmail(value string) string {
+	if _, err := netmail.ParseAddress(value); err != nil {
+		return "not an email"
+	}
+	return ""
+}
+
+func validateDate(value string) string {
+	if _, err := time.Parse("2006-01-02", value); err != nil {
+		return "YYYY-MM-DD"
+	}
+	return ""
+}
+
+// keys protected by a passphrase can not be parsed, they are accepted
+func validatePrivateKey(value string) string {
+	_, err := ssh.ParseRawPrivateKey([]byte(value))
+	var missing *ssh.PassphraseMissingError
+	if err != nil && !errors.As(err, &missing) {
+		return "not a private key in PEM or OpenSSH format"
+	}
+	return ""
+}
+
+func validatePublicKey(value string) string {
+	if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(value)); err != nil {
+		return "not a public key in authorized_keys format"
+	}
+	return ""
+}
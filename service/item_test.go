@@ -0,0 +1,132 @@
+package service
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"reflect"
+	"testing"
+
+	"github.com/danilomarques1/secretumserver/model"
+	"github.com/danilomarques1/secretumserver/pb"
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestItemValidators(t *testing.T) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	sshPublicKey, _ := ssh.NewPublicKey(publicKey)
+	der, _ := x509.MarshalPKCS8PrivateKey(privateKey)
+	pemKey := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	tests := []struct {
+		label    string
+		validate func(string) string
+		value    string
+		valid    bool
+	}{
+		{"card number", validateCardNumber, "4111111111111111", true},
+		{"card number with spaces", validateCardNumber, "4111 1111 1111 1111", true},
+		{"card number with dashes", validateCardNumber, "5500-0000-0000-0004", true},
+		{"card number failing luhn", validateCardNumber, "4111111111111112", false},
+		{"short card number", validateCardNumber, "41111111", false},
+		{"card number with letters", validateCardNumber, "4111a11111111111", false},
+		{"expiration", validateCardExpiration, "01/30", true},
+		{"expiration with the full year", validateCardExpiration, "12/2030", true},
+		{"expiration month 13", validateCardExpiration, "13/30", false},
+		{"cvv", validateCVV, "123", true},
+		{"amex cvv", validateCVV, "1234", true},
+		{"short cvv", validateCVV, "12", false},
+		{"email", validateEmail, "john@mail.com", true},
+		{"bad email", validateEmail, "john", false},
+		{"date", validateDate, "1990-01-31", true},
+		{"bad date", validateDate, "31/01/1990", false},
+		{"private key", validatePrivateKey, pemKey, true},
+		{"bad private key", validatePrivateKey, "not a key", false},
+		{"public key", validatePublicKey, string(ssh.MarshalAuthorizedKey(sshPublicKey)), true},
+		{"bad public key", validatePublicKey, "ssh-ed25519 not-a-key", false},
+	}
+
+	for _, test := range tests {
+		problem := test.validate(test.value)
+		if valid := len(problem) == 0; valid != test.valid {
+			t.Fatalf("Wrong validation for %v expected %v got %v %v\n", test.label, test.valid, valid, problem)
+		}
+	}
+}
+
+func TestItemFromPb(t *testing.T) {
+	field := func(name, value string) *pb.ItemField {
+		return &pb.ItemField{Name: name, Value: value}
+	}
+	tests := []struct {
+		label         string
+		zeroKnowledge bool
+		item          *pb.Item
+		password      *model.Password
+		violations    []string
+	}{
+		{"login", false, &pb.Item{Key: "github", Type: model.ItemLogin, Fields: []*pb.ItemField{
+			field("password", "secret"),
+		}}, &model.Password{Key: "github", Type: model.ItemLogin, Pwd: "secret"}, nil},
+		{"card in the schema order", false, &pb.Item{Key: "visa", Type: model.ItemCard, Fields: []*pb.ItemField{
+			field("expiration", "01/30"), field("number", "4111111111111111"), field("brand", ""),
+		}}, &model.Password{Key: "visa", Type: model.ItemCard, Data: []model.ItemField{
+			{Name: "number", Value: "4111111111111111"}, {Name: "expiration", Value: "01/30"},
+		}}, nil},
+		{"bad card", false, &pb.Item{Key: "visa", Type: model.ItemCard, Fields: []*pb.ItemField{
+			field("number", "4111111111111112"), field("expiration", "13/30"),
+		}}, nil, []string{"item.fields[0].value", "item.fields[1].value"}},
+		{"client encrypted card", true, &pb.Item{Key: "visa", Type: model.ItemCard, Fields: []*pb.ItemField{
+			field("number", "encrypted"), field("expiration", "01/30"),
+		}}, &model.Password{Key: "visa", Type: model.ItemCard, Data: []model.ItemField{
+			{Name: "number", Value: "encrypted"}, {Name: "expiration", Value: "01/30"},
+		}}, nil},
+		{"missing required fields", false, &pb.Item{Key: "me", Type: model.ItemIdentity, Fields: []*pb.ItemField{
+			field("phone", "555"),
+		}}, nil, []string{"item.fields"}},
+		{"unknown field", false, &pb.Item{Key: "note", Type: model.ItemNote, Fields: []*pb.ItemField{
+			field("text", "hello"), field("title", "hi"),
+		}}, nil, []string{"item.fields[1].name"}},
+		{"field given twice", false, &pb.Item{Key: "note", Type: model.ItemNote, Fields: []*pb.ItemField{
+			field("text", "hello"), field("text", "again"),
+		}}, nil, []string{"item.fields[1].name"}},
+	}
+
+	for _, test := range tests {
+		ps := &PasswordService{zeroKnowledge: test.zeroKnowledge}
+		password, err := ps.itemFromPb(test.item)
+		if len(test.violations) == 0 {
+			if err != nil {
+				t.Fatalf("Err should for %v be nil %v\n", test.label, err)
+			}
+			if !reflect.DeepEqual(password, test.password) {
+				t.Fatalf("Wrong password for %v expected %v got %v\n", test.label, test.password, password)
+			}
+			continue
+		}
+
+		st := status.Convert(err)
+		if st.Code() != codes.InvalidArgument {
+			t.Fatalf("Wrong code for %v expected %v got %v\n", test.label, codes.InvalidArgument, st.Code())
+		}
+		fields := make([]string, 0)
+		for _, detail := range st.Details() {
+			if badRequest, ok := detail.(*errdetails.BadRequest); ok {
+				for _, violation := range badRequest.GetFieldViolations() {
+					fields = append(fields, violation.GetField())
+				}
+			}
+		}
+		if !reflect.DeepEqual(fields, test.violations) {
+			t.Fatalf("Wrong violations for %v expected %v got %v\n", test.label, test.violations, fields)
+		}
+	}
+
+	ps := &PasswordService{}
+	if _, err := ps.itemFromPb(&pb.Item{Key: "car", Type: "vehicle"}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Wrong code for an unknown type expected %v got %v\n", codes.InvalidArgument, status.Code(err))
+	}
+}
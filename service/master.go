@@ -2,11 +2,15 @@ package service
 
 import (
 	"context"
+	"errors"
 	"log"
 	"time"
 
+	"github.com/danilomarques1/secretumserver/encrypt"
+	"github.com/danilomarques1/secretumserver/mail"
 	"github.com/danilomarques1/secretumserver/model"
 	"github.com/danilomarques1/secretumserver/pb"
+	"github.com/danilomarques1/secretumserver/policy"
 	"github.com/danilomarques1/secretumserver/repository"
 	"github.com/danilomarques1/secretumserver/token"
 	"github.com/google/uuid"
@@ -20,33 +24,96 @@ const (
 	ErrEmailAlreadyUsed = "Master email already used"
 	ErrPasswordExpired  = "Password has expired"
 	ErrWrongPassword    = "The given password is invalid"
+	ErrPasswordReused   = "The new password was used recently"
 )
 
+// how many previous master passwords can not be used again
+const DefaultPasswordHistory = 5
+
 type MasterService struct {
 	pb.UnimplementedMasterServer
-	masterRepo model.MasterRepository
+	masterRepo     model.MasterRepository
+	sessionRepo    model.SessionRepository
+	attempts       *AttemptTracker
+	passwordPolicy *policy.Policy
+	expiration     *ExpirationSettings
+	mailer         mail.Mailer
+	barrier        *Barrier         // nil in zero knowledge mode
+	twoFactorKeys  *encrypt.Keyring // only in zero knowledge mode
+	vaultSecret    []byte           // VAULT_PARAMS_SECRET, only in zero knowledge mode
 }
 
-func NewMasterService() (*MasterService, error) {
+func NewMasterService(barrier *Barrier) (*MasterService, error) {
 	masterRepo, err := repository.NewMasterRepository()
 	if err != nil {
 		log.Printf("Error creating master service %v\n", err)
 		return nil, err
 	}
+	sessionRepo, err := repository.NewSessionRepository()
+	if err != nil {
+		log.Printf("Error creating master service %v\n", err)
+		return nil, err
+	}
+	attempts, err := NewAttemptTracker()
+	if err != nil {
+		log.Printf("Error creating master service %v\n", err)
+		return nil, err
+	}
+	passwordPolicy, err := policy.LoadPolicy()
+	if err != nil {
+		log.Printf("Error creating master service %v\n", err)
+		return nil, err
+	}
+	expiration, err := LoadExpirationSettings()
+	if err != nil {
+		log.Printf("Error creating master service %v\n", err)
+		return nil, err
+	}
+	mailer, err := mail.LoadMailer()
+	if err != nil {
+		log.Printf("Error creating master service %v\n", err)
+		return nil, err
+	}
+	// without them the masters could not use two factor authentication
+	// and GetVaultParams would tell which emails have an account
+	var twoFactorKeys *encrypt.Keyring
+	var vaultSecret []byte
+	if barrier == nil {
+		if twoFactorKeys, err = loadTwoFactorKeyring(); err != nil {
+			log.Printf("Error creating master service %v\n", err)
+			return nil, err
+		}
+		if vaultSecret, err = loadVaultParamsSecret(); err != nil {
+			log.Printf("Error creating master service %v\n", err)
+			return nil, err
+		}
+	}
 
 	return &MasterService{
-		masterRepo: masterRepo,
+		masterRepo:     masterRepo,
+		sessionRepo:    sessionRepo,
+		attempts:       attempts,
+		passwordPolicy: passwordPolicy,
+		expiration:     expiration,
+		mailer:         mailer,
+		barrier:        barrier,
+		twoFactorKeys:  twoFactorKeys,
+		vaultSecret:    vaultSecret,
 	}, nil
 }
 
 func (ms *MasterService) SaveMaster(ctx context.Context, in *pb.CreateMasterRequest) (*pb.CreateMasterResponse, error) {
-	if !isValidCreateMasterRequest(in) {
+	credential, ok := masterCredential(in.GetPassword(), in.GetAuthHash())
+	if !ok || len(in.GetEmail()) == 0 {
 		log.Printf("Error validating create master request\n")
 		return nil, status.Errorf(
 			codes.InvalidArgument,
 			ErrValidation,
 		)
 	}
+	if err := ms.checkPasswordPolicy("password", credential, in.GetEmail()); err != nil {
+		return nil, err
+	}
 
 	if _, err := ms.masterRepo.FindByEmail(in.GetEmail()); err == nil {
 		log.Printf("There was a master registered with the given email already\n")
@@ -56,33 +123,67 @@ func (ms *MasterService) SaveMaster(ctx context.Context, in *pb.CreateMasterRequ
 		)
 	}
 
-	hashedPwd, err := bcrypt.GenerateFromPassword([]byte(in.GetPassword()), bcrypt.DefaultCost)
+	var vault *model.VaultParams
+	if IsZeroKnowledge() {
+		params, err := vaultParamsFromPb(in.GetVault())
+		if err != nil {
+			log.Printf("Error validating vault params %v\n", err)
+			return nil, status.Errorf(codes.InvalidArgument, ErrVaultParams)
+		}
+		vault = params
+	}
+
+	hashedPwd, err := bcrypt.GenerateFromPassword([]byte(credential), bcrypt.DefaultCost)
 	if err != nil {
 		log.Printf("Error hashing master password %v\n", err)
 		return nil, err
 	}
+	// only shown in the response, the master has to keep it
+	var recoveryKey, hashedRecoveryKey string
+	if !IsZeroKnowledge() {
+		if recoveryKey, hashedRecoveryKey, err = generateRecoveryKey(); err != nil {
+			log.Printf("Error generating recovery key %v\n", err)
+			return nil, err
+		}
+	}
 
-	masterPwdExpiration := ms.getPasswordExpirationDate()
 	master := &model.Master{
-		Id:                uuid.NewString(),
-		Email:             in.GetEmail(),
-		Pwd:               string(hashedPwd),
-		PwdExpirationDate: masterPwdExpiration,
-		Passwords:         []model.Password{},
+		Id:           uuid.NewString(),
+		Email:        in.GetEmail(),
+		Pwd:          string(hashedPwd),
+		PwdUpdatedAt: time.Now(),
+		Passwords:    []model.Password{},
+		Vault:        vault,
+		RecoveryKey:  hashedRecoveryKey,
+	}
+	master.PwdExpirationDate = ms.getPasswordExpirationDate(master)
+	if emailVerificationEnabled() {
+		master.Verification = &model.EmailVerification{}
 	}
 
 	if err := ms.masterRepo.Save(master); err != nil {
 		log.Printf("Error saving password %v\n", err)
+		if errors.Is(err, model.ErrDuplicatedEmail) {
+			return nil, status.Errorf(codes.AlreadyExists, ErrEmailAlreadyUsed)
+		}
 		return nil, err
 	}
+	// the master can ask for the email again, the account is kept
+	if master.Verification != nil {
+		if err := ms.sendVerificationEmail(master); err != nil {
+			log.Printf("Error sending verification email %v\n", err)
+		}
+	}
 
 	return &pb.CreateMasterResponse{
-		OK: true,
+		OK:          true,
+		RecoveryKey: recoveryKey,
 	}, nil
 }
 
 func (ms *MasterService) AuthenticateMaster(ctx context.Context, in *pb.AuthMasterRequest) (*pb.AuthMasterResponse, error) {
-	if !isValidteAuthMasterRequest(in) {
+	credential, ok := masterCredential(in.GetPassword(), in.GetAuthHash())
+	if !ok || len(in.GetEmail()) == 0 {
 		log.Printf("Error validating auth request\n")
 		return nil, status.Errorf(
 			codes.InvalidArgument,
@@ -90,19 +191,27 @@ func (ms *MasterService) AuthenticateMaster(ctx context.Context, in *pb.AuthMast
 		)
 	}
 
+	if err := ms.attempts.Check(ctx, in.GetEmail()); err != nil {
+		log.Printf("Error authenticating master %v\n", err)
+		return nil, err
+	}
+
 	master, err := ms.masterRepo.FindByEmail(in.GetEmail())
 	if err != nil {
 		log.Printf("Error finding master by email %v\n", err)
+		ms.attempts.Failure(ctx, in.GetEmail())
 		return nil, err
 	}
-	if err := bcrypt.CompareHashAndPassword([]byte(master.Pwd), []byte(in.GetPassword())); err != nil {
+	if err := bcrypt.CompareHashAndPassword([]byte(master.Pwd), []byte(credential)); err != nil {
 		log.Printf("Error comparing master password %v\n", err)
+		ms.attempts.Failure(ctx, in.GetEmail())
 		return nil, status.Errorf(codes.NotFound, ErrWrongPassword)
 	}
 
 	// by returning PermissionDenied the client will interpret it
-	// as needing to update the password
-	if master.PwdExpirationDate.Unix() <= time.Now().Unix() {
+	// as needing to update the password. Before that the master gets a
+	// few grace logins, only used once the tokens are issued
+	if ms.expiration.Expired(master, time.Now()) && master.GraceLoginsUsed >= ms.expiration.GraceLogins {
 		log.Printf("master password has expired\n")
 		return nil, status.Errorf(
 			codes.PermissionDenied,
@@ -110,46 +219,130 @@ func (ms *MasterService) AuthenticateMaster(ctx context.Context, in *pb.AuthMast
 		)
 	}
 
-	tokenResponse, err := token.GetToken(master.Id)
+	// the tokens are only issued by CompleteTwoFactor, the failures are
+	// kept until the second factor is checked too
+	if master.TwoFactor != nil && master.TwoFactor.Confirmed {
+		challengeToken, err := token.GetChallengeToken(master.Id, master.TokenGeneration)
+		if err != nil {
+			log.Printf("Error getting challenge token %v\n", err)
+			return nil, err
+		}
+		response := &pb.AuthMasterResponse{
+			TwoFactorRequired: true,
+			ChallengeToken:    challengeToken,
+		}
+		ms.expiration.setNotice(response, master)
+		return response, nil
+	}
+
+	ms.attempts.Success(master.Email)
+	return ms.authResponse(ctx, master)
+}
+
+// starts a session for the authenticated master, using one of its grace
+// logins when the password has expired
+func (ms *MasterService) authResponse(ctx context.Context, master *model.Master) (*pb.AuthMasterResponse, error) {
+	if ms.expiration.Expired(master, time.Now()) {
+		used, err := ms.masterRepo.UseGraceLogin(master.Id, ms.expiration.GraceLogins)
+		if err != nil {
+			log.Printf("Error using grace login %v\n", err)
+			return nil, err
+		}
+		if !used {
+			log.Printf("master password has expired\n")
+			return nil, status.Errorf(
+				codes.PermissionDenied,
+				ErrPasswordExpired,
+			)
+		}
+		master.GraceLoginsUsed++
+	}
+
+	tokenResponse, err := ms.startSession(ctx, master)
 	if err != nil {
 		log.Printf("Error getting token %v\n", err)
 		return nil, err
 	}
 
-	return &pb.AuthMasterResponse{
+	response := &pb.AuthMasterResponse{
 		AccessToken:  tokenResponse.AccessToken,
 		ExpiresIn:    tokenResponse.ExpiresIn,
 		RefreshToken: tokenResponse.RefreshToken,
-	}, nil
+	}
+	if master.Vault != nil {
+		response.WrappedVaultKey = master.Vault.WrappedKey
+	}
+	ms.expiration.setNotice(response, master)
+
+	return response, nil
 }
 
+// changes the master password. In zero knowledge mode the client sends
+// the vault key wrapped again with the new password along with the new
+// auth hash. Masters with two factor authentication also send a code
 func (ms *MasterService) UpdateMaster(ctx context.Context, in *pb.UpdateMasterRequest) (*pb.UpdateMasterResponse, error) {
-	if !isValidUpdateMasterRequest(in) {
+	oldCredential, oldOk := masterCredential(in.GetOldPassword(), in.GetOldAuthHash())
+	newCredential, newOk := masterCredential(in.GetNewPassword(), in.GetNewAuthHash())
+	if !oldOk || !newOk || len(in.GetEmail()) == 0 {
 		log.Printf("Error validating update request\n")
 		return nil, status.Errorf(codes.InvalidArgument, ErrValidation)
 	}
+	var vault *model.VaultParams
+	if IsZeroKnowledge() {
+		params, err := vaultParamsFromPb(in.GetVault())
+		if err != nil {
+			log.Printf("Error validating vault params %v\n", err)
+			return nil, status.Errorf(codes.InvalidArgument, ErrVaultParams)
+		}
+		vault = params
+	}
+	// the old password can be guessed here as well as on login
+	if err := ms.attempts.Check(ctx, in.GetEmail()); err != nil {
+		log.Printf("Error updating master %v\n", err)
+		return nil, err
+	}
 	master, err := ms.masterRepo.FindByEmail(in.GetEmail())
 	if err != nil {
 		log.Printf("Error finding master %v\n", err)
+		ms.attempts.Failure(ctx, in.GetEmail())
 		return nil, err
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(master.Pwd), []byte(in.GetOldPassword())); err != nil {
+	if err := bcrypt.CompareHashAndPassword([]byte(master.Pwd), []byte(oldCredential)); err != nil {
 		log.Printf("Error comparing master password %v\n", err)
+		ms.attempts.Failure(ctx, in.GetEmail())
 		return nil, status.Errorf(codes.NotFound, ErrWrongPassword)
 	}
+	if err := ms.checkSecondFactor(ctx, master, in.GetCode(), in.GetRecoveryCode()); err != nil {
+		return nil, err
+	}
+	ms.attempts.Success(master.Email)
+	if err := ms.checkPasswordPolicy("new_password", newCredential, master.Email); err != nil {
+		return nil, err
+	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(in.GetNewPassword()), bcrypt.DefaultCost)
-	if err != nil {
+	// in zero knowledge mode only a password reused with the same kdf
+	// params gives the same auth hash
+	if passwordReused(master, newCredential) {
+		log.Printf("Error updating master password, it was used recently\n")
+		return nil, status.Errorf(codes.InvalidArgument, ErrPasswordReused)
+	}
+
+	if err := ms.setMasterPassword(master, newCredential); err != nil {
 		log.Printf("Error hashing master password %v\n", err)
 		return nil, err
 	}
-	master.Pwd = string(hashedPassword)
-	master.PwdExpirationDate = ms.getPasswordExpirationDate()
+	if vault != nil {
+		master.Vault = vault
+	}
 	if err := ms.masterRepo.Update(master); err != nil {
 		log.Printf("Error updating master password\n")
 		return nil, err
 	}
+	// the tokens issued with the old password are no longer valid
+	if err := ms.revokeAll(master.Id, RevokedPasswordChange); err != nil {
+		return nil, err
+	}
 
 	return &pb.UpdateMasterResponse{
 		OK: true,
@@ -165,10 +358,11 @@ func (ms *MasterService) RefreshMasterToken(ctx context.Context, in *pb.RefreshT
 
 	claims, err := token.ValidateRefreshToken(in.GetRefreshToken())
 	if err != nil {
-		return nil, err
+		log.Printf("Error validating refresh token %v\n", err)
+		return nil, status.Errorf(codes.Unauthenticated, ErrInvalidRefreshToken)
 	}
 
-	tokenResponse, err := token.GetToken(claims.MasterId)
+	tokenResponse, err := ms.refreshSession(claims)
 	if err != nil {
 		return nil, err
 	}
@@ -180,19 +374,84 @@ func (ms *MasterService) RefreshMasterToken(ctx context.Context, in *pb.RefreshT
 	}, nil
 }
 
-// return now + 30 days
-func (ms *MasterService) getPasswordExpirationDate() time.Time {
-	return time.Now().AddDate(0, 0, 30)
+// returns the public keys that validate the tokens, so other services can
+// verify them without being able to sign them
+func (ms *MasterService) GetSigningKeys(ctx context.Context, in *pb.GetSigningKeysRequest) (*pb.GetSigningKeysResponse, error) {
+	jwks := token.PublicKeys()
+	keys := make([]*pb.SigningKey, 0, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		keys = append(keys, &pb.SigningKey{
+			Kid: jwk.Kid,
+			Kty: jwk.Kty,
+			Alg: jwk.Alg,
+			Use: jwk.Use,
+			Crv: jwk.Crv,
+			X:   jwk.X,
+			N:   jwk.N,
+			E:   jwk.E,
+		})
+	}
+
+	return &pb.GetSigningKeysResponse{Keys: keys}, nil
 }
 
-func isValidCreateMasterRequest(request *pb.CreateMasterRequest) bool {
-	return len(request.GetEmail()) > 0 && len(request.GetPassword()) > 0
+// the methods not listed here are used to get a token
+var masterAuthRequired = map[string]bool{
+	"RotateVaultKey":        true,
+	"ListSessions":          true,
+	"RevokeSession":         true,
+	"Logout":                true,
+	"EnrollTOTP":            true,
+	"ConfirmTOTP":           true,
+	"SendVerificationEmail": true,
+	"RegenerateRecoveryKey": true,
+	"RequestEmailChange":    true,
+	"ChangeEmail":           true,
+	"DeleteMaster":          true,
+	"ExportAccount":         true,
 }
 
-func isValidteAuthMasterRequest(request *pb.AuthMasterRequest) bool {
-	return len(request.GetEmail()) > 0 && len(request.GetPassword()) > 0
+func (ms *MasterService) RequiresAuth(method string) bool {
+	return masterAuthRequired[method]
 }
 
-func isValidUpdateMasterRequest(request *pb.UpdateMasterRequest) bool {
-	return len(request.GetEmail()) > 0 && len(request.GetOldPassword()) > 0 && len(request.GetNewPassword()) > 0
+// returns when the password expires under the current policy, the zero
+// time when it never does
+func (ms *MasterService) getPasswordExpirationDate(master *model.Master) time.Time {
+	expiresAt, _ := ms.expiration.ExpiresAt(master)
+	return expiresAt
+}
+
+// the current password counts as part of the history
+func passwordReused(master *model.Master, password string) bool {
+	size := passwordHistorySize()
+	hashes := append([]string{master.Pwd}, master.PwdHistory...)
+	for i, hash := range hashes {
+		if i > size {
+			break
+		}
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// puts the hash first and drops what is over the size, which also prunes
+// histories kept under a bigger size
+func pushPasswordHistory(history []string, hash string, size int) []string {
+	history = append([]string{hash}, history...)
+	if len(history) > size {
+		history = history[:size]
+	}
+	return history
+}
+
+// PASSWORD_HISTORY, 0 only blocks the current password
+func passwordHistorySize() int {
+	size := getEnvInt("PASSWORD_HISTORY", DefaultPasswordHistory)
+	if size < 0 {
+		return 0
+	}
+	return size
 }
@@ -0,0 +1,63 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/danilomarques1/secretumserver/model"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordReused(t *testing.T) {
+	t.Setenv("PASSWORD_HISTORY", "2")
+	hash := func(password string) string {
+		hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatalf("Err should when hashing be nil %v\n", err)
+		}
+		return string(hashed)
+	}
+	master := &model.Master{
+		Pwd:        hash("current"),
+		PwdHistory: []string{hash("previous"), hash("before previous"), hash("oldest")},
+	}
+	tests := []struct {
+		label    string
+		password string
+		reused   bool
+	}{
+		{"current password", "current", true},
+		{"previous password", "previous", true},
+		{"last password in the history size", "before previous", true},
+		{"password over the history size", "oldest", false},
+		{"new password", "brand new", false},
+	}
+
+	for _, test := range tests {
+		if reused := passwordReused(master, test.password); reused != test.reused {
+			t.Fatalf("Wrong reuse for %v expected %v got %v\n", test.label, test.reused, reused)
+		}
+	}
+}
+
+func TestPushPasswordHistory(t *testing.T) {
+	tests := []struct {
+		label   string
+		history []string
+		size    int
+		pushed  []string
+	}{
+		{"empty history", nil, 3, []string{"new"}},
+		{"under the size", []string{"b", "a"}, 3, []string{"new", "b", "a"}},
+		{"at the size", []string{"c", "b", "a"}, 3, []string{"new", "c", "b"}},
+		{"kept under a bigger size", []string{"e", "d", "c", "b", "a"}, 2, []string{"new", "e"}},
+		{"no history", []string{"a"}, 0, []string{}},
+	}
+
+	for _, test := range tests {
+		pushed := pushPasswordHistory(test.history, "new", test.size)
+		if !reflect.DeepEqual(pushed, test.pushed) {
+			t.Fatalf("Wrong history for %v expected %v got %v\n", test.label, test.pushed, pushed)
+		}
+	}
+}
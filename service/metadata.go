@@ -0,0 +1,223 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/danilomarques1/secretumserver/encrypt"
+	"github.com/danilomarques1/secretumserver/model"
+	"github.com/danilomarques1/secretumserver/pb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	ErrInvalidMetadata = "The password metadata is invalid"
+)
+
+const (
+	MaxURIs         = 20
+	MaxCustomFields = 50
+	MaxNotesLength  = 10000
+	MaxTags         = 20
+	MaxTagLength    = 50
+)
+
+// secretField is an encrypted value of a password along with the data its
+// cipher text is bound to
+type secretField struct {
+	path  string // where the value is stored in the password
+	value *string
+	ad    []byte
+}
+
+// returns the password, the sensitive item data, the notes and the hidden
+// custom fields
+func secretFields(masterId string, password *model.Password) []secretField {
+	fields := make([]secretField, 0)
+	if len(password.Pwd) > 0 {
+		fields = append(fields, secretField{"password", &password.Pwd, encrypt.AssociatedData(masterId, password.Key)})
+	}
+	schema := itemSchemas[password.ItemType()]
+	for i := range password.Data {
+		field := &password.Data[i]
+		if schema.sensitive(field.Name) && len(field.Value) > 0 {
+			ad := encrypt.FieldAssociatedData(masterId, password.Key, "data:"+field.Name)
+			fields = append(fields, secretField{"data.value", &field.Value, ad})
+		}
+	}
+	if len(password.Notes) > 0 {
+		fields = append(fields, secretField{"notes", &password.Notes, encrypt.FieldAssociatedData(masterId, password.Key, "notes")})
+	}
+	for i := range password.Fields {
+		field := &password.Fields[i]
+		if field.Type == model.FieldHidden && len(field.Value) > 0 {
+			ad := encrypt.FieldAssociatedData(masterId, password.Key, "field:"+field.Name)
+			fields = append(fields, secretField{"fields.value", &field.Value, ad})
+		}
+	}
+	return fields
+}
+
+// encrypts the secret fields of the password in place
+func sealPassword(keyring *encrypt.Keyring, masterId string, password *model.Password) error {
+	e := encrypt.NewEncrypt(keyring)
+	for _, field := range secretFields(masterId, password) {
+		encrypted, err := e.EncryptMessage(*field.value, field.ad)
+		if err != nil {
+			return err
+		}
+		*field.value = encrypted
+	}
+	return nil
+}
+
+// decrypts the secret fields of the password in place
+func openPassword(keyring *encrypt.Keyring, masterId string, password *model.Password) error {
+	d := encrypt.NewDecrypt(keyring)
+	for _, field := range secretFields(masterId, password) {
+		decrypted, err := d.DecryptMessage(*field.value, field.ad)
+		if err != nil {
+			return err
+		}
+		*field.value = decrypted
+	}
+	return nil
+}
+
+// copies the metadata of the request into the password, returning
+// InvalidArgument with a field violation per problem
+func setMetadata(password *model.Password, metadata *pb.PasswordMetadata) error {
+	badRequest := &errdetails.BadRequest{}
+	violation := func(field, description string) {
+		badRequest.FieldViolations = append(badRequest.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       field,
+			Description: description,
+		})
+	}
+
+	if len(metadata.GetUris()) > MaxURIs {
+		violation("metadata.uris", fmt.Sprintf("at most %v uris", MaxURIs))
+	}
+	for i, uri := range metadata.GetUris() {
+		parsed, err := url.Parse(uri)
+		if err != nil || len(parsed.Scheme) == 0 || (len(parsed.Host) == 0 && len(parsed.Opaque) == 0) {
+			violation(fmt.Sprintf("metadata.uris[%v]", i), "not an absolute uri")
+		}
+	}
+	if len(metadata.GetNotes()) > MaxNotesLength {
+		violation("metadata.notes", fmt.Sprintf("at most %v characters", MaxNotesLength))
+	}
+	if len(metadata.GetFields()) > MaxCustomFields {
+		violation("metadata.fields", fmt.Sprintf("at most %v fields", MaxCustomFields))
+	}
+	names := make(map[string]bool)
+	fields := make([]model.CustomField, 0, len(metadata.GetFields()))
+	for i, field := range metadata.GetFields() {
+		name := fmt.Sprintf("metadata.fields[%v]", i)
+		if len(field.GetName()) == 0 {
+			violation(name+".name", "required")
+		} else if names[field.GetName()] {
+			violation(name+".name", "used by another field")
+		}
+		names[field.GetName()] = true
+		switch field.GetType() {
+		case model.FieldText, model.FieldHidden:
+		case model.FieldBoolean:
+			if field.GetValue() != "true" && field.GetValue() != "false" {
+				violation(name+".value", "true or false")
+			}
+		default:
+			violation(name+".type", "text, hidden or boolean")
+		}
+		fields = append(fields, model.CustomField{
+			Name:  field.GetName(),
+			Type:  field.GetType(),
+			Value: field.GetValue(),
+		})
+	}
+
+	if len(metadata.GetTags()) > MaxTags {
+		violation("metadata.tags", fmt.Sprintf("at most %v tags", MaxTags))
+	}
+	tags := make([]string, 0, len(metadata.GetTags()))
+	for i, tag := range metadata.GetTags() {
+		tag = normalizeTag(tag)
+		if len(tag) == 0 || len(tag) > MaxTagLength {
+			violation(fmt.Sprintf("metadata.tags[%v]", i), fmt.Sprintf("1 to %v characters", MaxTagLength))
+			continue
+		}
+		// the same tag twice is kept once
+		if !contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+
+	if len(badRequest.FieldViolations) > 0 {
+		log.Printf("Error validating password metadata, %v violations\n", len(badRequest.FieldViolations))
+		return invalidArgument(ErrInvalidMetadata, badRequest)
+	}
+
+	password.Username = metadata.GetUsername()
+	password.URIs = metadata.GetUris()
+	password.Notes = metadata.GetNotes()
+	password.Fields = fields
+	password.FolderId = metadata.GetFolderId()
+	password.Tags = tags
+	return nil
+}
+
+// like setMetadata, checking the folder exists too
+func (ps *PasswordService) setMetadata(masterId string, password *model.Password, metadata *pb.PasswordMetadata) error {
+	if err := setMetadata(password, metadata); err != nil {
+		return err
+	}
+	return ps.checkFolder(masterId, password.FolderId)
+}
+
+// tags are compared ignoring the case and the spaces around them
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// the metadata of a decrypted password
+func metadataToPb(password *model.Password) *pb.PasswordMetadata {
+	fields := make([]*pb.CustomField, 0, len(password.Fields))
+	for _, field := range password.Fields {
+		fields = append(fields, &pb.CustomField{
+			Name:  field.Name,
+			Type:  field.Type,
+			Value: field.Value,
+		})
+	}
+	return &pb.PasswordMetadata{
+		Username: password.Username,
+		Uris:     password.URIs,
+		Notes:    password.Notes,
+		Fields:   fields,
+		FolderId: password.FolderId,
+		Tags:     password.Tags,
+	}
+}
+
+// InvalidArgument carrying the field violations
+func invalidArgument(message string, badRequest *errdetails.BadRequest) error {
+	st := status.New(codes.InvalidArgument, message)
+	detailed, err := st.WithDetails(badRequest)
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
@@ -0,0 +1,101 @@
+package service
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/danilomarques1/secretumserver/model"
+	"github.com/danilomarques1/secretumserver/pb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSetMetadata(t *testing.T) {
+	tests := []struct {
+		label      string
+		metadata   *pb.PasswordMetadata
+		violations []string
+	}{
+		{"valid", &pb.PasswordMetadata{
+			Username: "john",
+			Uris:     []string{"https://github.com", "android://com.github"},
+			Notes:    "notes",
+			Fields:   []*pb.CustomField{{Name: "pin", Type: model.FieldHidden, Value: "1234"}},
+			FolderId: "work",
+			Tags:     []string{" Dev ", "dev", "work"},
+		}, nil},
+		{"empty", &pb.PasswordMetadata{}, nil},
+		{"relative uri", &pb.PasswordMetadata{Uris: []string{"github.com"}}, []string{"metadata.uris[0]"}},
+		{"long notes", &pb.PasswordMetadata{Notes: strings.Repeat("a", MaxNotesLength+1)}, []string{"metadata.notes"}},
+		{"field without name", &pb.PasswordMetadata{
+			Fields: []*pb.CustomField{{Type: model.FieldText}},
+		}, []string{"metadata.fields[0].name"}},
+		{"duplicated field", &pb.PasswordMetadata{
+			Fields: []*pb.CustomField{{Name: "pin", Type: model.FieldText}, {Name: "pin", Type: model.FieldText}},
+		}, []string{"metadata.fields[1].name"}},
+		{"bad boolean", &pb.PasswordMetadata{
+			Fields: []*pb.CustomField{{Name: "2fa", Type: model.FieldBoolean, Value: "yes"}},
+		}, []string{"metadata.fields[0].value"}},
+		{"unknown field type", &pb.PasswordMetadata{
+			Fields: []*pb.CustomField{{Name: "pin", Type: "number"}},
+		}, []string{"metadata.fields[0].type"}},
+		{"empty tag", &pb.PasswordMetadata{Tags: []string{"  "}}, []string{"metadata.tags[0]"}},
+		{"several", &pb.PasswordMetadata{
+			Uris: []string{"github"},
+			Tags: []string{strings.Repeat("a", MaxTagLength+1)},
+		}, []string{"metadata.uris[0]", "metadata.tags[0]"}},
+	}
+
+	for _, test := range tests {
+		password := &model.Password{Username: "old", Tags: []string{"old"}}
+		err := setMetadata(password, test.metadata)
+		if len(test.violations) == 0 {
+			if err != nil {
+				t.Fatalf("Err should for %v be nil %v\n", test.label, err)
+			}
+			continue
+		}
+
+		st := status.Convert(err)
+		if st.Code() != codes.InvalidArgument {
+			t.Fatalf("Wrong code for %v expected %v got %v\n", test.label, codes.InvalidArgument, st.Code())
+		}
+		fields := make([]string, 0)
+		for _, detail := range st.Details() {
+			if badRequest, ok := detail.(*errdetails.BadRequest); ok {
+				for _, violation := range badRequest.GetFieldViolations() {
+					fields = append(fields, violation.GetField())
+				}
+			}
+		}
+		if !reflect.DeepEqual(fields, test.violations) {
+			t.Fatalf("Wrong violations for %v expected %v got %v\n", test.label, test.violations, fields)
+		}
+		// nothing is set when the metadata is invalid
+		if password.Username != "old" || !reflect.DeepEqual(password.Tags, []string{"old"}) {
+			t.Fatalf("The password should be unchanged for %v got %v\n", test.label, password)
+		}
+	}
+}
+
+func TestSetMetadataNormalizesTags(t *testing.T) {
+	password := &model.Password{}
+	metadata := &pb.PasswordMetadata{
+		Username: "john",
+		Fields:   []*pb.CustomField{{Name: "pin", Type: model.FieldHidden, Value: "1234"}},
+		FolderId: "work",
+		Tags:     []string{" Dev ", "dev", "WORK"},
+	}
+	if err := setMetadata(password, metadata); err != nil {
+		t.Fatalf("Err should be nil %v\n", err)
+	}
+	if !reflect.DeepEqual(password.Tags, []string{"dev", "work"}) {
+		t.Fatalf("Wrong tags expected %v got %v\n", []string{"dev", "work"}, password.Tags)
+	}
+	expected := []model.CustomField{{Name: "pin", Type: model.FieldHidden, Value: "1234"}}
+	if password.Username != "john" || password.FolderId != "work" || !reflect.DeepEqual(password.Fields, expected) {
+		t.Fatalf("Wrong metadata got %v\n", password)
+	}
+}
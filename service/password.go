@@ -2,55 +2,79 @@ package service
 
 import (
 	"context"
+	"errors"
 	"log"
+	"time"
 
 	"github.com/danilomarques1/secretumserver/encrypt"
 	"github.com/danilomarques1/secretumserver/generate"
 	"github.com/danilomarques1/secretumserver/model"
 	"github.com/danilomarques1/secretumserver/pb"
 	"github.com/danilomarques1/secretumserver/repository"
-	"github.com/danilomarques1/secretumserver/token"
 	"github.com/google/uuid"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
 var (
-	ErrKeyAlreadyUsed = "Key already used"
+	ErrKeyAlreadyUsed  = "Key already used"
+	ErrPasswordCorrupt = "Stored password failed the integrity check"
+	ErrVaultSealed     = "The vault is sealed"
 )
 
 type PasswordService struct {
 	pb.UnimplementedPasswordServer
 	passwordRepository model.PasswordRepository
-	e                  encrypt.Encrypt
-	d                  encrypt.Decrypt
+	masterRepo         model.MasterRepository
+	folderRepo         model.FolderRepository
+	barrier            *Barrier
+	zeroKnowledge      bool
+	versions           VersionPolicy
 }
 
-func NewPasswordService() (*PasswordService, error) {
+func NewPasswordService(barrier *Barrier) (*PasswordService, error) {
 	passwordRepository, err := repository.NewPasswordRepository()
 	if err != nil {
 		log.Printf("Error creating password service %v\n", err)
 		return nil, err
 	}
-	e, err := encrypt.NewEncrypt()
+	masterRepo, err := repository.NewMasterRepository()
 	if err != nil {
-		log.Printf("error getting encryption type %v\n", err)
+		log.Printf("Error creating password service %v\n", err)
 		return nil, err
 	}
-	d, err := encrypt.NewDecrypt()
+	folderRepo, err := repository.NewFolderRepository()
 	if err != nil {
-		log.Printf("error getting decryption type %v\n", err)
+		log.Printf("Error creating password service %v\n", err)
 		return nil, err
 	}
 
+	// in zero knowledge mode the clients send the passwords already
+	// encrypted and there is no barrier
+	if IsZeroKnowledge() {
+		return &PasswordService{
+			passwordRepository: passwordRepository,
+			masterRepo:         masterRepo,
+			folderRepo:         folderRepo,
+			zeroKnowledge:      true,
+			versions:           LoadVersionPolicy(),
+		}, nil
+	}
+
 	return &PasswordService{
 		passwordRepository: passwordRepository,
-		e:                  e,
-		d:                  d,
+		masterRepo:         masterRepo,
+		folderRepo:         folderRepo,
+		barrier:            barrier,
+		versions:           LoadVersionPolicy(),
 	}, nil
 }
 
-func (ps *PasswordService) SavePassword(context context.Context, in *pb.CreatePasswordRequest) (*pb.CreatePasswordResponse, error) {
+func (ps *PasswordService) SavePassword(ctx context.Context, in *pb.CreatePasswordRequest) (*pb.CreatePasswordResponse, error) {
+	if err := ps.checkSealed(); err != nil {
+		return nil, err
+	}
+
 	if !isValidCreatePasswordRequest(in) {
 		log.Printf("Error validating save password request\n")
 		return nil, status.Errorf(
@@ -59,9 +83,8 @@ func (ps *PasswordService) SavePassword(context context.Context, in *pb.CreatePa
 		)
 	}
 
-	claims, err := token.ValidateAccessToken(in.GetAccessToken())
+	claims, err := getClaims(ctx)
 	if err != nil {
-		log.Printf("Error validating token %v\n", err)
 		return nil, err
 	}
 	masterId := claims.MasterId
@@ -70,17 +93,24 @@ func (ps *PasswordService) SavePassword(context context.Context, in *pb.CreatePa
 		log.Printf("Error because is already registered\n")
 		return nil, status.Errorf(codes.AlreadyExists, ErrKeyAlreadyUsed)
 	}
-
-	encrypted, err := ps.e.EncryptMessage(in.GetPassword())
-	if err != nil {
-		log.Printf("Error while encrypting password %v\n", err)
+	if err := ps.checkUnverifiedLimit(masterId); err != nil {
 		return nil, err
 	}
 
 	password := &model.Password{
-		Id:  uuid.NewString(),
-		Key: in.GetKey(),
-		Pwd: encrypted,
+		Id:   uuid.NewString(),
+		Key:  in.GetKey(),
+		Type: model.ItemLogin,
+		Pwd:  in.GetPassword(),
+	}
+	if in.GetMetadata() != nil {
+		if err := ps.setMetadata(masterId, password, in.GetMetadata()); err != nil {
+			return nil, err
+		}
+	}
+	if err := ps.sealPassword(masterId, password); err != nil {
+		log.Printf("Error while encrypting password %v\n", err)
+		return nil, err
 	}
 
 	if err := ps.passwordRepository.Save(masterId, password); err != nil {
@@ -92,14 +122,17 @@ func (ps *PasswordService) SavePassword(context context.Context, in *pb.CreatePa
 }
 
 func (ps *PasswordService) FindPassword(ctx context.Context, in *pb.FindPasswordRequest) (*pb.FindPasswordResponse, error) {
+	if err := ps.checkSealed(); err != nil {
+		return nil, err
+	}
+
 	if !isValidteFindPasswordRequest(in) {
 		log.Printf("Error validating find password request\n")
 		return nil, status.Errorf(codes.InvalidArgument, ErrValidation)
 	}
 
-	claims, err := token.ValidateAccessToken(in.GetAccessToken())
+	claims, err := getClaims(ctx)
 	if err != nil {
-		log.Printf("Error validating token %v\n", err)
 		return nil, err
 	}
 
@@ -109,9 +142,11 @@ func (ps *PasswordService) FindPassword(ctx context.Context, in *pb.FindPassword
 		log.Printf("Error finding the password %v\n", err)
 		return nil, err
 	}
+	if password.ItemType() != model.ItemLogin {
+		return nil, status.Errorf(codes.FailedPrecondition, ErrNotAPassword)
+	}
 
-	decrypted, err := ps.d.DecryptMessage(password.Pwd)
-	if err != nil {
+	if err := ps.openPassword(masterId, password); err != nil {
 		log.Printf("Error while decrypting password %v\n", err)
 		return nil, err
 	}
@@ -119,19 +154,23 @@ func (ps *PasswordService) FindPassword(ctx context.Context, in *pb.FindPassword
 	return &pb.FindPasswordResponse{
 		Id:       password.Id,
 		Key:      password.Key,
-		Password: decrypted,
+		Password: password.Pwd,
+		Metadata: metadataToPb(password),
 	}, nil
 }
 
 func (ps *PasswordService) RemovePassword(ctx context.Context, in *pb.RemovePasswordRequest) (*pb.RemovePasswordResponse, error) {
+	if err := ps.checkSealed(); err != nil {
+		return nil, err
+	}
+
 	if !isValidRemovePasswordRequest(in) {
 		log.Printf("Error validating remove password request\n")
 		return nil, status.Errorf(codes.InvalidArgument, ErrValidation)
 	}
 
-	claims, err := token.ValidateAccessToken(in.GetAccessToken())
+	claims, err := getClaims(ctx)
 	if err != nil {
-		log.Printf("Error validating token %v\n", err)
 		return nil, err
 	}
 
@@ -141,7 +180,8 @@ func (ps *PasswordService) RemovePassword(ctx context.Context, in *pb.RemovePass
 		return nil, err
 	}
 
-	if err := ps.passwordRepository.Remove(claims.MasterId, password); err != nil {
+	// it stays in the trash until it is purged
+	if err := ps.passwordRepository.Trash(claims.MasterId, password.Id, time.Now()); err != nil {
 		log.Printf("Error removing password %v\n", err)
 		return nil, err
 	}
@@ -150,34 +190,77 @@ func (ps *PasswordService) RemovePassword(ctx context.Context, in *pb.RemovePass
 }
 
 func (ps *PasswordService) FindKeys(ctx context.Context, in *pb.FindKeysRequest) (*pb.FindKeysResponse, error) {
-	if !isValidFindKeysRequest(in) {
-		log.Printf("Error validating find keys request\n")
-		return nil, status.Errorf(codes.InvalidArgument, ErrValidation)
+	if err := ps.checkSealed(); err != nil {
+		return nil, err
 	}
 
-	claims, err := token.ValidateAccessToken(in.GetAccessToken())
+	claims, err := getClaims(ctx)
 	if err != nil {
-		log.Printf("Error validating token %v\n", err)
 		return nil, err
 	}
 
-	keys, err := ps.passwordRepository.FindKeys(claims.MasterId)
+	if len(in.GetFolderId()) == 0 && len(in.GetTag()) == 0 {
+		keys, err := ps.passwordRepository.FindKeys(claims.MasterId)
+		if err != nil {
+			return nil, err
+		}
+		return &pb.FindKeysResponse{Keys: keys}, nil
+	}
+
+	// the passwords of the folder, of the folders inside it too when
+	// asked for, that have the tag
+	folderIds := make(map[string]bool)
+	if len(in.GetFolderId()) > 0 {
+		folders, err := ps.folderRepo.FindAll(claims.MasterId)
+		if err != nil {
+			log.Printf("Error finding folders %v\n", err)
+			return nil, err
+		}
+		if findFolder(folders, in.GetFolderId()) == nil {
+			return nil, status.Errorf(codes.NotFound, ErrFolderNotFound)
+		}
+		folderIds[in.GetFolderId()] = true
+		if in.GetIncludeSubfolders() {
+			for _, id := range folderTree(folders, in.GetFolderId()) {
+				folderIds[id] = true
+			}
+		}
+	}
+	tag := normalizeTag(in.GetTag())
+
+	passwords, err := ps.passwordRepository.FindAll(claims.MasterId)
 	if err != nil {
 		return nil, err
 	}
+	keys := make([]string, 0)
+	for _, password := range passwords {
+		if password.DeletedAt != nil {
+			continue
+		}
+		if len(folderIds) > 0 && !folderIds[password.FolderId] {
+			continue
+		}
+		if len(tag) > 0 && !contains(password.Tags, tag) {
+			continue
+		}
+		keys = append(keys, password.Key)
+	}
 
 	return &pb.FindKeysResponse{Keys: keys}, nil
 }
 
 func (ps *PasswordService) UpdatePassword(ctx context.Context, in *pb.UpdatePasswordRequest) (*pb.UpdatePasswordResponse, error) {
+	if err := ps.checkSealed(); err != nil {
+		return nil, err
+	}
+
 	if !isValidUpdatePasswordRequest(in) {
 		log.Printf("Error validating update password request\n")
 		return nil, status.Errorf(codes.InvalidArgument, ErrValidation)
 	}
 
-	claims, err := token.ValidateAccessToken(in.GetAccessToken())
+	claims, err := getClaims(ctx)
 	if err != nil {
-		log.Printf("Error validating token %v\n", err)
 		return nil, err
 	}
 
@@ -186,15 +269,30 @@ func (ps *PasswordService) UpdatePassword(ctx context.Context, in *pb.UpdatePass
 		log.Printf("Error finding the password %v\n", err)
 		return nil, err
 	}
+	if password.ItemType() != model.ItemLogin {
+		return nil, status.Errorf(codes.FailedPrecondition, ErrNotAPassword)
+	}
 
-	encrypted, err := ps.e.EncryptMessage(in.GetPassword())
-	if err != nil {
+	// every secret field is encrypted again, the metadata included
+	version := newVersion(password, claims.SessionId)
+	if err := ps.openPassword(claims.MasterId, password); err != nil {
+		log.Printf("Error decrypting password %v\n", err)
+		return nil, err
+	}
+	if len(in.GetPassword()) > 0 {
+		password.Pwd = in.GetPassword()
+	}
+	if in.GetMetadata() != nil {
+		if err := ps.setMetadata(claims.MasterId, password, in.GetMetadata()); err != nil {
+			return nil, err
+		}
+	}
+	if err := ps.sealPassword(claims.MasterId, password); err != nil {
 		log.Printf("Error encrypting password %v\n", err)
 		return nil, err
 	}
 
-	password.Pwd = encrypted
-	if err := ps.passwordRepository.Update(claims.MasterId, password); err != nil {
+	if err := ps.updateWithVersion(claims.MasterId, password, version); err != nil {
 		log.Printf("Error updating password %v\n", err)
 		return nil, err
 	}
@@ -203,34 +301,45 @@ func (ps *PasswordService) UpdatePassword(ctx context.Context, in *pb.UpdatePass
 }
 
 func (ps *PasswordService) GeneratePassword(ctx context.Context, in *pb.GeneratePasswordRequest) (*pb.GeneratePasswordResponse, error) {
+	if err := ps.checkSealed(); err != nil {
+		return nil, err
+	}
+
 	if !isValidGeneratePasswordRequest(in) {
 		log.Printf("Error validating find password request\n")
 		return nil, status.Errorf(codes.InvalidArgument, ErrValidation)
 	}
 
-	claims, err := token.ValidateAccessToken(in.GetAccessToken())
+	claims, err := getClaims(ctx)
 	if err != nil {
-		log.Printf("Error validating token %v\n", err)
 		return nil, err
 	}
 
+	// the server can not encrypt the generated password for the client
+	if ps.zeroKnowledge {
+		return nil, status.Errorf(codes.FailedPrecondition, ErrZeroKnowledgeGenerate)
+	}
+
 	if _, err := ps.passwordRepository.FindByKey(claims.MasterId, in.GetKey()); err == nil {
 		log.Printf("Error because is already registered\n")
 		return nil, status.Errorf(codes.AlreadyExists, ErrKeyAlreadyUsed)
 	}
+	if err := ps.checkUnverifiedLimit(claims.MasterId); err != nil {
+		return nil, err
+	}
 
 	generatePassword := generate.NewGeneratePassword(in.GetKeyphrase())
 	generatedPassword := generatePassword.Generate()
-	encrypted, err := ps.e.EncryptMessage(generatedPassword)
-	if err != nil {
+	password := &model.Password{
+		Id:   uuid.NewString(),
+		Key:  in.GetKey(),
+		Type: model.ItemLogin,
+		Pwd:  generatedPassword,
+	}
+	if err := ps.sealPassword(claims.MasterId, password); err != nil {
 		log.Printf("Error encrypting message %v\n", err)
 		return nil, err
 	}
-	password := &model.Password{
-		Id:  uuid.NewString(),
-		Key: in.GetKey(),
-		Pwd: encrypted,
-	}
 
 	if err := ps.passwordRepository.Save(claims.MasterId, password); err != nil {
 		log.Printf("error when saving password %v\n", err)
@@ -240,26 +349,99 @@ func (ps *PasswordService) GeneratePassword(ctx context.Context, in *pb.Generate
 	return &pb.GeneratePasswordResponse{Id: password.Id, Key: password.Key, Password: password.Pwd}, nil
 }
 
+// every Password method needs an authenticated master
+func (ps *PasswordService) RequiresAuth(method string) bool {
+	return true
+}
+
+// every request is refused with Unavailable while the vault is sealed
+func (ps *PasswordService) checkSealed() error {
+	if ps.zeroKnowledge {
+		return nil
+	}
+	if _, err := ps.barrier.DataKeys(); err != nil {
+		log.Printf("Error refusing request %v\n", err)
+		return status.Errorf(codes.Unavailable, ErrVaultSealed)
+	}
+	return nil
+}
+
+// masters that did not verify the email can only save a few passwords
+func (ps *PasswordService) checkUnverifiedLimit(masterId string) error {
+	master, err := ps.masterRepo.FindById(masterId)
+	if err != nil {
+		log.Printf("Error finding master %v\n", err)
+		return err
+	}
+	if master.EmailVerified() {
+		return nil
+	}
+	keys, err := ps.passwordRepository.FindKeys(masterId)
+	if err != nil {
+		log.Printf("Error finding keys %v\n", err)
+		return err
+	}
+	if len(keys) >= unverifiedPasswordLimit() {
+		return status.Errorf(codes.FailedPrecondition, ErrEmailNotVerified)
+	}
+	return nil
+}
+
+func (ps *PasswordService) keyring(masterId string) (*encrypt.Keyring, error) {
+	dataKeys, err := ps.barrier.DataKeys()
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, ErrVaultSealed)
+	}
+	return dataKeys.Keyring(masterId)
+}
+
+// in zero knowledge mode the password, the notes and the hidden fields
+// are opaque client encrypted blobs and are stored as they are
+func (ps *PasswordService) sealPassword(masterId string, password *model.Password) error {
+	if ps.zeroKnowledge {
+		return nil
+	}
+	keyring, err := ps.keyring(masterId)
+	if err != nil {
+		return err
+	}
+	return sealPassword(keyring, masterId, password)
+}
+
+func (ps *PasswordService) openPassword(masterId string, password *model.Password) error {
+	if ps.zeroKnowledge {
+		return nil
+	}
+	keyring, err := ps.keyring(masterId)
+	if err != nil {
+		return err
+	}
+	if err := openPassword(keyring, masterId, password); err != nil {
+		if errors.Is(err, encrypt.ErrAuthentication) {
+			return status.Errorf(codes.DataLoss, ErrPasswordCorrupt)
+		}
+		return err
+	}
+	return nil
+}
+
 func isValidCreatePasswordRequest(request *pb.CreatePasswordRequest) bool {
-	return len(request.GetKey()) > 0 && len(request.GetPassword()) > 0 && len(request.GetAccessToken()) > 0
+	return len(request.GetKey()) > 0 && len(request.GetPassword()) > 0
 }
 
 func isValidteFindPasswordRequest(request *pb.FindPasswordRequest) bool {
-	return len(request.GetAccessToken()) > 0 && len(request.GetKey()) > 0
+	return len(request.GetKey()) > 0
 }
 
 func isValidRemovePasswordRequest(request *pb.RemovePasswordRequest) bool {
-	return len(request.GetAccessToken()) > 0 && len(request.GetKey()) > 0
-}
-
-func isValidFindKeysRequest(request *pb.FindKeysRequest) bool {
-	return len(request.GetAccessToken()) > 0
+	return len(request.GetKey()) > 0
 }
 
+// the password is kept when only the metadata is given
 func isValidUpdatePasswordRequest(request *pb.UpdatePasswordRequest) bool {
-	return len(request.GetKey()) > 0 && len(request.GetPassword()) > 0 && len(request.GetAccessToken()) == 0
+	return len(request.GetKey()) > 0 && (len(request.GetPassword()) > 0 || request.GetMetadata() != nil)
 }
 
 func isValidGeneratePasswordRequest(request *pb.GeneratePasswordRequest) bool {
-	return len(request.GetAccessToken()) > 0 && len(request.GetKey()) > 0 && len(request.GetKeyphrase()) > 0
+	return len(request.GetKey()) > 0 && len(request.GetKeyphrase()) > 0
 }
@@ -0,0 +1,41 @@
+package service
+
+import (
+	"log"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	ErrWeakPassword = "The password does not follow the password policy"
+)
+
+// returns InvalidArgument with a field violation per failed rule, so the
+// client can show what has to change. In zero knowledge mode the server
+// only gets the auth hash, the client checks the policy
+func (ms *MasterService) checkPasswordPolicy(field, password, email string) error {
+	if IsZeroKnowledge() {
+		return nil
+	}
+	violations := ms.passwordPolicy.Check(password, email)
+	if len(violations) == 0 {
+		return nil
+	}
+	log.Printf("Error validating password policy, %v rules failed\n", len(violations))
+
+	badRequest := &errdetails.BadRequest{}
+	for _, violation := range violations {
+		badRequest.FieldViolations = append(badRequest.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       field,
+			Description: violation.Rule + ": " + violation.Message,
+		})
+	}
+	st := status.New(codes.InvalidArgument, ErrWeakPassword)
+	detailed, err := st.WithDetails(badRequest)
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
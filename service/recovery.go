@@ -0,0 +1,145 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/danilomarques1/secretumserver/model"
+	"github.com/danilomarques1/secretumserver/pb"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	ErrWrongRecoveryKey = "The given recovery key is invalid"
+)
+
+const (
+	RecoveryKeySize  = 20 // bytes, encoded in base32 as 32 chars
+	recoveryKeyGroup = 8  // chars between the dashes
+)
+
+// resets the master password with the recovery key. Every token of the
+// master is revoked and the recovery key is replaced, the new one is
+// returned. Not available in zero knowledge mode, the vault would be lost
+func (ms *MasterService) RecoverMaster(ctx context.Context, in *pb.RecoverMasterRequest) (*pb.RecoverMasterResponse, error) {
+	if IsZeroKnowledge() {
+		return nil, status.Errorf(codes.FailedPrecondition, ErrZeroKnowledgeRecovery)
+	}
+	if len(in.GetEmail()) == 0 || len(in.GetRecoveryKey()) == 0 || len(in.GetNewPassword()) == 0 {
+		log.Printf("Error validating recover master request\n")
+		return nil, status.Errorf(codes.InvalidArgument, ErrValidation)
+	}
+	if err := ms.attempts.Check(ctx, in.GetEmail()); err != nil {
+		log.Printf("Error recovering master %v\n", err)
+		return nil, err
+	}
+
+	master, err := ms.masterRepo.FindByEmail(in.GetEmail())
+	if err != nil {
+		log.Printf("Error finding master by email %v\n", err)
+		ms.attempts.Failure(ctx, in.GetEmail())
+		return nil, status.Errorf(codes.NotFound, ErrWrongRecoveryKey)
+	}
+	hashedKey := hashRecoveryCode(in.GetRecoveryKey())
+	if len(master.RecoveryKey) == 0 || subtle.ConstantTimeCompare([]byte(master.RecoveryKey), []byte(hashedKey)) != 1 {
+		log.Printf("Error comparing recovery key\n")
+		ms.attempts.Failure(ctx, in.GetEmail())
+		return nil, status.Errorf(codes.NotFound, ErrWrongRecoveryKey)
+	}
+	if err := ms.checkPasswordPolicy("new_password", in.GetNewPassword(), master.Email); err != nil {
+		return nil, err
+	}
+
+	if err := ms.setMasterPassword(master, in.GetNewPassword()); err != nil {
+		log.Printf("Error hashing master password %v\n", err)
+		return nil, err
+	}
+	recoveryKey, newHashedKey, err := generateRecoveryKey()
+	if err != nil {
+		log.Printf("Error generating recovery key %v\n", err)
+		return nil, err
+	}
+	master.RecoveryKey = newHashedKey
+
+	// a key used by a concurrent recovery can not be used again
+	updated, err := ms.masterRepo.UpdateWithRecoveryKey(master, hashedKey)
+	if err != nil {
+		log.Printf("Error updating master %v\n", err)
+		return nil, err
+	}
+	if !updated {
+		return nil, status.Errorf(codes.NotFound, ErrWrongRecoveryKey)
+	}
+	ms.attempts.Success(master.Email)
+
+	if err := ms.revokeAll(master.Id, RevokedRecovery); err != nil {
+		return nil, err
+	}
+
+	return &pb.RecoverMasterResponse{RecoveryKey: recoveryKey}, nil
+}
+
+// replaces the recovery key, the masters created before the recovery keys
+// get their first one here. Needs the password
+func (ms *MasterService) RegenerateRecoveryKey(ctx context.Context, in *pb.RegenerateRecoveryKeyRequest) (*pb.RegenerateRecoveryKeyResponse, error) {
+	if IsZeroKnowledge() {
+		return nil, status.Errorf(codes.FailedPrecondition, ErrZeroKnowledgeRecovery)
+	}
+	if len(in.GetPassword()) == 0 {
+		log.Printf("Error validating regenerate recovery key request\n")
+		return nil, status.Errorf(codes.InvalidArgument, ErrValidation)
+	}
+	master, err := ms.reauthenticate(ctx, in.GetPassword(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	recoveryKey, hashedKey, err := generateRecoveryKey()
+	if err != nil {
+		log.Printf("Error generating recovery key %v\n", err)
+		return nil, err
+	}
+	if err := ms.masterRepo.SetRecoveryKey(master.Id, hashedKey); err != nil {
+		log.Printf("Error saving recovery key %v\n", err)
+		return nil, err
+	}
+
+	return &pb.RegenerateRecoveryKeyResponse{RecoveryKey: recoveryKey}, nil
+}
+
+// sets the hash of a new password, or auth hash, moving the current one to
+// the history and restarting the expiration
+func (ms *MasterService) setMasterPassword(master *model.Master, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	master.PwdHistory = pushPasswordHistory(master.PwdHistory, master.Pwd, passwordHistorySize())
+	master.Pwd = string(hashedPassword)
+	master.PwdUpdatedAt = time.Now()
+	master.GraceLoginsUsed = 0
+	master.PwdExpirationDate = ms.getPasswordExpirationDate(master)
+	return nil
+}
+
+// returns the key to show to the master once and its hash, like the
+// recovery codes it is random enough for a plain sha256
+func generateRecoveryKey() (string, string, error) {
+	b := make([]byte, RecoveryKeySize)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	encoded := strings.ToLower(recoveryCodeEncoding.EncodeToString(b))
+	groups := make([]string, 0, len(encoded)/recoveryKeyGroup)
+	for i := 0; i < len(encoded); i += recoveryKeyGroup {
+		groups = append(groups, encoded[i:i+recoveryKeyGroup])
+	}
+	key := strings.Join(groups, "-")
+	return key, hashRecoveryCode(key), nil
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/danilomarques1/secretumserver/model"
+	"github.com/danilomarques1/secretumserver/pb"
+	"github.com/danilomarques1/secretumserver/policy"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// keeps a single master in memory, only what RecoverMaster uses
+type recoveryRepository struct {
+	model.MasterRepository
+	master *model.Master
+	// returned by FindByEmail instead of the master, like a read done
+	// before a concurrent recovery
+	found *model.Master
+}
+
+func (r *recoveryRepository) FindByEmail(email string) (*model.Master, error) {
+	master := r.master
+	if r.found != nil {
+		master = r.found
+	}
+	if master.Email != email {
+		return nil, status.Errorf(codes.NotFound, ErrWrongRecoveryKey)
+	}
+	found := *master
+	return &found, nil
+}
+
+func (r *recoveryRepository) UpdateWithRecoveryKey(master *model.Master, hashedKey string) (bool, error) {
+	if r.master.RecoveryKey != hashedKey {
+		return false, nil
+	}
+	updated := *master
+	r.master = &updated
+	return true, nil
+}
+
+func (r *recoveryRepository) NextTokenGeneration(id string) (int64, error) {
+	r.master.TokenGeneration++
+	return r.master.TokenGeneration, nil
+}
+
+// records the masters whose sessions were revoked
+type revokedSessionRepository struct {
+	model.SessionRepository
+	revoked []string
+}
+
+func (r *revokedSessionRepository) RevokeAllByMasterId(masterId, reason string) error {
+	r.revoked = append(r.revoked, masterId)
+	return nil
+}
+
+func TestRecoverMaster(t *testing.T) {
+	t.Setenv("VAULT_MODE", "")
+	recoveryKey, hashedKey, err := generateRecoveryKey()
+	if err != nil {
+		t.Fatalf("Err should when generating the recovery key be nil %v\n", err)
+	}
+	oldPwd, _ := bcrypt.GenerateFromPassword([]byte("old password"), bcrypt.MinCost)
+	newMaster := func() *model.Master {
+		return &model.Master{Id: "id", Email: "john@mail.com", Pwd: string(oldPwd), RecoveryKey: hashedKey}
+	}
+	tests := []struct {
+		label       string
+		email       string
+		recoveryKey string
+		password    string
+		used        bool // the key was used by a recovery in between
+		code        codes.Code
+	}{
+		{"recovered", "john@mail.com", recoveryKey, "Hold-back-the-river-7", false, codes.OK},
+		{"key in upper case", "john@mail.com", " " + strings.ToUpper(recoveryKey) + " ", "Hold-back-the-river-7", false, codes.OK},
+		{"wrong key", "john@mail.com", "aaaaaaaa-bbbbbbbb-cccccccc-dddddddd", "Hold-back-the-river-7", false, codes.NotFound},
+		{"unknown email", "jane@mail.com", recoveryKey, "Hold-back-the-river-7", false, codes.NotFound},
+		{"weak password", "john@mail.com", recoveryKey, "short", false, codes.InvalidArgument},
+		{"key used meanwhile", "john@mail.com", recoveryKey, "Hold-back-the-river-7", true, codes.NotFound},
+	}
+
+	for _, test := range tests {
+		repo := &recoveryRepository{master: newMaster()}
+		if test.used {
+			repo.found = newMaster()
+			repo.master.RecoveryKey = hashRecoveryCode("another key")
+		}
+		sessionRepo := &revokedSessionRepository{}
+		ms := &MasterService{
+			masterRepo:     repo,
+			sessionRepo:    sessionRepo,
+			attempts:       newTestAttemptTracker(),
+			passwordPolicy: policy.DefaultPolicy(),
+			expiration:     &ExpirationSettings{Default: &model.ExpirationPolicy{Mode: model.ExpireNever}},
+		}
+
+		response, err := ms.RecoverMaster(context.Background(), &pb.RecoverMasterRequest{
+			Email:       test.email,
+			RecoveryKey: test.recoveryKey,
+			NewPassword: test.password,
+		})
+		if code := status.Code(err); code != test.code {
+			t.Fatalf("Wrong code for %v expected %v got %v %v\n", test.label, test.code, code, err)
+		}
+		if test.code != codes.OK {
+			if repo.master.Pwd != string(oldPwd) || len(sessionRepo.revoked) > 0 {
+				t.Fatalf("The master should be unchanged for %v\n", test.label)
+			}
+			continue
+		}
+
+		if bcrypt.CompareHashAndPassword([]byte(repo.master.Pwd), []byte(test.password)) != nil {
+			t.Fatalf("The password should have been changed for %v\n", test.label)
+		}
+		if repo.master.RecoveryKey != hashRecoveryCode(response.GetRecoveryKey()) || repo.master.RecoveryKey == hashedKey {
+			t.Fatalf("The recovery key should have been replaced for %v\n", test.label)
+		}
+		if len(sessionRepo.revoked) != 1 || repo.master.TokenGeneration != 1 {
+			t.Fatalf("The tokens should have been revoked for %v\n", test.label)
+		}
+
+		// the key can not be used twice
+		_, err = ms.RecoverMaster(context.Background(), &pb.RecoverMasterRequest{
+			Email:       test.email,
+			RecoveryKey: test.recoveryKey,
+			NewPassword: "Another-long-password-8",
+		})
+		if code := status.Code(err); code != codes.NotFound {
+			t.Fatalf("Wrong code for %v used twice expected %v got %v\n", test.label, codes.NotFound, code)
+		}
+	}
+}
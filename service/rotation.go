@@ -0,0 +1,204 @@
+package service
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/danilomarques1/secretumserver/encrypt"
+	"github.com/danilomarques1/secretumserver/model"
+	"github.com/danilomarques1/secretumserver/repository"
+)
+
+// how many re-encrypted passwords between progress logs
+const rotationLogEvery = 100
+
+type RotationProgress struct {
+	StartedAt     time.Time
+	FinishedAt    time.Time
+	Masters       int // masters found when the job started
+	MastersDone   int
+	Passwords     int // passwords inspected so far
+	Reencrypted   int
+	Failed        int
+	Running       bool
+	LastErr       error
+	CurrentMaster string
+}
+
+// KeyRotation re-encrypts every stored password that was not encrypted
+// with the master data key, moving the passwords written with the legacy
+// keyring over. It runs while the server is serving requests, entries
+// changed in the meantime are left alone. The admin service reports its
+// progress
+type KeyRotation struct {
+	passwordRepository model.PasswordRepository
+	barrier            *Barrier
+
+	mu       sync.Mutex
+	progress RotationProgress
+}
+
+func NewKeyRotation(barrier *Barrier) (*KeyRotation, error) {
+	passwordRepository, err := repository.NewPasswordRepository()
+	if err != nil {
+		log.Printf("Error creating key rotation %v\n", err)
+		return nil, err
+	}
+
+	return &KeyRotation{
+		passwordRepository: passwordRepository,
+		barrier:            barrier,
+	}, nil
+}
+
+// Progress returns a snapshot of the job progress
+func (kr *KeyRotation) Progress() RotationProgress {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	return kr.progress
+}
+
+// Run does nothing when the job is already running
+func (kr *KeyRotation) Run(ctx context.Context) error {
+	dataKeys, err := kr.barrier.DataKeys()
+	if err != nil {
+		return err
+	}
+	kr.mu.Lock()
+	running := kr.progress.Running
+	kr.progress.Running = true
+	kr.mu.Unlock()
+	if running {
+		return nil
+	}
+
+	masterIds, err := kr.passwordRepository.FindMasterIds()
+	if err != nil {
+		log.Printf("Error finding masters to rotate %v\n", err)
+		kr.finish(err)
+		return err
+	}
+
+	kr.update(func(p *RotationProgress) {
+		*p = RotationProgress{StartedAt: time.Now(), Masters: len(masterIds), Running: true}
+	})
+	log.Printf("Starting key rotation of %v masters\n", len(masterIds))
+
+	for _, masterId := range masterIds {
+		if err := ctx.Err(); err != nil {
+			kr.finish(err)
+			return err
+		}
+		kr.update(func(p *RotationProgress) { p.CurrentMaster = masterId })
+		if err := kr.rotateMaster(dataKeys, masterId); err != nil {
+			log.Printf("Error rotating passwords of master %v %v\n", masterId, err)
+			kr.update(func(p *RotationProgress) { p.LastErr = err })
+		}
+		kr.update(func(p *RotationProgress) { p.MastersDone++ })
+	}
+
+	kr.finish(nil)
+	progress := kr.Progress()
+	log.Printf(
+		"Key rotation finished: %v passwords inspected, %v re-encrypted, %v failed\n",
+		progress.Passwords, progress.Reencrypted, progress.Failed,
+	)
+	return nil
+}
+
+func (kr *KeyRotation) rotateMaster(dataKeys *DataKeys, masterId string) error {
+	passwords, err := kr.passwordRepository.FindAll(masterId)
+	if err != nil {
+		return err
+	}
+	keyring, err := dataKeys.Keyring(masterId)
+	if err != nil {
+		return err
+	}
+
+	for i := range passwords {
+		password := &passwords[i]
+		rotated, err := kr.rotatePassword(keyring, masterId, password)
+		kr.update(func(p *RotationProgress) {
+			p.Passwords++
+			if err != nil {
+				p.Failed++
+				p.LastErr = err
+			}
+			if rotated {
+				p.Reencrypted++
+				if p.Reencrypted%rotationLogEvery == 0 {
+					log.Printf("Key rotation progress: %v passwords re-encrypted, %v/%v masters\n", p.Reencrypted, p.MastersDone, p.Masters)
+				}
+			}
+		})
+		if err != nil {
+			log.Printf("Error rotating password %v of master %v %v\n", password.Id, masterId, err)
+		}
+	}
+
+	return nil
+}
+
+func (kr *KeyRotation) rotatePassword(keyring *encrypt.Keyring, masterId string, password *model.Password) (bool, error) {
+	// the versions are encrypted again along with the password
+	entries := []*model.Password{password}
+	for i := range password.Versions {
+		entries = append(entries, versionEntry(password, &password.Versions[i]))
+	}
+	needs := false
+	for _, entry := range entries {
+		for _, field := range secretFields(masterId, entry) {
+			fieldNeeds, err := keyring.NeedsReencrypt(*field.value)
+			if err != nil {
+				return false, err
+			}
+			needs = needs || fieldNeeds
+		}
+	}
+	if !needs {
+		return false, nil
+	}
+
+	// every update encrypts all the fields again with a new nonce, the
+	// first one is enough to tell whether the entry changed. An entry
+	// without secrets of its own only has its versions to rotate
+	path, old := "_id", password.Id
+	if fields := secretFields(masterId, password); len(fields) > 0 {
+		path, old = fields[0].path, *fields[0].value
+	}
+	for i, entry := range entries {
+		if err := openPassword(keyring, masterId, entry); err != nil {
+			return false, err
+		}
+		if err := sealPassword(keyring, masterId, entry); err != nil {
+			return false, err
+		}
+		if i > 0 {
+			version := &password.Versions[i-1]
+			version.Pwd, version.Data, version.Notes, version.Fields = entry.Pwd, entry.Data, entry.Notes, entry.Fields
+		}
+	}
+	// false means the user updated the entry meanwhile, which already
+	// encrypted it with the primary key
+	return kr.passwordRepository.CompareAndUpdate(masterId, password, path, old)
+}
+
+func (kr *KeyRotation) update(fn func(*RotationProgress)) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	fn(&kr.progress)
+}
+
+func (kr *KeyRotation) finish(err error) {
+	kr.update(func(p *RotationProgress) {
+		p.Running = false
+		p.FinishedAt = time.Now()
+		p.CurrentMaster = ""
+		if err != nil {
+			p.LastErr = err
+		}
+	})
+}
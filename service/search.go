@@ -0,0 +1,138 @@
+package service
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/danilomarques1/secretumserver/model"
+	"github.com/danilomarques1/secretumserver/pb"
+	"github.com/danilomarques1/secretumserver/search"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	ErrInvalidSearchMode = "Invalid search mode, use prefix, substring or fuzzy"
+)
+
+const (
+	DefaultSearchLimit = 20
+	MaxSearchLimit     = 100
+)
+
+// how much a match on each field counts, the key matters most
+var searchWeights = map[string]float64{
+	"key":      1.0,
+	"username": 0.8,
+	"host":     0.8,
+	"tag":      0.7,
+}
+
+// searches the key, the username, the uri hosts and the tags of the
+// passwords. Those are never encrypted, so nothing is decrypted and it
+// works while the vault is sealed and in zero knowledge mode too
+func (ps *PasswordService) SearchPasswords(ctx context.Context, in *pb.SearchPasswordsRequest) (*pb.SearchPasswordsResponse, error) {
+	if len(strings.TrimSpace(in.GetQuery())) == 0 || in.GetLimit() < 0 {
+		log.Printf("Error validating search passwords request\n")
+		return nil, status.Errorf(codes.InvalidArgument, ErrValidation)
+	}
+	mode, err := search.ParseMode(in.GetMode())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, ErrInvalidSearchMode)
+	}
+	limit := int(in.GetLimit())
+	if limit == 0 {
+		limit = DefaultSearchLimit
+	}
+	if limit > MaxSearchLimit {
+		limit = MaxSearchLimit
+	}
+
+	claims, err := getClaims(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	passwords, err := ps.passwordRepository.FindAll(claims.MasterId)
+	if err != nil {
+		log.Printf("Error finding passwords %v\n", err)
+		return nil, err
+	}
+
+	tag := normalizeTag(in.GetTag())
+	byId := make(map[string]*model.Password)
+	documents := make([]search.Document, 0, len(passwords))
+	for i := range passwords {
+		password := &passwords[i]
+		if password.DeletedAt != nil {
+			continue
+		}
+		if len(in.GetType()) > 0 && password.ItemType() != in.GetType() {
+			continue
+		}
+		if len(in.GetFolderId()) > 0 && password.FolderId != in.GetFolderId() {
+			continue
+		}
+		if len(tag) > 0 && !contains(password.Tags, tag) {
+			continue
+		}
+		byId[password.Id] = password
+		documents = append(documents, searchDocument(password))
+	}
+
+	results := search.Rank(in.GetQuery(), mode, documents, limit)
+	response := &pb.SearchPasswordsResponse{Results: make([]*pb.SearchResult, 0, len(results))}
+	for _, result := range results {
+		password := byId[result.Id]
+		response.Results = append(response.Results, &pb.SearchResult{
+			Id:           password.Id,
+			Key:          password.Key,
+			Type:         password.ItemType(),
+			Username:     password.Username,
+			Hosts:        uriHosts(password.URIs),
+			Tags:         password.Tags,
+			FolderId:     password.FolderId,
+			Score:        result.Score,
+			MatchedField: result.MatchedField,
+		})
+	}
+
+	return response, nil
+}
+
+// only the fields that are stored in plain text
+func searchDocument(password *model.Password) search.Document {
+	document := search.Document{
+		Id:   password.Id,
+		Name: password.Key,
+		Fields: []search.Field{
+			{Name: "key", Value: password.Key, Weight: searchWeights["key"]},
+			{Name: "username", Value: password.Username, Weight: searchWeights["username"]},
+		},
+	}
+	for _, host := range uriHosts(password.URIs) {
+		document.Fields = append(document.Fields, search.Field{Name: "host", Value: host, Weight: searchWeights["host"]})
+	}
+	for _, tag := range password.Tags {
+		document.Fields = append(document.Fields, search.Field{Name: "tag", Value: tag, Weight: searchWeights["tag"]})
+	}
+	return document
+}
+
+// the hosts of the uris without the www, each one once
+func uriHosts(uris []string) []string {
+	hosts := make([]string, 0, len(uris))
+	for _, uri := range uris {
+		parsed, err := url.Parse(uri)
+		if err != nil {
+			continue
+		}
+		host := strings.TrimPrefix(strings.ToLower(parsed.Hostname()), "www.")
+		if len(host) > 0 && !contains(hosts, host) {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
@@ -0,0 +1,223 @@
+package service
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/danilomarques1/secretumserver/model"
+	"github.com/danilomarques1/secretumserver/pb"
+	"github.com/danilomarques1/secretumserver/token"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	ErrInvalidRefreshToken = "Invalid refresh token"
+	ErrSessionNotFound     = "Session not found"
+)
+
+// reasons recorded on revoked sessions
+const (
+	RevokedByMaster       = "revoked by master"
+	RevokedRefreshReused  = "refresh token reused"
+	RevokedLogout         = "logout"
+	RevokedPasswordChange = "master password changed"
+	RevokedRecovery       = "master recovered"
+	RevokedDeleted        = "master deleted"
+)
+
+// starts a session for a freshly authenticated master
+func (ms *MasterService) startSession(ctx context.Context, master *model.Master) (*token.TokenResponse, error) {
+	sessionId := uuid.NewString()
+	tokenResponse, err := token.GetToken(master.Id, sessionId, master.TokenGeneration)
+	if err != nil {
+		return nil, err
+	}
+
+	userAgent, peerAddr := requestOrigin(ctx)
+	now := time.Now()
+	session := &model.Session{
+		Id:              sessionId,
+		MasterId:        master.Id,
+		TokenId:         tokenResponse.RefreshTokenId,
+		UserAgent:       userAgent,
+		PeerAddr:        peerAddr,
+		CreatedAt:       now,
+		LastUsedAt:      now,
+		ExpiresAt:       tokenResponse.RefreshExpiresAt,
+		TokenGeneration: master.TokenGeneration,
+	}
+	if err := ms.sessionRepo.Save(session); err != nil {
+		return nil, err
+	}
+
+	return tokenResponse, nil
+}
+
+// rotates the session refresh token. A refresh token that is not the
+// latest one of its session was already used, so it was stolen or the
+// client was cloned: the whole session is revoked
+func (ms *MasterService) refreshSession(claims *token.Claims) (*token.TokenResponse, error) {
+	session, err := ms.sessionRepo.FindById(claims.SessionId)
+	if err != nil || session.MasterId != claims.MasterId || !session.IsActive() {
+		log.Printf("Error finding an active session for the refresh token %v\n", err)
+		return nil, status.Errorf(codes.Unauthenticated, ErrInvalidRefreshToken)
+	}
+
+	if session.TokenId != claims.Id {
+		ms.revokeReusedSession(session)
+		return nil, status.Errorf(codes.Unauthenticated, ErrInvalidRefreshToken)
+	}
+
+	tokenResponse, err := token.GetToken(session.MasterId, session.Id, session.TokenGeneration)
+	if err != nil {
+		return nil, err
+	}
+	rotated, err := ms.sessionRepo.Rotate(session.Id, claims.Id, tokenResponse.RefreshTokenId, tokenResponse.RefreshExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	// another request used the same refresh token first
+	if !rotated {
+		ms.revokeReusedSession(session)
+		return nil, status.Errorf(codes.Unauthenticated, ErrInvalidRefreshToken)
+	}
+
+	return tokenResponse, nil
+}
+
+func (ms *MasterService) revokeReusedSession(session *model.Session) {
+	log.Printf("Refresh token reused on session %v, revoking it\n", session.Id)
+	ms.revokeSession(session.Id, RevokedRefreshReused)
+}
+
+func (ms *MasterService) ListSessions(ctx context.Context, in *pb.ListSessionsRequest) (*pb.ListSessionsResponse, error) {
+	claims, err := getClaims(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions, err := ms.sessionRepo.FindActiveByMasterId(claims.MasterId)
+	if err != nil {
+		log.Printf("Error finding sessions %v\n", err)
+		return nil, err
+	}
+
+	response := &pb.ListSessionsResponse{Sessions: make([]*pb.Session, 0, len(sessions))}
+	for _, session := range sessions {
+		response.Sessions = append(response.Sessions, &pb.Session{
+			Id:         session.Id,
+			UserAgent:  session.UserAgent,
+			PeerAddr:   session.PeerAddr,
+			CreatedAt:  session.CreatedAt.Unix(),
+			LastUsedAt: session.LastUsedAt.Unix(),
+			ExpiresAt:  session.ExpiresAt.Unix(),
+			Current:    session.Id == claims.SessionId,
+		})
+	}
+
+	return response, nil
+}
+
+func (ms *MasterService) RevokeSession(ctx context.Context, in *pb.RevokeSessionRequest) (*pb.RevokeSessionResponse, error) {
+	if len(in.GetSessionId()) == 0 {
+		log.Printf("Error validating revoke session request\n")
+		return nil, status.Errorf(codes.InvalidArgument, ErrValidation)
+	}
+
+	claims, err := getClaims(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := ms.sessionRepo.FindById(in.GetSessionId())
+	if err != nil || session.MasterId != claims.MasterId {
+		log.Printf("Error finding session %v\n", err)
+		return nil, status.Errorf(codes.NotFound, ErrSessionNotFound)
+	}
+
+	if err := ms.revokeSession(session.Id, RevokedByMaster); err != nil {
+		return nil, err
+	}
+
+	return &pb.RevokeSessionResponse{OK: true}, nil
+}
+
+// revokes the access token and the session it belongs to. With
+// AllDevices every token and session of the master is revoked
+func (ms *MasterService) Logout(ctx context.Context, in *pb.LogoutRequest) (*pb.LogoutResponse, error) {
+	claims, err := getClaims(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if in.GetAllDevices() {
+		if err := ms.revokeAll(claims.MasterId, RevokedLogout); err != nil {
+			return nil, err
+		}
+		return &pb.LogoutResponse{OK: true}, nil
+	}
+
+	if err := token.Revoke(claims); err != nil {
+		log.Printf("Error revoking access token %v\n", err)
+		return nil, err
+	}
+	if len(claims.SessionId) > 0 {
+		if err := ms.revokeSession(claims.SessionId, RevokedLogout); err != nil {
+			return nil, err
+		}
+	}
+
+	return &pb.LogoutResponse{OK: true}, nil
+}
+
+// revokes the session and every access token it issued
+func (ms *MasterService) revokeSession(sessionId, reason string) error {
+	if err := ms.sessionRepo.Revoke(sessionId, reason); err != nil {
+		log.Printf("Error revoking session %v\n", err)
+		return err
+	}
+	if err := token.RevokeSession(sessionId); err != nil {
+		log.Printf("Error revoking session access tokens %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// revokes every access token and session of the master. The tokens
+// issued from now on carry the new token generation
+func (ms *MasterService) revokeAll(masterId, reason string) error {
+	generation, err := ms.masterRepo.NextTokenGeneration(masterId)
+	if err != nil {
+		log.Printf("Error bumping token generation %v\n", err)
+		return err
+	}
+	if err := token.RevokeAll(masterId, generation); err != nil {
+		log.Printf("Error revoking access tokens %v\n", err)
+		return err
+	}
+	if err := ms.sessionRepo.RevokeAllByMasterId(masterId, reason); err != nil {
+		log.Printf("Error revoking sessions %v\n", err)
+		return err
+	}
+	return nil
+}
+
+// returns the user agent and the address of the client
+func requestOrigin(ctx context.Context) (string, string) {
+	userAgent := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("user-agent"); len(values) > 0 {
+			userAgent = values[0]
+		}
+	}
+	peerAddr := ""
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		peerAddr = p.Addr.String()
+	}
+	return userAgent, peerAddr
+}
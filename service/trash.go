@@ -0,0 +1,170 @@
+package service
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/danilomarques1/secretumserver/model"
+	"github.com/danilomarques1/secretumserver/pb"
+	"github.com/danilomarques1/secretumserver/repository"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	ErrNotInTrash = "The password is not in the trash"
+)
+
+const DefaultTrashRetentionDays = 30
+
+// how long the removed passwords stay in the trash
+//
+//	TRASH_RETENTION_DAYS  days before a removed password is purged, 0 keeps them
+func trashRetention() time.Duration {
+	return time.Duration(getEnvInt("TRASH_RETENTION_DAYS", DefaultTrashRetentionDays)) * 24 * time.Hour
+}
+
+// lists the removed passwords, nothing is decrypted
+func (ps *PasswordService) ListTrash(ctx context.Context, in *pb.ListTrashRequest) (*pb.ListTrashResponse, error) {
+	if err := ps.checkSealed(); err != nil {
+		return nil, err
+	}
+
+	claims, err := getClaims(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	trash, err := ps.passwordRepository.FindTrash(claims.MasterId)
+	if err != nil {
+		log.Printf("Error finding trash %v\n", err)
+		return nil, err
+	}
+
+	retention := trashRetention()
+	response := &pb.ListTrashResponse{Items: make([]*pb.TrashedItem, 0, len(trash))}
+	for _, password := range trash {
+		item := &pb.TrashedItem{
+			Id:        password.Id,
+			Key:       password.Key,
+			Type:      password.ItemType(),
+			DeletedAt: password.DeletedAt.Unix(),
+		}
+		if retention > 0 {
+			item.PurgeAt = password.DeletedAt.Add(retention).Unix()
+		}
+		response.Items = append(response.Items, item)
+	}
+
+	return response, nil
+}
+
+// the password is restored by id, the trash may hold several passwords
+// with the same key
+func (ps *PasswordService) RestoreFromTrash(ctx context.Context, in *pb.RestoreFromTrashRequest) (*pb.RestoreFromTrashResponse, error) {
+	if err := ps.checkSealed(); err != nil {
+		return nil, err
+	}
+	if len(in.GetId()) == 0 {
+		log.Printf("Error validating restore from trash request\n")
+		return nil, status.Errorf(codes.InvalidArgument, ErrValidation)
+	}
+
+	claims, err := getClaims(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	trash, err := ps.passwordRepository.FindTrash(claims.MasterId)
+	if err != nil {
+		log.Printf("Error finding trash %v\n", err)
+		return nil, err
+	}
+	var trashed *model.Password
+	for i := range trash {
+		if trash[i].Id == in.GetId() {
+			trashed = &trash[i]
+			break
+		}
+	}
+	if trashed == nil {
+		return nil, status.Errorf(codes.NotFound, ErrNotInTrash)
+	}
+
+	restored, err := ps.passwordRepository.Restore(claims.MasterId, trashed.Id, trashed.Key)
+	if err != nil {
+		log.Printf("Error restoring password %v\n", err)
+		return nil, err
+	}
+	// the key was used again since it was removed
+	if !restored {
+		return nil, status.Errorf(codes.AlreadyExists, ErrKeyAlreadyUsed)
+	}
+
+	return &pb.RestoreFromTrashResponse{OK: true}, nil
+}
+
+func (ps *PasswordService) EmptyTrash(ctx context.Context, in *pb.EmptyTrashRequest) (*pb.EmptyTrashResponse, error) {
+	if err := ps.checkSealed(); err != nil {
+		return nil, err
+	}
+
+	claims, err := getClaims(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ps.passwordRepository.EmptyTrash(claims.MasterId); err != nil {
+		log.Printf("Error emptying trash %v\n", err)
+		return nil, err
+	}
+
+	return &pb.EmptyTrashResponse{OK: true}, nil
+}
+
+// TrashPurger removes for good the passwords that stayed in the trash
+// longer than the retention
+type TrashPurger struct {
+	passwordRepository model.PasswordRepository
+	retention          time.Duration
+	interval           time.Duration
+}
+
+func NewTrashPurger() (*TrashPurger, error) {
+	passwordRepository, err := repository.NewPasswordRepository()
+	if err != nil {
+		log.Printf("Error creating trash purger %v\n", err)
+		return nil, err
+	}
+
+	return &TrashPurger{
+		passwordRepository: passwordRepository,
+		retention:          trashRetention(),
+		interval:           getEnvDuration("TRASH_PURGE_INTERVAL", DefaultPurgeInterval),
+	}, nil
+}
+
+// Run purges the trash every interval until ctx is done
+func (tp *TrashPurger) Run(ctx context.Context) {
+	if tp.retention <= 0 {
+		return
+	}
+	ticker := time.NewTicker(tp.interval)
+	defer ticker.Stop()
+	for {
+		if err := tp.Purge(time.Now()); err != nil {
+			log.Printf("Error purging trash %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Purge removes the passwords trashed longer than the retention before now
+func (tp *TrashPurger) Purge(now time.Time) error {
+	return tp.passwordRepository.PurgeTrash(now.Add(-tp.retention))
+}
@@ -0,0 +1,145 @@
+package service
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/danilomarques1/secretumserver/model"
+	"github.com/danilomarques1/secretumserver/pb"
+	"github.com/danilomarques1/secretumserver/token"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// keeps the passwords of a master in memory, only what the trash uses
+type trashRepository struct {
+	model.PasswordRepository
+	passwords []model.Password
+}
+
+func (r *trashRepository) FindTrash(masterId string) ([]model.Password, error) {
+	trash := make([]model.Password, 0)
+	for _, password := range r.passwords {
+		if password.DeletedAt != nil {
+			trash = append(trash, password)
+		}
+	}
+	return trash, nil
+}
+
+func (r *trashRepository) Restore(masterId, id, key string) (bool, error) {
+	for _, password := range r.passwords {
+		if password.DeletedAt == nil && password.Key == key {
+			return false, nil
+		}
+	}
+	for i := range r.passwords {
+		if r.passwords[i].Id == id && r.passwords[i].DeletedAt != nil {
+			r.passwords[i].DeletedAt = nil
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *trashRepository) PurgeTrash(before time.Time) error {
+	kept := make([]model.Password, 0)
+	for _, password := range r.passwords {
+		if password.DeletedAt == nil || !password.DeletedAt.Before(before) {
+			kept = append(kept, password)
+		}
+	}
+	r.passwords = kept
+	return nil
+}
+
+// the ids of the passwords out of the trash
+func (r *trashRepository) active() []string {
+	ids := make([]string, 0)
+	for _, password := range r.passwords {
+		if password.DeletedAt == nil {
+			ids = append(ids, password.Id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func newTrashRepository(now time.Time) *trashRepository {
+	at := func(d time.Duration) *time.Time {
+		date := now.Add(d)
+		return &date
+	}
+	return &trashRepository{passwords: []model.Password{
+		{Id: "github", Key: "github", DeletedAt: at(-time.Hour)},
+		{Id: "old github", Key: "github", DeletedAt: at(-40 * 24 * time.Hour)},
+		{Id: "gitlab", Key: "gitlab"},
+		{Id: "old gitlab", Key: "gitlab", DeletedAt: at(-2 * time.Hour)},
+	}}
+}
+
+func TestRestoreFromTrash(t *testing.T) {
+	tests := []struct {
+		label  string
+		id     string
+		code   codes.Code
+		active []string
+	}{
+		{"restored", "github", codes.OK, []string{"github", "gitlab"}},
+		{"restored by id", "old github", codes.OK, []string{"gitlab", "old github"}},
+		{"key used again", "old gitlab", codes.AlreadyExists, []string{"gitlab"}},
+		{"not in the trash", "gitlab", codes.NotFound, []string{"gitlab"}},
+		{"unknown id", "other", codes.NotFound, []string{"gitlab"}},
+		{"no id", "", codes.InvalidArgument, []string{"gitlab"}},
+	}
+
+	for _, test := range tests {
+		repo := newTrashRepository(time.Now())
+		ps := &PasswordService{passwordRepository: repo, zeroKnowledge: true}
+		ctx := token.NewContext(context.Background(), &token.Claims{MasterId: "id"})
+
+		_, err := ps.RestoreFromTrash(ctx, &pb.RestoreFromTrashRequest{Id: test.id})
+		if code := status.Code(err); code != test.code {
+			t.Fatalf("Wrong code for %v expected %v got %v %v\n", test.label, test.code, code, err)
+		}
+		if active := repo.active(); !reflect.DeepEqual(active, test.active) {
+			t.Fatalf("Wrong passwords for %v expected %v got %v\n", test.label, test.active, active)
+		}
+	}
+}
+
+func TestTrashPurgerPurge(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		label     string
+		retention time.Duration
+		trash     []string
+	}{
+		{"retention of 30 days", 30 * 24 * time.Hour, []string{"github", "old gitlab"}},
+		{"retention of 90 minutes", 90 * time.Minute, []string{"github"}},
+		{"retention of 50 days", 50 * 24 * time.Hour, []string{"github", "old github", "old gitlab"}},
+	}
+
+	for _, test := range tests {
+		repo := newTrashRepository(now)
+		tp := &TrashPurger{passwordRepository: repo, retention: test.retention}
+		if err := tp.Purge(now); err != nil {
+			t.Fatalf("Err should when purging be nil %v\n", err)
+		}
+
+		trash, _ := repo.FindTrash("id")
+		ids := make([]string, 0)
+		for _, password := range trash {
+			ids = append(ids, password.Id)
+		}
+		if !reflect.DeepEqual(ids, test.trash) {
+			t.Fatalf("Wrong trash for %v expected %v got %v\n", test.label, test.trash, ids)
+		}
+		if active := repo.active(); !reflect.DeepEqual(active, []string{"gitlab"}) {
+			t.Fatalf("The passwords out of the trash should be kept for %v got %v\n", test.label, active)
+		}
+	}
+}
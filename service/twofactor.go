@@ -0,0 +1,303 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/danilomarques1/secretumserver/encrypt"
+	"github.com/danilomarques1/secretumserver/model"
+	"github.com/danilomarques1/secretumserver/pb"
+	"github.com/danilomarques1/secretumserver/token"
+	"github.com/danilomarques1/secretumserver/totp"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	ErrTwoFactorEnabled     = "Two factor authentication is already enabled"
+	ErrTwoFactorNotEnrolled = "Two factor authentication is not enrolled"
+	ErrInvalidTwoFactorCode = "Invalid two factor code"
+	ErrInvalidChallenge     = "Invalid or expired two factor challenge"
+)
+
+const (
+	RecoveryCodes    = 10
+	RecoveryCodeSize = 10 // bytes, encoded in base32 as 16 chars
+	DefaultIssuer    = "secretum"
+	TwoFactorKeyId   = "totp"
+)
+
+var ErrNoTwoFactorKey = errors.New("TOTP_SECRET_KEY must be set in zero knowledge mode")
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// starts a new enrollment, replacing one that was never confirmed. The
+// secret and the recovery codes are only returned here
+func (ms *MasterService) EnrollTOTP(ctx context.Context, in *pb.EnrollTOTPRequest) (*pb.EnrollTOTPResponse, error) {
+	// a stolen access token must not be enough to bind a second factor the
+	// real master does not have
+	master, err := ms.reauthenticate(ctx, in.GetPassword(), in.GetAuthHash())
+	if err != nil {
+		return nil, err
+	}
+	if master.TwoFactor != nil && master.TwoFactor.Confirmed {
+		return nil, status.Errorf(codes.FailedPrecondition, ErrTwoFactorEnabled)
+	}
+	if !master.EmailVerified() {
+		return nil, status.Errorf(codes.FailedPrecondition, ErrEmailNotVerified)
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		log.Printf("Error generating totp secret %v\n", err)
+		return nil, err
+	}
+	encrypted, err := ms.encryptTwoFactorSecret(master.Id, secret)
+	if err != nil {
+		log.Printf("Error encrypting totp secret %v\n", err)
+		return nil, err
+	}
+	recoveryCodes, hashedCodes, err := generateRecoveryCodes()
+	if err != nil {
+		log.Printf("Error generating recovery codes %v\n", err)
+		return nil, err
+	}
+
+	twoFactor := &model.TwoFactor{
+		Secret:        encrypted,
+		RecoveryCodes: hashedCodes,
+		EnrolledAt:    time.Now(),
+	}
+	if err := ms.masterRepo.SetTwoFactor(master.Id, twoFactor); err != nil {
+		log.Printf("Error saving two factor %v\n", err)
+		return nil, err
+	}
+
+	return &pb.EnrollTOTPResponse{
+		ProvisioningUri: totp.ProvisioningURI(issuer(), master.Email, secret),
+		Secret:          secret,
+		RecoveryCodes:   recoveryCodes,
+	}, nil
+}
+
+// enables two factor authentication once the master proves the
+// authenticator app has the secret
+func (ms *MasterService) ConfirmTOTP(ctx context.Context, in *pb.ConfirmTOTPRequest) (*pb.ConfirmTOTPResponse, error) {
+	if len(in.GetCode()) == 0 {
+		log.Printf("Error validating confirm totp request\n")
+		return nil, status.Errorf(codes.InvalidArgument, ErrValidation)
+	}
+	claims, err := getClaims(ctx)
+	if err != nil {
+		return nil, err
+	}
+	master, err := ms.masterRepo.FindById(claims.MasterId)
+	if err != nil {
+		log.Printf("Error finding master %v\n", err)
+		return nil, err
+	}
+	if master.TwoFactor == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, ErrTwoFactorNotEnrolled)
+	}
+	if master.TwoFactor.Confirmed {
+		return nil, status.Errorf(codes.FailedPrecondition, ErrTwoFactorEnabled)
+	}
+
+	step, err := ms.validateTOTP(master, in.GetCode())
+	if err != nil {
+		return nil, err
+	}
+	master.TwoFactor.Confirmed = true
+	master.TwoFactor.LastStep = step
+	if err := ms.masterRepo.SetTwoFactor(master.Id, master.TwoFactor); err != nil {
+		log.Printf("Error saving two factor %v\n", err)
+		return nil, err
+	}
+
+	return &pb.ConfirmTOTPResponse{OK: true}, nil
+}
+
+// exchanges the challenge of AuthenticateMaster and a totp or recovery
+// code for the token pair. A challenge is only good for one try
+func (ms *MasterService) CompleteTwoFactor(ctx context.Context, in *pb.CompleteTwoFactorRequest) (*pb.AuthMasterResponse, error) {
+	if len(in.GetChallengeToken()) == 0 || (len(in.GetCode()) == 0 && len(in.GetRecoveryCode()) == 0) {
+		log.Printf("Error validating complete two factor request\n")
+		return nil, status.Errorf(codes.InvalidArgument, ErrValidation)
+	}
+
+	claims, err := token.ValidateChallengeToken(in.GetChallengeToken())
+	if err != nil {
+		log.Printf("Error validating challenge token %v\n", err)
+		return nil, status.Errorf(codes.Unauthenticated, ErrInvalidChallenge)
+	}
+	if err := token.Revoke(claims); err != nil {
+		log.Printf("Error revoking challenge token %v\n", err)
+		return nil, err
+	}
+
+	master, err := ms.masterRepo.FindById(claims.MasterId)
+	if err != nil {
+		log.Printf("Error finding master %v\n", err)
+		return nil, err
+	}
+	if master.TwoFactor == nil || !master.TwoFactor.Confirmed {
+		return nil, status.Errorf(codes.FailedPrecondition, ErrTwoFactorNotEnrolled)
+	}
+	if err := ms.attempts.Check(ctx, master.Email); err != nil {
+		log.Printf("Error completing two factor %v\n", err)
+		return nil, err
+	}
+
+	used, err := ms.useSecondFactor(master, in.GetCode(), in.GetRecoveryCode())
+	if err != nil {
+		return nil, err
+	}
+	if !used {
+		ms.attempts.Failure(ctx, master.Email)
+		return nil, status.Errorf(codes.Unauthenticated, ErrInvalidTwoFactorCode)
+	}
+
+	ms.attempts.Success(master.Email)
+	return ms.authResponse(ctx, master)
+}
+
+// checks the totp code, or the recovery code when there is none, and marks
+// it as used. Returns false when the code is invalid or was already used
+func (ms *MasterService) useSecondFactor(master *model.Master, code, recoveryCode string) (bool, error) {
+	if len(code) == 0 {
+		used, err := ms.masterRepo.UseRecoveryCode(master.Id, hashRecoveryCode(recoveryCode))
+		if err != nil {
+			log.Printf("Error using recovery code %v\n", err)
+			return false, err
+		}
+		return used, nil
+	}
+
+	step, err := ms.validateTOTP(master, code)
+	if status.Code(err) == codes.Unauthenticated {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	// the same code can not be used twice
+	used, err := ms.masterRepo.UseTwoFactorStep(master.Id, step)
+	if err != nil {
+		log.Printf("Error saving totp step %v\n", err)
+		return false, err
+	}
+	if !used {
+		log.Printf("Totp code replayed for master %v\n", master.Id)
+	}
+	return used, nil
+}
+
+func (ms *MasterService) validateTOTP(master *model.Master, code string) (int64, error) {
+	secret, err := ms.decryptTwoFactorSecret(master.Id, master.TwoFactor.Secret)
+	if err != nil {
+		log.Printf("Error decrypting totp secret %v\n", err)
+		return 0, err
+	}
+	step, err := totp.Validate(secret, code, time.Now())
+	if err != nil {
+		return 0, status.Errorf(codes.Unauthenticated, ErrInvalidTwoFactorCode)
+	}
+	return step, nil
+}
+
+// the secret is encrypted with the master data key. In zero knowledge
+// mode there is none and the TOTP_SECRET_KEY keyring is used instead
+func (ms *MasterService) twoFactorKeyring(masterId string) (*encrypt.Keyring, error) {
+	if ms.barrier == nil {
+		return ms.twoFactorKeys, nil
+	}
+	dataKeys, err := ms.barrier.DataKeys()
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, ErrVaultSealed)
+	}
+	return dataKeys.Keyring(masterId)
+}
+
+func (ms *MasterService) encryptTwoFactorSecret(masterId, secret string) (string, error) {
+	keyring, err := ms.twoFactorKeyring(masterId)
+	if err != nil {
+		return "", err
+	}
+	return encrypt.NewEncrypt(keyring).EncryptMessage(secret, twoFactorAssociatedData(masterId))
+}
+
+func (ms *MasterService) decryptTwoFactorSecret(masterId, encrypted string) (string, error) {
+	keyring, err := ms.twoFactorKeyring(masterId)
+	if err != nil {
+		return "", err
+	}
+	secret, err := encrypt.NewDecrypt(keyring).DecryptMessage(encrypted, twoFactorAssociatedData(masterId))
+	if errors.Is(err, encrypt.ErrAuthentication) {
+		return "", status.Errorf(codes.DataLoss, ErrPasswordCorrupt)
+	}
+	return secret, err
+}
+
+// loadTwoFactorKeyring returns the keyring of the totp secrets in zero
+// knowledge mode. It only holds TOTP_SECRET_KEY, the server has no other
+// key in that mode
+func loadTwoFactorKeyring() (*encrypt.Keyring, error) {
+	secret := os.Getenv("TOTP_SECRET_KEY")
+	if len(secret) == 0 {
+		return nil, ErrNoTwoFactorKey
+	}
+	keyring := encrypt.NewKeyring()
+	if err := keyring.AddSecret(TwoFactorKeyId, secret, encrypt.KeyActive); err != nil {
+		return nil, err
+	}
+	if err := keyring.SetPrimary(TwoFactorKeyId); err != nil {
+		return nil, err
+	}
+	return keyring, nil
+}
+
+// differs from the associated data of the passwords so the secret can not
+// be passed off as one of them
+func twoFactorAssociatedData(masterId string) []byte {
+	return []byte("two_factor\x00" + masterId)
+}
+
+// returns the codes to show to the master and the hashes to store. The
+// codes are random enough for a plain sha256
+func generateRecoveryCodes() ([]string, []string, error) {
+	recoveryCodes := make([]string, 0, RecoveryCodes)
+	hashedCodes := make([]string, 0, RecoveryCodes)
+	for i := 0; i < RecoveryCodes; i++ {
+		b := make([]byte, RecoveryCodeSize)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(recoveryCodeEncoding.EncodeToString(b))
+		code = code[:8] + "-" + code[8:]
+		recoveryCodes = append(recoveryCodes, code)
+		hashedCodes = append(hashedCodes, hashRecoveryCode(code))
+	}
+	return recoveryCodes, hashedCodes, nil
+}
+
+// the dash and the case are ignored
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+func issuer() string {
+	if issuer := os.Getenv("TOTP_ISSUER"); len(issuer) > 0 {
+		return issuer
+	}
+	return DefaultIssuer
+}
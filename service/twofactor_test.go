@@ -0,0 +1,58 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/danilomarques1/secretumserver/model"
+	"github.com/danilomarques1/secretumserver/pb"
+	"github.com/danilomarques1/secretumserver/token"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// keeps the enrollment in the master, only what EnrollTOTP uses
+type twoFactorRepository struct {
+	*accountRepository
+}
+
+func (r *twoFactorRepository) SetTwoFactor(id string, twoFactor *model.TwoFactor) error {
+	r.masters[id].TwoFactor = twoFactor
+	return nil
+}
+
+func TestEnrollTOTP(t *testing.T) {
+	t.Setenv("TOTP_SECRET_KEY", "totp secret key")
+	keyring, err := loadTwoFactorKeyring()
+	if err != nil {
+		t.Fatalf("Err should when loading the keyring be nil %v\n", err)
+	}
+	tests := []struct {
+		label    string
+		password string
+		code     codes.Code
+	}{
+		{"enrolled", "password", codes.OK},
+		{"wrong password", "wrong", codes.NotFound},
+		{"without the password", "", codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		ms, repo, _ := newAccountService(t, &model.Master{Id: "id"})
+		ms.masterRepo = &twoFactorRepository{repo}
+		ms.twoFactorKeys = keyring
+		ctx := token.NewContext(context.Background(), &token.Claims{MasterId: "id"})
+
+		response, err := ms.EnrollTOTP(ctx, &pb.EnrollTOTPRequest{Password: test.password})
+		if code := status.Code(err); code != test.code {
+			t.Fatalf("Wrong code for %v expected %v got %v %v\n", test.label, test.code, code, err)
+		}
+		enrolled := repo.masters["id"].TwoFactor != nil
+		if enrolled != (test.code == codes.OK) {
+			t.Fatalf("Wrong enrollment for %v expected %v got %v\n", test.label, test.code == codes.OK, enrolled)
+		}
+		if test.code == codes.OK && len(response.GetRecoveryCodes()) != RecoveryCodes {
+			t.Fatalf("Wrong number of recovery codes for %v got %v\n", test.label, len(response.GetRecoveryCodes()))
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package service
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"github.com/danilomarques1/secretumserver/encrypt"
+	"github.com/danilomarques1/secretumserver/model"
+	"github.com/danilomarques1/secretumserver/pb"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	ErrVaultParams           = "Invalid vault key derivation parameters"
+	ErrNotZeroKnowledge      = "The server is not running in zero knowledge mode"
+	ErrZeroKnowledgeGenerate = "Passwords can not be generated and stored in zero knowledge mode"
+	ErrZeroKnowledgeRecovery = "The recovery key can not restore the vault in zero knowledge mode"
+)
+
+var ErrNoVaultParamsSecret = errors.New("VAULT_PARAMS_SECRET must be set in zero knowledge mode")
+
+// VAULT_MODE values
+const (
+	// the server encrypts the passwords with its own keys
+	VaultModeServer = "server"
+	// clients encrypt the passwords with a key derived from the master
+	// password, the server only stores opaque blobs
+	VaultModeZeroKnowledge = "zero_knowledge"
+)
+
+// The zero knowledge protocol. The master password never reaches the
+// server, the client:
+//
+//  1. gets the kdf params of the email from GetVaultParams
+//  2. derives the master key with Argon2id(password, params)
+//  3. splits it with HKDF-SHA256 into the auth hash, labeled
+//     encrypt.AuthHashInfo, and the wrapping key, labeled
+//     encrypt.VaultWrappingInfo (see encrypt.DeriveAuthHash)
+//  4. sends the auth hash wherever a password is asked for, the auth_hash
+//     fields. The server bcrypts it like a password
+//  5. unwraps the vault key returned after authentication with the
+//     wrapping key, and encrypts every password with the vault key
+//
+// The server can not get from the auth hash to the wrapping key, so it
+// can not decrypt the vault. Changing the password or the kdf params
+// changes the auth hash, both are always sent along with the new vault
+// params. The password policy can only be checked by the client.
+// There is no recovery key, the server would need the vault key to wrap
+// it with one, so a forgotten password loses the vault
+
+// the requests that authenticate the master
+type credentialRequest interface {
+	GetPassword() string
+	GetAuthHash() []byte
+}
+
+// returns the secret the master authenticates with: the master password,
+// or in zero knowledge mode the auth hash. The master password is refused
+// in zero knowledge mode, so a client can not leak it by mistake
+func masterCredential(password string, authHash []byte) (string, bool) {
+	if !IsZeroKnowledge() {
+		return password, len(password) > 0
+	}
+	if len(password) > 0 || len(authHash) != encrypt.AuthHashSize {
+		return "", false
+	}
+	return hex.EncodeToString(authHash), true
+}
+
+func hasCredential(in credentialRequest) bool {
+	_, ok := masterCredential(in.GetPassword(), in.GetAuthHash())
+	return ok
+}
+
+func IsZeroKnowledge() bool {
+	return os.Getenv("VAULT_MODE") == VaultModeZeroKnowledge
+}
+
+// returns the kdf parameters of a master so the client can derive the key
+// that unwraps the vault key. The wrapped key itself is only returned
+// after authentication
+func (ms *MasterService) GetVaultParams(ctx context.Context, in *pb.GetVaultParamsRequest) (*pb.GetVaultParamsResponse, error) {
+	if !IsZeroKnowledge() {
+		return nil, status.Errorf(codes.FailedPrecondition, ErrNotZeroKnowledge)
+	}
+	if len(in.GetEmail()) == 0 {
+		log.Printf("Error validating vault params request\n")
+		return nil, status.Errorf(codes.InvalidArgument, ErrValidation)
+	}
+
+	// unknown emails get the same made up params on every call, they can
+	// not be told apart from the masters
+	master, err := ms.masterRepo.FindByEmail(in.GetEmail())
+	if err != nil || master.Vault == nil {
+		params := encrypt.DefaultKdfParams(ms.vaultSecret, in.GetEmail())
+		return &pb.GetVaultParamsResponse{Vault: kdfParamsToPb(params)}, nil
+	}
+
+	return &pb.GetVaultParamsResponse{Vault: kdfParamsToPb(vaultKdfParams(master.Vault))}, nil
+}
+
+// stores a new wrapped vault key, used when the client changes the kdf
+// parameters. The auth hash changes with them, the new one is stored too.
+// Password changes go through UpdateMaster
+func (ms *MasterService) RotateVaultKey(ctx context.Context, in *pb.RotateVaultKeyRequest) (*pb.RotateVaultKeyResponse, error) {
+	if !IsZeroKnowledge() {
+		return nil, status.Errorf(codes.FailedPrecondition, ErrNotZeroKnowledge)
+	}
+	_, ok := masterCredential("", in.GetAuthHash())
+	newCredential, newOk := masterCredential("", in.GetNewAuthHash())
+	if in.GetVault() == nil || !ok || !newOk {
+		log.Printf("Error validating rotate vault key request\n")
+		return nil, status.Errorf(codes.InvalidArgument, ErrValidation)
+	}
+
+	vault, err := vaultParamsFromPb(in.GetVault())
+	if err != nil {
+		log.Printf("Error validating vault params %v\n", err)
+		return nil, status.Errorf(codes.InvalidArgument, ErrVaultParams)
+	}
+
+	master, err := ms.reauthenticate(ctx, "", in.GetAuthHash())
+	if err != nil {
+		return nil, err
+	}
+	hashedCredential, err := bcrypt.GenerateFromPassword([]byte(newCredential), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("Error hashing auth hash %v\n", err)
+		return nil, err
+	}
+	// the password is the same, its history and expiration are kept
+	master.Pwd = string(hashedCredential)
+	master.Vault = vault
+	if err := ms.masterRepo.Update(master); err != nil {
+		log.Printf("Error updating master vault %v\n", err)
+		return nil, err
+	}
+
+	return &pb.RotateVaultKeyResponse{OK: true}, nil
+}
+
+// validates the vault params sent by the client
+func vaultParamsFromPb(in *pb.VaultParams) (*model.VaultParams, error) {
+	if in.GetKdfThreads() > 255 {
+		return nil, encrypt.ErrWeakKdfParams
+	}
+	params := encrypt.KdfParams{
+		Algorithm: in.GetKdfAlgorithm(),
+		Salt:      in.GetKdfSalt(),
+		Time:      in.GetKdfTime(),
+		Memory:    in.GetKdfMemory(),
+		Threads:   uint8(in.GetKdfThreads()),
+		KeyLength: in.GetKdfKeyLength(),
+	}
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+	if err := encrypt.ValidateWrappedKey(in.GetWrappedVaultKey()); err != nil {
+		return nil, err
+	}
+
+	return &model.VaultParams{
+		KdfAlgorithm: params.Algorithm,
+		KdfSalt:      params.Salt,
+		KdfTime:      params.Time,
+		KdfMemory:    params.Memory,
+		KdfThreads:   params.Threads,
+		KdfKeyLength: params.KeyLength,
+		WrappedKey:   in.GetWrappedVaultKey(),
+		UpdatedAt:    time.Now(),
+	}, nil
+}
+
+func vaultKdfParams(vault *model.VaultParams) encrypt.KdfParams {
+	return encrypt.KdfParams{
+		Algorithm: vault.KdfAlgorithm,
+		Salt:      vault.KdfSalt,
+		Time:      vault.KdfTime,
+		Memory:    vault.KdfMemory,
+		Threads:   vault.KdfThreads,
+		KeyLength: vault.KdfKeyLength,
+	}
+}
+
+func kdfParamsToPb(params encrypt.KdfParams) *pb.VaultParams {
+	return &pb.VaultParams{
+		KdfAlgorithm: params.Algorithm,
+		KdfSalt:      params.Salt,
+		KdfTime:      params.Time,
+		KdfMemory:    params.Memory,
+		KdfThreads:   uint32(params.Threads),
+		KdfKeyLength: params.KeyLength,
+	}
+}
+
+// loadVaultParamsSecret returns VAULT_PARAMS_SECRET, the made up params of
+// the unknown emails are derived from it
+func loadVaultParamsSecret() ([]byte, error) {
+	secret := os.Getenv("VAULT_PARAMS_SECRET")
+	if len(secret) == 0 {
+		return nil, ErrNoVaultParamsSecret
+	}
+	return []byte(secret), nil
+}
@@ -0,0 +1,48 @@
+package service
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/danilomarques1/secretumserver/encrypt"
+	"github.com/danilomarques1/secretumserver/model"
+	"github.com/danilomarques1/secretumserver/pb"
+)
+
+func TestGetVaultParams(t *testing.T) {
+	t.Setenv("VAULT_MODE", VaultModeZeroKnowledge)
+	vault := &model.VaultParams{
+		KdfAlgorithm: encrypt.KdfArgon2id,
+		KdfSalt:      []byte("0123456789abcdef"),
+		KdfTime:      4,
+		KdfMemory:    128 * 1024,
+		KdfThreads:   2,
+		KdfKeyLength: encrypt.VaultKeySize,
+	}
+	ms := &MasterService{
+		masterRepo:  &recoveryRepository{master: &model.Master{Email: "john@mail.com", Vault: vault}},
+		vaultSecret: []byte("vault params secret"),
+	}
+	params := func(email string) *pb.VaultParams {
+		response, err := ms.GetVaultParams(context.Background(), &pb.GetVaultParamsRequest{Email: email})
+		if err != nil {
+			t.Fatalf("Err should for %v be nil %v\n", email, err)
+		}
+		return response.GetVault()
+	}
+
+	if master := params("john@mail.com"); !reflect.DeepEqual(master, kdfParamsToPb(vaultKdfParams(vault))) {
+		t.Fatalf("Wrong params of the master got %v\n", master)
+	}
+	unknown := params("jane@mail.com")
+	if !reflect.DeepEqual(unknown, params("jane@mail.com")) {
+		t.Fatalf("An unknown email should always get the same params\n")
+	}
+	if reflect.DeepEqual(unknown.GetKdfSalt(), params("joe@mail.com").GetKdfSalt()) {
+		t.Fatalf("Unknown emails should get different salts\n")
+	}
+	if unknown.GetKdfAlgorithm() != encrypt.KdfArgon2id || len(unknown.GetKdfSalt()) != encrypt.MinKdfSaltSize {
+		t.Fatalf("The params of an unknown email should look like the ones of a master got %v\n", unknown)
+	}
+}
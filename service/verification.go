@@ -0,0 +1,127 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/danilomarques1/secretumserver/mail"
+	"github.com/danilomarques1/secretumserver/model"
+	"github.com/danilomarques1/secretumserver/pb"
+	"github.com/danilomarques1/secretumserver/token"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	ErrInvalidVerification  = "Invalid or expired verification token"
+	ErrEmailAlreadyVerified = "The email is already verified"
+	ErrEmailNotVerified     = "Verify the email first"
+	ErrVerificationResend   = "The verification email was sent recently, wait before asking for another one"
+)
+
+const (
+	// how many passwords a master may save before verifying the email
+	DefaultUnverifiedPasswordLimit = 10
+	// how long a master waits before the verification email is sent again
+	DefaultVerificationResendInterval = time.Minute
+)
+
+// EMAIL_VERIFICATION=off creates the masters already verified
+func emailVerificationEnabled() bool {
+	return os.Getenv("EMAIL_VERIFICATION") != "off"
+}
+
+func unverifiedPasswordLimit() int {
+	return getEnvInt("UNVERIFIED_PASSWORD_LIMIT", DefaultUnverifiedPasswordLimit)
+}
+
+func verificationResendInterval() time.Duration {
+	return getEnvDuration("VERIFICATION_RESEND_INTERVAL", DefaultVerificationResendInterval)
+}
+
+func (ms *MasterService) VerifyEmail(ctx context.Context, in *pb.VerifyEmailRequest) (*pb.VerifyEmailResponse, error) {
+	if len(in.GetToken()) == 0 {
+		log.Printf("Error validating verify email request\n")
+		return nil, status.Errorf(codes.InvalidArgument, ErrValidation)
+	}
+
+	claims, err := token.ValidateVerificationToken(in.GetToken())
+	if err != nil {
+		log.Printf("Error validating verification token %v\n", err)
+		return nil, status.Errorf(codes.InvalidArgument, ErrInvalidVerification)
+	}
+
+	// the email may have changed since the token was sent
+	verified, err := ms.masterRepo.VerifyEmail(claims.MasterId, claims.Email, time.Now())
+	if err != nil {
+		log.Printf("Error verifying email %v\n", err)
+		return nil, err
+	}
+	if !verified {
+		return nil, status.Errorf(codes.InvalidArgument, ErrInvalidVerification)
+	}
+
+	return &pb.VerifyEmailResponse{OK: true}, nil
+}
+
+// sends the verification email again, at most once every
+// VERIFICATION_RESEND_INTERVAL
+func (ms *MasterService) SendVerificationEmail(ctx context.Context, in *pb.SendVerificationEmailRequest) (*pb.SendVerificationEmailResponse, error) {
+	claims, err := getClaims(ctx)
+	if err != nil {
+		return nil, err
+	}
+	master, err := ms.masterRepo.FindById(claims.MasterId)
+	if err != nil {
+		log.Printf("Error finding master %v\n", err)
+		return nil, err
+	}
+	if master.EmailVerified() {
+		return nil, status.Errorf(codes.FailedPrecondition, ErrEmailAlreadyVerified)
+	}
+	if master.Verification != nil {
+		resendAt := master.Verification.SentAt.Add(verificationResendInterval())
+		if wait := time.Until(resendAt); wait > 0 {
+			return nil, RetryError(ErrVerificationResend, wait)
+		}
+	}
+
+	if err := ms.sendVerificationEmail(master); err != nil {
+		log.Printf("Error sending verification email %v\n", err)
+		return nil, err
+	}
+
+	return &pb.SendVerificationEmailResponse{OK: true}, nil
+}
+
+// mails a signed token to the master. With VERIFY_EMAIL_URL set it goes
+// as a link, the page calls VerifyEmail with it
+func (ms *MasterService) sendVerificationEmail(master *model.Master) error {
+	verificationToken, err := token.GetVerificationToken(master.Id, master.Email)
+	if err != nil {
+		return err
+	}
+
+	body := "Use the token below to verify the email of your secretum account.\n\n" + verificationToken + "\n"
+	if verifyURL := os.Getenv("VERIFY_EMAIL_URL"); len(verifyURL) > 0 {
+		body = fmt.Sprintf(
+			"Open the link below to verify the email of your secretum account.\n\n%v?token=%v\n",
+			verifyURL, url.QueryEscape(verificationToken),
+		)
+	}
+	body += "\nIt expires in 24 hours. If you did not create the account you can ignore this email.\n"
+
+	msg := &mail.Message{
+		To:      master.Email,
+		Subject: "Verify your secretum email",
+		Body:    body,
+	}
+	if err := ms.mailer.Send(msg); err != nil {
+		return err
+	}
+	return ms.masterRepo.SetVerificationSent(master.Id, time.Now())
+}
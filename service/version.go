@@ -0,0 +1,235 @@
+package service
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/danilomarques1/secretumserver/model"
+	"github.com/danilomarques1/secretumserver/pb"
+	"github.com/danilomarques1/secretumserver/repository"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	ErrVersionNotFound = "Version not found"
+)
+
+const (
+	DefaultVersionsKept  = 10
+	DefaultVersionMaxAge = 365 * 24 * time.Hour
+)
+
+// VersionPolicy is how many previous versions of each password are kept
+// and for how long. A MaxAge of zero keeps them until they are pushed out
+type VersionPolicy struct {
+	Keep   int
+	MaxAge time.Duration
+}
+
+// reads the policy from the environment
+//
+//	PASSWORD_VERSIONS         versions kept per password, 0 disables them
+//	PASSWORD_VERSION_MAX_AGE  how long a version is kept
+func LoadVersionPolicy() VersionPolicy {
+	return VersionPolicy{
+		Keep:   getEnvInt("PASSWORD_VERSIONS", DefaultVersionsKept),
+		MaxAge: getEnvDuration("PASSWORD_VERSION_MAX_AGE", DefaultVersionMaxAge),
+	}
+}
+
+// the versions that are not too old yet
+func (vp VersionPolicy) retained(versions []model.PasswordVersion, now time.Time) []model.PasswordVersion {
+	retained := make([]model.PasswordVersion, 0, len(versions))
+	for _, version := range versions {
+		if vp.MaxAge > 0 && now.Sub(version.ReplacedAt) > vp.MaxAge {
+			continue
+		}
+		retained = append(retained, version)
+	}
+	return retained
+}
+
+func (ps *PasswordService) ListPasswordVersions(ctx context.Context, in *pb.ListPasswordVersionsRequest) (*pb.ListPasswordVersionsResponse, error) {
+	if err := ps.checkSealed(); err != nil {
+		return nil, err
+	}
+	if len(in.GetKey()) == 0 {
+		log.Printf("Error validating list password versions request\n")
+		return nil, status.Errorf(codes.InvalidArgument, ErrValidation)
+	}
+
+	claims, err := getClaims(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	password, err := ps.passwordRepository.FindByKey(claims.MasterId, in.GetKey())
+	if err != nil {
+		log.Printf("Error finding the password %v\n", err)
+		return nil, err
+	}
+
+	versions := ps.versions.retained(password.Versions, time.Now())
+	response := &pb.ListPasswordVersionsResponse{Versions: make([]*pb.PasswordVersion, 0, len(versions))}
+	for _, version := range versions {
+		response.Versions = append(response.Versions, &pb.PasswordVersion{
+			Id:         version.Id,
+			ReplacedAt: version.ReplacedAt.Unix(),
+			SessionId:  version.SessionId,
+			Username:   version.Username,
+		})
+	}
+
+	return response, nil
+}
+
+// puts the version back. The current one becomes a version, so the
+// restore can be undone too
+func (ps *PasswordService) RestorePasswordVersion(ctx context.Context, in *pb.RestorePasswordVersionRequest) (*pb.RestorePasswordVersionResponse, error) {
+	if err := ps.checkSealed(); err != nil {
+		return nil, err
+	}
+	if len(in.GetKey()) == 0 || len(in.GetVersionId()) == 0 {
+		log.Printf("Error validating restore password version request\n")
+		return nil, status.Errorf(codes.InvalidArgument, ErrValidation)
+	}
+
+	claims, err := getClaims(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	password, err := ps.passwordRepository.FindByKey(claims.MasterId, in.GetKey())
+	if err != nil {
+		log.Printf("Error finding the password %v\n", err)
+		return nil, err
+	}
+	var restored *model.PasswordVersion
+	for _, version := range ps.versions.retained(password.Versions, time.Now()) {
+		if version.Id == in.GetVersionId() {
+			restored = &version
+			break
+		}
+	}
+	if restored == nil {
+		return nil, status.Errorf(codes.NotFound, ErrVersionNotFound)
+	}
+
+	// the cipher texts are bound to the key, which never changes, they
+	// are copied back as they are
+	current := newVersion(password, claims.SessionId)
+	*password = *versionEntry(password, restored)
+	if err := ps.updateWithVersion(claims.MasterId, password, current); err != nil {
+		log.Printf("Error restoring password version %v\n", err)
+		return nil, err
+	}
+
+	return &pb.RestorePasswordVersionResponse{OK: true}, nil
+}
+
+// saves the password, keeping the version when versions are enabled
+func (ps *PasswordService) updateWithVersion(masterId string, password *model.Password, version *model.PasswordVersion) error {
+	if ps.versions.Keep <= 0 {
+		return ps.passwordRepository.Update(masterId, password)
+	}
+	return ps.passwordRepository.UpdateWithVersion(masterId, password, version, ps.versions.Keep)
+}
+
+// the password as it is now, still encrypted. The slices are copied, the
+// password is decrypted in place right after
+func newVersion(password *model.Password, sessionId string) *model.PasswordVersion {
+	return &model.PasswordVersion{
+		Id:         uuid.NewString(),
+		Pwd:        password.Pwd,
+		Data:       copyItemFields(password.Data),
+		Username:   password.Username,
+		URIs:       copyStrings(password.URIs),
+		Notes:      password.Notes,
+		Fields:     copyCustomFields(password.Fields),
+		ReplacedAt: time.Now(),
+		SessionId:  sessionId,
+	}
+}
+
+// the password as it was at the version, the folder and the tags are not
+// versioned
+func versionEntry(password *model.Password, version *model.PasswordVersion) *model.Password {
+	return &model.Password{
+		Id:       password.Id,
+		Key:      password.Key,
+		Type:     password.Type,
+		Pwd:      version.Pwd,
+		Data:     copyItemFields(version.Data),
+		Username: version.Username,
+		URIs:     copyStrings(version.URIs),
+		Notes:    version.Notes,
+		Fields:   copyCustomFields(version.Fields),
+		FolderId: password.FolderId,
+		Tags:     password.Tags,
+		Versions: password.Versions,
+	}
+}
+
+func copyItemFields(fields []model.ItemField) []model.ItemField {
+	if fields == nil {
+		return nil
+	}
+	return append(make([]model.ItemField, 0, len(fields)), fields...)
+}
+
+func copyCustomFields(fields []model.CustomField) []model.CustomField {
+	if fields == nil {
+		return nil
+	}
+	return append(make([]model.CustomField, 0, len(fields)), fields...)
+}
+
+func copyStrings(values []string) []string {
+	if values == nil {
+		return nil
+	}
+	return append(make([]string, 0, len(values)), values...)
+}
+
+// VersionPruner removes the versions older than the policy allows
+type VersionPruner struct {
+	passwordRepository model.PasswordRepository
+	policy             VersionPolicy
+	interval           time.Duration
+}
+
+func NewVersionPruner() (*VersionPruner, error) {
+	passwordRepository, err := repository.NewPasswordRepository()
+	if err != nil {
+		log.Printf("Error creating version pruner %v\n", err)
+		return nil, err
+	}
+
+	return &VersionPruner{
+		passwordRepository: passwordRepository,
+		policy:             LoadVersionPolicy(),
+		interval:           getEnvDuration("PASSWORD_VERSION_PRUNE_INTERVAL", DefaultPurgeInterval),
+	}, nil
+}
+
+// Run prunes the versions every interval until ctx is done
+func (vp *VersionPruner) Run(ctx context.Context) {
+	if vp.policy.MaxAge <= 0 {
+		return
+	}
+	ticker := time.NewTicker(vp.interval)
+	defer ticker.Stop()
+	for {
+		if err := vp.passwordRepository.PruneVersions(time.Now().Add(-vp.policy.MaxAge)); err != nil {
+			log.Printf("Error pruning password versions %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
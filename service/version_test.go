@@ -0,0 +1,170 @@
+package service
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/danilomarques1/secretumserver/encrypt"
+	"github.com/danilomarques1/secretumserver/model"
+	"github.com/danilomarques1/secretumserver/pb"
+	"github.com/danilomarques1/secretumserver/token"
+)
+
+// keeps a single password in memory, only what UpdatePassword uses
+type versionRepository struct {
+	model.PasswordRepository
+	password *model.Password
+	version  *model.PasswordVersion
+}
+
+func (r *versionRepository) FindByKey(masterId, key string) (*model.Password, error) {
+	return r.password, nil
+}
+
+func (r *versionRepository) UpdateWithVersion(masterId string, password *model.Password, version *model.PasswordVersion, keep int) error {
+	r.password = password
+	r.version = version
+	return nil
+}
+
+// returns an unsealed password service whose master has a fresh data key
+func newVersionService(t *testing.T, masterId string, repo *versionRepository) *PasswordService {
+	dataKey, err := encrypt.NewDataKey()
+	if err != nil {
+		t.Fatalf("Err should when creating the data key be nil %v\n", err)
+	}
+	keyring := encrypt.NewKeyring()
+	if err := keyring.Add("data key", dataKey, encrypt.KeyActive); err != nil {
+		t.Fatalf("Err should when creating the keyring be nil %v\n", err)
+	}
+	if err := keyring.SetPrimary("data key"); err != nil {
+		t.Fatalf("Err should when setting the primary key be nil %v\n", err)
+	}
+	dataKeys := &DataKeys{keyrings: map[string]*encrypt.Keyring{masterId: keyring}}
+	return &PasswordService{
+		passwordRepository: repo,
+		barrier:            &Barrier{dataKeys: dataKeys},
+		versions:           VersionPolicy{Keep: 5},
+	}
+}
+
+func TestUpdatePasswordKeepsEncryptedVersion(t *testing.T) {
+	masterId := "master"
+	repo := &versionRepository{}
+	ps := newVersionService(t, masterId, repo)
+
+	password := &model.Password{
+		Id:     "id",
+		Key:    "github",
+		Type:   model.ItemLogin,
+		Pwd:    "old password",
+		Notes:  "old notes",
+		Fields: []model.CustomField{{Name: "pin", Type: model.FieldHidden, Value: "1234"}},
+	}
+	if err := ps.sealPassword(masterId, password); err != nil {
+		t.Fatalf("Err should when sealing be nil %v\n", err)
+	}
+	sealedPwd, sealedNotes, sealedPin := password.Pwd, password.Notes, password.Fields[0].Value
+	repo.password = password
+
+	ctx := token.NewContext(context.Background(), &token.Claims{MasterId: masterId, SessionId: "session"})
+	if _, err := ps.UpdatePassword(ctx, &pb.UpdatePasswordRequest{Key: "github", Password: "new password"}); err != nil {
+		t.Fatalf("Err should when updating be nil %v\n", err)
+	}
+
+	version := repo.version
+	if version == nil {
+		t.Fatalf("The version should have been stored\n")
+	}
+	if version.Pwd != sealedPwd {
+		t.Fatalf("Wrong version password expected %v got %v\n", sealedPwd, version.Pwd)
+	}
+	if version.Notes != sealedNotes {
+		t.Fatalf("Wrong version notes expected %v got %v\n", sealedNotes, version.Notes)
+	}
+	if len(version.Fields) != 1 || version.Fields[0].Value != sealedPin {
+		t.Fatalf("Wrong version fields expected %v got %v\n", sealedPin, version.Fields)
+	}
+	if version.Fields[0].Value == "1234" {
+		t.Fatalf("The version hidden field should still be encrypted\n")
+	}
+
+	// the stored password is encrypted again with the new value
+	stored := *repo.password
+	stored.Fields = append([]model.CustomField{}, stored.Fields...)
+	if err := ps.openPassword(masterId, &stored); err != nil {
+		t.Fatalf("Err should when opening be nil %v\n", err)
+	}
+	if stored.Pwd != "new password" || stored.Fields[0].Value != "1234" {
+		t.Fatalf("Wrong stored password got %v %v\n", stored.Pwd, stored.Fields)
+	}
+}
+
+func TestNewVersionAndVersionEntry(t *testing.T) {
+	tests := []struct {
+		label    string
+		password model.Password
+	}{
+		{"login", model.Password{
+			Id: "id", Key: "github", Type: model.ItemLogin, Pwd: "sealed password",
+			Username: "john", URIs: []string{"https://github.com"}, Notes: "sealed notes",
+			Fields:   []model.CustomField{{Name: "pin", Type: model.FieldHidden, Value: "sealed pin"}},
+			FolderId: "work", Tags: []string{"dev"},
+		}},
+		{"card", model.Password{
+			Id: "id", Key: "visa", Type: model.ItemCard,
+			Data: []model.ItemField{{Name: "number", Value: "sealed number"}},
+		}},
+		{"without slices", model.Password{Id: "id", Key: "empty", Pwd: "sealed password"}},
+	}
+
+	for _, test := range tests {
+		password := test.password
+		data := copyItemFields(password.Data)
+		fields := copyCustomFields(password.Fields)
+		uris := copyStrings(password.URIs)
+		version := newVersion(&password, "session")
+		if version.SessionId != "session" || len(version.Id) == 0 {
+			t.Fatalf("Wrong version of %v got %v %v\n", test.label, version.Id, version.SessionId)
+		}
+
+		// decrypting the password in place must not reach the version
+		for i := range password.Data {
+			password.Data[i].Value = "plain"
+		}
+		for i := range password.Fields {
+			password.Fields[i].Value = "plain"
+		}
+		for i := range password.URIs {
+			password.URIs[i] = "plain"
+		}
+		if !reflect.DeepEqual(version.Data, data) ||
+			!reflect.DeepEqual(version.Fields, fields) ||
+			!reflect.DeepEqual(version.URIs, uris) {
+			t.Fatalf("The version of %v should not share the slices of the password\n", test.label)
+		}
+
+		// the restored entry keeps the folder, the tags and the versions
+		current := model.Password{
+			Id: "id", Key: test.password.Key, Type: test.password.Type,
+			FolderId: "home", Tags: []string{"personal"}, Versions: []model.PasswordVersion{*version},
+		}
+		entry := versionEntry(&current, version)
+		if entry.Pwd != test.password.Pwd || entry.Notes != test.password.Notes || entry.Username != test.password.Username {
+			t.Fatalf("Wrong entry of %v got %v\n", test.label, entry)
+		}
+		if entry.FolderId != "home" || !reflect.DeepEqual(entry.Tags, current.Tags) || len(entry.Versions) != 1 {
+			t.Fatalf("The entry of %v should keep the current folder, tags and versions got %v\n", test.label, entry)
+		}
+		for i := range entry.Fields {
+			entry.Fields[i].Value = "plain"
+		}
+		for i := range entry.Data {
+			entry.Data[i].Value = "plain"
+		}
+		if !reflect.DeepEqual(version.Data, data) || !reflect.DeepEqual(version.Fields, fields) {
+			t.Fatalf("The entry of %v should not share the slices of the version\n", test.label)
+		}
+	}
+}
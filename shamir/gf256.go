@@ -0,0 +1,54 @@
+package shamir
+
+// log and exp tables of GF(2^8) with the AES polynomial
+// x^8 + x^4 + x^3 + x + 1 and 3 as generator
+var (
+	expTable [510]byte
+	logTable [256]byte
+)
+
+func init() {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		expTable[i] = x
+		expTable[i+255] = x
+		logTable[x] = byte(i)
+		x = mulNoTable(x, 3)
+	}
+}
+
+func add(a, b byte) byte {
+	return a ^ b
+}
+
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+int(logTable[b])]
+}
+
+// b must not be zero
+func div(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+255-int(logTable[b])]
+}
+
+// russian peasant multiplication, only used to build the tables
+func mulNoTable(a, b byte) byte {
+	result := byte(0)
+	for b > 0 {
+		if b&1 == 1 {
+			result ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return result
+}
@@ -0,0 +1,145 @@
+// Package shamir splits a secret in parts so that any threshold of them
+// rebuilds it while fewer reveal nothing. The arithmetic is done in
+// GF(2^8), each byte of the secret gets its own random polynomial
+package shamir
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+)
+
+var (
+	ErrInvalidParts     = errors.New("Parts must be between threshold and 255")
+	ErrInvalidThreshold = errors.New("Threshold must be between 2 and 255")
+	ErrEmptySecret      = errors.New("Secret can not be empty")
+	ErrNotEnoughParts   = errors.New("At least two parts are needed")
+	ErrInvalidPart      = errors.New("Parts must have the same size")
+	ErrDuplicatedPart   = errors.New("Duplicated part")
+)
+
+// each part is the polynomials evaluated at x followed by x itself
+const partOverhead = 1
+
+// Split returns parts shares of secret, any threshold of them rebuild it
+func Split(secret []byte, parts, threshold int) ([][]byte, error) {
+	if threshold < 2 || threshold > 255 {
+		return nil, ErrInvalidThreshold
+	}
+	if parts < threshold || parts > 255 {
+		return nil, ErrInvalidParts
+	}
+	if len(secret) == 0 {
+		return nil, ErrEmptySecret
+	}
+
+	xs, err := randomCoordinates(parts)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([][]byte, parts)
+	for i := range out {
+		out[i] = make([]byte, len(secret)+partOverhead)
+		out[i][len(secret)] = xs[i]
+	}
+
+	coefficients := make([]byte, threshold)
+	for idx, b := range secret {
+		coefficients[0] = b
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+		for i, x := range xs {
+			out[i][idx] = evaluate(coefficients, x)
+		}
+	}
+
+	return out, nil
+}
+
+// Combine rebuilds the secret from the parts. Given fewer parts than the
+// threshold it returns garbage, callers must verify the result
+func Combine(parts [][]byte) ([]byte, error) {
+	if len(parts) < 2 {
+		return nil, ErrNotEnoughParts
+	}
+	size := len(parts[0])
+	if size <= partOverhead {
+		return nil, ErrInvalidPart
+	}
+
+	xs := make([]byte, len(parts))
+	seen := make(map[byte]bool)
+	for i, part := range parts {
+		if len(part) != size {
+			return nil, ErrInvalidPart
+		}
+		x := part[size-1]
+		if seen[x] {
+			return nil, ErrDuplicatedPart
+		}
+		seen[x] = true
+		xs[i] = x
+	}
+
+	secret := make([]byte, size-partOverhead)
+	ys := make([]byte, len(parts))
+	for idx := range secret {
+		for i, part := range parts {
+			ys[i] = part[idx]
+		}
+		secret[idx] = interpolateAtZero(xs, ys)
+	}
+
+	return secret, nil
+}
+
+// Equal reports whether two parts are the same in constant time
+func Equal(a, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
+
+// returns n distinct non zero x coordinates
+func randomCoordinates(n int) ([]byte, error) {
+	// random permutation of 1..255
+	xs := make([]byte, 255)
+	for i := range xs {
+		xs[i] = byte(i + 1)
+	}
+	random := make([]byte, len(xs))
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	for i := len(xs) - 1; i > 0; i-- {
+		j := int(random[i]) % (i + 1)
+		xs[i], xs[j] = xs[j], xs[i]
+	}
+	return xs[:n], nil
+}
+
+// horner's method
+func evaluate(coefficients []byte, x byte) byte {
+	result := byte(0)
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		result = add(mul(result, x), coefficients[i])
+	}
+	return result
+}
+
+// lagrange interpolation of the polynomial at x = 0
+func interpolateAtZero(xs, ys []byte) byte {
+	result := byte(0)
+	for i := range xs {
+		basis := byte(1)
+		for j := range xs {
+			if i == j {
+				continue
+			}
+			// x_j / (x_j - x_i), subtraction is xor in GF(2^8)
+			basis = mul(basis, div(xs[j], add(xs[j], xs[i])))
+		}
+		result = add(result, mul(ys[i], basis))
+	}
+	return result
+}
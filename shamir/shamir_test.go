@@ -0,0 +1,68 @@
+package shamir
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSplitCombine(t *testing.T) {
+	secret := []byte("hold back the river let me look in your eyes")
+	parts, err := Split(secret, 5, 3)
+	if err != nil {
+		t.Fatalf("Err should when splitting be nil %v\n", err)
+	}
+
+	cases := []struct {
+		label string
+		parts [][]byte
+		equal bool
+	}{
+		{"Should combine with the threshold", [][]byte{parts[0], parts[2], parts[4]}, true},
+		{"Should combine with every part", parts, true},
+		{"Should combine in any order", [][]byte{parts[3], parts[1], parts[0]}, true},
+		{"Should not rebuild with fewer parts", [][]byte{parts[0], parts[1]}, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.label, func(t *testing.T) {
+			combined, err := Combine(tc.parts)
+			if err != nil {
+				t.Fatalf("Err should when combining be nil %v\n", err)
+			}
+			if bytes.Equal(combined, secret) != tc.equal {
+				t.Fatalf("Wrong output expected equal %v got %v\n", tc.equal, combined)
+			}
+		})
+	}
+}
+
+func TestCombineDuplicatedPart(t *testing.T) {
+	parts, err := Split([]byte("secret"), 3, 2)
+	if err != nil {
+		t.Fatalf("Err should when splitting be nil %v\n", err)
+	}
+	if _, err := Combine([][]byte{parts[0], parts[0]}); err != ErrDuplicatedPart {
+		t.Fatalf("Err should be %v got %v\n", ErrDuplicatedPart, err)
+	}
+}
+
+func TestSplitValidation(t *testing.T) {
+	cases := []struct {
+		label     string
+		parts     int
+		threshold int
+		expected  error
+	}{
+		{"Should fail with threshold 1", 3, 1, ErrInvalidThreshold},
+		{"Should fail with fewer parts than threshold", 2, 3, ErrInvalidParts},
+		{"Should fail with more than 255 parts", 256, 3, ErrInvalidParts},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.label, func(t *testing.T) {
+			if _, err := Split([]byte("secret"), tc.parts, tc.threshold); err != tc.expected {
+				t.Fatalf("Err should be %v got %v\n", tc.expected, err)
+			}
+		})
+	}
+}
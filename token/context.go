@@ -0,0 +1,25 @@
+package token
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrNoClaims = errors.New("No token claims in the context")
+)
+
+type claimsKey struct{}
+
+// NewContext returns ctx carrying the claims of the validated token
+func NewContext(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+func FromContext(ctx context.Context) (*Claims, error) {
+	claims, ok := ctx.Value(claimsKey{}).(*Claims)
+	if !ok || claims == nil {
+		return nil, ErrNoClaims
+	}
+	return claims, nil
+}
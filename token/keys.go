@@ -0,0 +1,235 @@
+package token
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+var (
+	ErrUnknownKid        = errors.New("Unknown token key id")
+	ErrUnsupportedKey    = errors.New("Unsupported signing key, use Ed25519 or RSA")
+	ErrNoActiveKey       = errors.New("JWT_ACTIVE_KID is not one of the signing keys")
+	ErrInvalidSigningKey = errors.New("Invalid signing key file")
+)
+
+const (
+	privateKeySuffix = ".pem"
+	publicKeySuffix  = ".pub.pem"
+)
+
+// SigningKey is one of the keys tokens are signed with. Keys without a
+// private part are retired, they only validate the tokens they signed
+// until those expire
+type SigningKey struct {
+	Kid     string
+	Method  jwt.SigningMethod
+	private crypto.Signer
+	public  crypto.PublicKey
+}
+
+// KeySet holds the token signing keys by kid
+type KeySet struct {
+	keys   map[string]*SigningKey
+	active *SigningKey
+}
+
+var (
+	keySetMu sync.RWMutex
+	keySet   *KeySet
+)
+
+// LoadKeys reads the signing keys from JWT_KEYS_DIR. Each private key is a
+// PKCS#8 pem file named <kid>.pem and each retired key a PKIX public key
+// named <kid>.pub.pem. JWT_ACTIVE_KID is the key new tokens are signed
+// with. Without JWT_KEYS_DIR tokens are signed with HS256 and JWT_KEY
+func LoadKeys() error {
+	dir := os.Getenv("JWT_KEYS_DIR")
+	if len(dir) == 0 {
+		setKeySet(nil)
+		return nil
+	}
+
+	ks, err := readKeySet(dir, os.Getenv("JWT_ACTIVE_KID"))
+	if err != nil {
+		return err
+	}
+	setKeySet(ks)
+	return nil
+}
+
+func readKeySet(dir, activeKid string) (*KeySet, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ks := &KeySet{keys: make(map[string]*SigningKey)}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, privateKeySuffix) {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		var key *SigningKey
+		if strings.HasSuffix(name, publicKeySuffix) {
+			key, err = parsePublicKey(strings.TrimSuffix(name, publicKeySuffix), content)
+		} else {
+			key, err = parsePrivateKey(strings.TrimSuffix(name, privateKeySuffix), content)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", name, err)
+		}
+		// a private key wins over the public file of the same kid
+		if previous, ok := ks.keys[key.Kid]; ok && previous.private != nil {
+			continue
+		}
+		ks.keys[key.Kid] = key
+	}
+
+	active, ok := ks.keys[activeKid]
+	if !ok || active.private == nil {
+		return nil, ErrNoActiveKey
+	}
+	ks.active = active
+
+	return ks, nil
+}
+
+func parsePrivateKey(kid string, content []byte) (*SigningKey, error) {
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, ErrInvalidSigningKey
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	switch private := parsed.(type) {
+	case ed25519.PrivateKey:
+		return &SigningKey{Kid: kid, Method: jwt.SigningMethodEdDSA, private: private, public: private.Public()}, nil
+	case *rsa.PrivateKey:
+		return &SigningKey{Kid: kid, Method: jwt.SigningMethodRS256, private: private, public: private.Public()}, nil
+	default:
+		return nil, ErrUnsupportedKey
+	}
+}
+
+func parsePublicKey(kid string, content []byte) (*SigningKey, error) {
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, ErrInvalidSigningKey
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	switch public := parsed.(type) {
+	case ed25519.PublicKey:
+		return &SigningKey{Kid: kid, Method: jwt.SigningMethodEdDSA, public: public}, nil
+	case *rsa.PublicKey:
+		return &SigningKey{Kid: kid, Method: jwt.SigningMethodRS256, public: public}, nil
+	default:
+		return nil, ErrUnsupportedKey
+	}
+}
+
+// GenerateKey writes a new Ed25519 private key named kid to dir. It only
+// becomes the signing key once JWT_ACTIVE_KID points to it
+func GenerateKey(dir, kid string) (string, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, kid+privateKeySuffix)
+	content := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := file.Write(content); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// JWK is the json web key representation of a public signing key
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// PublicKeys returns every key that validates tokens. It is empty while
+// tokens are signed with the shared JWT_KEY, which is never published
+func PublicKeys() JWKS {
+	ks := getKeySet()
+	jwks := JWKS{Keys: []JWK{}}
+	if ks == nil {
+		return jwks
+	}
+
+	for _, key := range ks.keys {
+		jwk := JWK{Kid: key.Kid, Alg: key.Method.Alg(), Use: "sig"}
+		switch public := key.public.(type) {
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+
+	return jwks
+}
+
+func setKeySet(ks *KeySet) {
+	keySetMu.Lock()
+	defer keySetMu.Unlock()
+	keySet = ks
+}
+
+func getKeySet() *KeySet {
+	keySetMu.RLock()
+	defer keySetMu.RUnlock()
+	return keySet
+}
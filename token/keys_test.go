@@ -0,0 +1,110 @@
+package token
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("JWT_KEYS_DIR", dir)
+	t.Setenv("JWT_KEY", "")
+	if _, err := GenerateKey(dir, "k1"); err != nil {
+		t.Fatalf("Err should when generating a key be nil %v\n", err)
+	}
+	t.Setenv("JWT_ACTIVE_KID", "k1")
+	if err := LoadKeys(); err != nil {
+		t.Fatalf("Err should when loading the keys be nil %v\n", err)
+	}
+	defer setKeySet(nil)
+
+	oldToken, err := GetToken("master-id", "session-id", 0)
+	if err != nil {
+		t.Fatalf("Err should when getting a token be nil %v\n", err)
+	}
+
+	// k1 is retired, only its public key is kept
+	retirePrivateKey(t, dir, "k1")
+	if _, err := GenerateKey(dir, "k2"); err != nil {
+		t.Fatalf("Err should when generating a key be nil %v\n", err)
+	}
+	t.Setenv("JWT_ACTIVE_KID", "k2")
+	if err := LoadKeys(); err != nil {
+		t.Fatalf("Err should when loading the keys be nil %v\n", err)
+	}
+
+	claims, err := ValidateAccessToken(oldToken.AccessToken)
+	if err != nil {
+		t.Fatalf("Token signed by a retired key should be valid %v\n", err)
+	}
+	if claims.MasterId != "master-id" {
+		t.Fatalf("Wrong master id expected %v got %v\n", "master-id", claims.MasterId)
+	}
+
+	newToken, err := GetToken("master-id", "session-id", 0)
+	if err != nil {
+		t.Fatalf("Err should when getting a token be nil %v\n", err)
+	}
+	parsed, _, _ := new(jwt.Parser).ParseUnverified(newToken.AccessToken, &Claims{})
+	if parsed.Header["kid"] != "k2" {
+		t.Fatalf("New tokens should be signed by the active key, got %v\n", parsed.Header["kid"])
+	}
+
+	if jwks := PublicKeys(); len(jwks.Keys) != 2 {
+		t.Fatalf("Both keys should be published, got %v\n", jwks.Keys)
+	}
+}
+
+func TestRejectsAlgorithmConfusion(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("JWT_KEYS_DIR", dir)
+	t.Setenv("JWT_ACTIVE_KID", "k1")
+	t.Setenv("JWT_KEY", "")
+	if _, err := GenerateKey(dir, "k1"); err != nil {
+		t.Fatalf("Err should when generating a key be nil %v\n", err)
+	}
+	if err := LoadKeys(); err != nil {
+		t.Fatalf("Err should when loading the keys be nil %v\n", err)
+	}
+	defer setKeySet(nil)
+
+	// an HS256 token claiming the kid of the Ed25519 key
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{MasterId: "master-id", TokenType: AccessTokenType})
+	token.Header["kid"] = "k1"
+	tokenStr, err := token.SignedString([]byte("guessed"))
+	if err != nil {
+		t.Fatalf("Err should when signing be nil %v\n", err)
+	}
+
+	if _, err := ValidateAccessToken(tokenStr); err == nil {
+		t.Fatalf("Token signed with another algorithm should be rejected\n")
+	}
+}
+
+// replaces the private key file of kid by its public key
+func retirePrivateKey(t *testing.T, dir, kid string) {
+	content, err := os.ReadFile(filepath.Join(dir, kid+privateKeySuffix))
+	if err != nil {
+		t.Fatalf("Err should when reading the key be nil %v\n", err)
+	}
+	key, err := parsePrivateKey(kid, content)
+	if err != nil {
+		t.Fatalf("Err should when parsing the key be nil %v\n", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(key.public)
+	if err != nil {
+		t.Fatalf("Err should when marshaling the key be nil %v\n", err)
+	}
+	public := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, kid+publicKeySuffix), public, 0600); err != nil {
+		t.Fatalf("Err should when writing the key be nil %v\n", err)
+	}
+	if err := os.Remove(filepath.Join(dir, kid+privateKeySuffix)); err != nil {
+		t.Fatalf("Err should when removing the key be nil %v\n", err)
+	}
+}
@@ -0,0 +1,70 @@
+package token
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/danilomarques1/secretumserver/model"
+)
+
+var ErrTokenRevoked = errors.New("Token revoked")
+
+var (
+	revocationMu    sync.RWMutex
+	revocationStore model.RevocationRepository
+)
+
+// SetRevocationStore sets the store ValidateAccessToken consults. Without
+// one tokens are valid until they expire
+func SetRevocationStore(store model.RevocationRepository) {
+	revocationMu.Lock()
+	defer revocationMu.Unlock()
+	revocationStore = store
+}
+
+func getRevocationStore() model.RevocationRepository {
+	revocationMu.RLock()
+	defer revocationMu.RUnlock()
+	return revocationStore
+}
+
+// Revoke revokes the access token of the claims until it expires
+func Revoke(claims *Claims) error {
+	store := getRevocationStore()
+	if store == nil || len(claims.Id) == 0 {
+		return nil
+	}
+	return store.Revoke(claims.Id, time.Unix(claims.ExpiresAt, 0))
+}
+
+// RevokeAll revokes every access token of the master issued with a token
+// generation older than generation, the one the master was just moved to.
+// The entry lives as long as the newest of those tokens
+func RevokeAll(masterId string, generation int64) error {
+	store := getRevocationStore()
+	if store == nil {
+		return nil
+	}
+	expiresAt := time.Now().Add(AccessTokenExpiresIn * time.Second)
+	return store.RevokeAllByMasterId(masterId, generation, expiresAt)
+}
+
+// RevokeSession revokes every access token issued to the session so far.
+// The session itself can not issue new ones anymore
+func RevokeSession(sessionId string) error {
+	store := getRevocationStore()
+	if store == nil || len(sessionId) == 0 {
+		return nil
+	}
+	expiresAt := time.Now().Add(AccessTokenExpiresIn * time.Second)
+	return store.RevokeSession(sessionId, expiresAt)
+}
+
+func isRevoked(claims *Claims) (bool, error) {
+	store := getRevocationStore()
+	if store == nil {
+		return false, nil
+	}
+	return store.IsRevoked(claims.Id, claims.SessionId, claims.MasterId, claims.Generation)
+}
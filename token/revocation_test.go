@@ -0,0 +1,67 @@
+package token
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/danilomarques1/secretumserver/repository"
+)
+
+func TestRevocation(t *testing.T) {
+	t.Setenv("JWT_KEY", "revocation-test-key")
+	SetRevocationStore(repository.NewRevocationRepositoryMemory())
+	defer SetRevocationStore(nil)
+
+	first, err := GetToken("master-id", "first-session", 0)
+	if err != nil {
+		t.Fatalf("Err should when getting a token be nil %v\n", err)
+	}
+	second, err := GetToken("master-id", "second-session", 0)
+	if err != nil {
+		t.Fatalf("Err should when getting a token be nil %v\n", err)
+	}
+
+	claims, err := ValidateAccessToken(first.AccessToken)
+	if err != nil {
+		t.Fatalf("Err should when validating the token be nil %v\n", err)
+	}
+	if err := Revoke(claims); err != nil {
+		t.Fatalf("Err should when revoking the token be nil %v\n", err)
+	}
+	if _, err := ValidateAccessToken(first.AccessToken); !errors.Is(err, ErrTokenRevoked) {
+		t.Fatalf("Err should be %v got %v\n", ErrTokenRevoked, err)
+	}
+	if _, err := ValidateAccessToken(second.AccessToken); err != nil {
+		t.Fatalf("Other tokens should still be valid %v\n", err)
+	}
+
+	third, err := GetToken("master-id", "third-session", 0)
+	if err != nil {
+		t.Fatalf("Err should when getting a token be nil %v\n", err)
+	}
+	if err := RevokeSession("second-session"); err != nil {
+		t.Fatalf("Err should when revoking the session be nil %v\n", err)
+	}
+	if _, err := ValidateAccessToken(second.AccessToken); !errors.Is(err, ErrTokenRevoked) {
+		t.Fatalf("Err should be %v got %v\n", ErrTokenRevoked, err)
+	}
+	if _, err := ValidateAccessToken(third.AccessToken); err != nil {
+		t.Fatalf("Tokens of other sessions should still be valid %v\n", err)
+	}
+
+	if err := RevokeAll("master-id", 1); err != nil {
+		t.Fatalf("Err should when revoking all tokens be nil %v\n", err)
+	}
+	if _, err := ValidateAccessToken(third.AccessToken); !errors.Is(err, ErrTokenRevoked) {
+		t.Fatalf("Err should be %v got %v\n", ErrTokenRevoked, err)
+	}
+
+	// issued in the same second as the revocation, with the new generation
+	fourth, err := GetToken("master-id", "fourth-session", 1)
+	if err != nil {
+		t.Fatalf("Err should when getting a token be nil %v\n", err)
+	}
+	if _, err := ValidateAccessToken(fourth.AccessToken); err != nil {
+		t.Fatalf("Tokens of the new generation should be valid %v\n", err)
+	}
+}
@@ -6,36 +6,53 @@ import (
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
 )
 
 const (
 	RefreshTokenType = iota
 	AccessTokenType
+	ChallengeTokenType    // proves the password was checked, the second factor is still missing
+	VerificationTokenType // proves the master received an email
 )
 
 type Claims struct {
-	MasterId  string
-	TokenType uint
+	MasterId   string
+	SessionId  string
+	Email      string `json:",omitempty"` // the address an email token was sent to
+	Generation int64  `json:",omitempty"` // the master token generation, see RevokeAll
+	TokenType  uint
 	jwt.StandardClaims
 }
 
 const (
-	AccessTokenExpiresIn  = 3600   // an hour in seconds
-	RefreshTokenExpiresIn = 604800 // a week in seconds
+	AccessTokenExpiresIn       = 3600   // an hour in seconds
+	RefreshTokenExpiresIn      = 604800 // a week in seconds
+	ChallengeTokenExpiresIn    = 300    // five minutes in seconds
+	VerificationTokenExpiresIn = 86400  // a day in seconds
 )
 
 type TokenResponse struct {
-	AccessToken  string
-	RefreshToken string
-	ExpiresIn    int32 // how long in seconds the AccessToken will still be valid
+	AccessToken      string
+	RefreshToken     string
+	ExpiresIn        int32  // how long in seconds the AccessToken will still be valid
+	RefreshTokenId   string // the jti of the refresh token
+	RefreshExpiresAt time.Time
 }
 
-func GetToken(masterId string) (*TokenResponse, error) {
+// GetToken returns the token pair of a session. The refresh token gets a
+// new jti every time, the session only accepts the latest one
+func GetToken(masterId, sessionId string, generation int64) (*TokenResponse, error) {
+	now := time.Now()
 	accessTokenClaims := &Claims{
-		MasterId:  masterId,
-		TokenType: AccessTokenType,
+		MasterId:   masterId,
+		SessionId:  sessionId,
+		Generation: generation,
+		TokenType:  AccessTokenType,
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Unix() + AccessTokenExpiresIn,
+			Id:        uuid.NewString(),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Unix() + AccessTokenExpiresIn,
 		},
 	}
 	accessToken, err := generateToken(accessTokenClaims)
@@ -43,11 +60,15 @@ func GetToken(masterId string) (*TokenResponse, error) {
 		return nil, err
 	}
 
+	refreshExpiresAt := now.Add(RefreshTokenExpiresIn * time.Second)
 	refreshTokenClaims := &Claims{
 		MasterId:  masterId,
+		SessionId: sessionId,
 		TokenType: RefreshTokenType,
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Unix() + RefreshTokenExpiresIn,
+			Id:        uuid.NewString(),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: refreshExpiresAt.Unix(),
 		},
 	}
 	refreshToken, err := generateToken(refreshTokenClaims)
@@ -56,16 +77,59 @@ func GetToken(masterId string) (*TokenResponse, error) {
 	}
 
 	return &TokenResponse{
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
-		ExpiresIn:    AccessTokenExpiresIn,
+		AccessToken:      accessToken,
+		RefreshToken:     refreshToken,
+		ExpiresIn:        AccessTokenExpiresIn,
+		RefreshTokenId:   refreshTokenClaims.Id,
+		RefreshExpiresAt: refreshExpiresAt,
 	}, nil
 }
 
+// GetChallengeToken returns the token a master exchanges, together with a
+// second factor, for the token pair
+func GetChallengeToken(masterId string, generation int64) (string, error) {
+	now := time.Now()
+	claims := &Claims{
+		MasterId:   masterId,
+		Generation: generation,
+		TokenType:  ChallengeTokenType,
+		StandardClaims: jwt.StandardClaims{
+			Id:        uuid.NewString(),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Unix() + ChallengeTokenExpiresIn,
+		},
+	}
+	return generateToken(claims)
+}
+
+// GetVerificationToken returns the token mailed to an address to prove the
+// master owns it
+func GetVerificationToken(masterId, email string) (string, error) {
+	now := time.Now()
+	claims := &Claims{
+		MasterId:  masterId,
+		Email:     email,
+		TokenType: VerificationTokenType,
+		StandardClaims: jwt.StandardClaims{
+			Id:        uuid.NewString(),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Unix() + VerificationTokenExpiresIn,
+		},
+	}
+	return generateToken(claims)
+}
+
+// signs with the active key and records its kid in the header
 func generateToken(claims *Claims) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	key := []byte(os.Getenv("JWT_KEY"))
-	tokenStr, err := token.SignedString(key)
+	ks := getKeySet()
+	if ks == nil {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		return token.SignedString([]byte(os.Getenv("JWT_KEY")))
+	}
+
+	token := jwt.NewWithClaims(ks.active.Method, claims)
+	token.Header["kid"] = ks.active.Kid
+	tokenStr, err := token.SignedString(ks.active.private)
 	if err != nil {
 		return "", err
 	}
@@ -82,9 +146,31 @@ func ValidateAccessToken(tokenStr string) (*Claims, error) {
 		return nil, errors.New("Invalid toke type")
 	}
 
+	revoked, err := isRevoked(claims)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrTokenRevoked
+	}
+
 	return claims, nil
 }
 
+// MasterIdOf returns the master of a signed access token without checking
+// whether it was revoked, which needs the database. Only meant to tell the
+// clients apart before the token is validated
+func MasterIdOf(tokenStr string) (string, error) {
+	claims, err := validateToken(tokenStr)
+	if err != nil {
+		return "", err
+	}
+	if claims.TokenType != AccessTokenType {
+		return "", errors.New("Invalid toke type")
+	}
+	return claims.MasterId, nil
+}
+
 func ValidateRefreshToken(tokenStr string) (*Claims, error) {
 	claims, err := validateToken(tokenStr)
 	if err != nil {
@@ -98,14 +184,72 @@ func ValidateRefreshToken(tokenStr string) (*Claims, error) {
 	return claims, nil
 }
 
+// ValidateChallengeToken also consults the revocation store, a challenge
+// is revoked once it is used
+func ValidateChallengeToken(tokenStr string) (*Claims, error) {
+	claims, err := validateToken(tokenStr)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.TokenType != ChallengeTokenType {
+		return nil, errors.New("Invalid toke type")
+	}
+
+	revoked, err := isRevoked(claims)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrTokenRevoked
+	}
+
+	return claims, nil
+}
+
+func ValidateVerificationToken(tokenStr string) (*Claims, error) {
+	claims, err := validateToken(tokenStr)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.TokenType != VerificationTokenType {
+		return nil, errors.New("Invalid toke type")
+	}
+
+	return claims, nil
+}
+
 func validateToken(tokenStr string) (*Claims, error) {
 	claims := &Claims{}
-	_, err := jwt.ParseWithClaims(tokenStr, claims, func(t *jwt.Token) (any, error) {
-		return []byte(os.Getenv("JWT_KEY")), nil
-	})
+	_, err := jwt.ParseWithClaims(tokenStr, claims, verificationKey)
 	if err != nil {
 		return nil, err
 	}
 
 	return claims, nil
 }
+
+// tokens with a kid are verified with that key and its algorithm only.
+// Tokens without one were signed with JWT_KEY, they are accepted while it
+// is still set
+func verificationKey(t *jwt.Token) (any, error) {
+	kid, ok := t.Header["kid"].(string)
+	if !ok {
+		key := os.Getenv("JWT_KEY")
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok || len(key) == 0 {
+			return nil, ErrUnknownKid
+		}
+		return []byte(key), nil
+	}
+
+	ks := getKeySet()
+	if ks == nil {
+		return nil, ErrUnknownKid
+	}
+	key, ok := ks.keys[kid]
+	if !ok || key.Method.Alg() != t.Method.Alg() {
+		return nil, ErrUnknownKid
+	}
+	return key.public, nil
+}
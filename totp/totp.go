@@ -0,0 +1,119 @@
+// Package totp implements the time based one time passwords of RFC 6238
+// with the parameters every authenticator app supports: HMAC-SHA1, six
+// digits and a thirty seconds step
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	Digits     = 6
+	Period     = 30 // seconds
+	SecretSize = 20 // bytes, the size of a sha1 output
+	// how many steps before and after the current one are accepted, so
+	// clocks slightly out of sync still work
+	Skew = 1
+)
+
+var (
+	ErrInvalidSecret = errors.New("Invalid totp secret")
+	ErrInvalidCode   = errors.New("Invalid totp code")
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a random secret encoded in base32, the format the
+// authenticator apps expect
+func GenerateSecret() (string, error) {
+	secret := make([]byte, SecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(secret), nil
+}
+
+// Step returns the time step t falls in
+func Step(t time.Time) int64 {
+	return t.Unix() / Period
+}
+
+// Code returns the code of the step
+func Code(secret string, step int64) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return generate(key, step), nil
+}
+
+// Validate checks the code against the steps around t and returns the step
+// it matched. Callers should reject steps that were already used so a
+// code can not be replayed
+func Validate(secret, code string, t time.Time) (int64, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return 0, err
+	}
+	code = strings.TrimSpace(code)
+	if len(code) != Digits {
+		return 0, ErrInvalidCode
+	}
+
+	current := Step(t)
+	for step := current - Skew; step <= current+Skew; step++ {
+		if subtle.ConstantTimeCompare([]byte(generate(key, step)), []byte(code)) == 1 {
+			return step, nil
+		}
+	}
+	return 0, ErrInvalidCode
+}
+
+// ProvisioningURI returns the otpauth uri authenticator apps read from a
+// qr code
+func ProvisioningURI(issuer, account, secret string) string {
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", issuer)
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", fmt.Sprint(Digits))
+	values.Set("period", fmt.Sprint(Period))
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + values.Encode()
+}
+
+func decodeSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.TrimRight(strings.ReplaceAll(secret, " ", ""), "="))
+	key, err := encoding.DecodeString(secret)
+	if err != nil || len(key) == 0 {
+		return nil, ErrInvalidSecret
+	}
+	return key, nil
+}
+
+// the dynamic truncation of RFC 4226
+func generate(key []byte, step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < Digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", Digits, value%mod)
+}
@@ -0,0 +1,58 @@
+package totp
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+// the sha1 vectors of RFC 6238 appendix B, keeping the last six digits
+func TestCode(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	tests := []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, test := range tests {
+		code, err := Code(secret, Step(time.Unix(test.time, 0)))
+		if err != nil {
+			t.Fatalf("Err should when generating a code be nil %v\n", err)
+		}
+		if code != test.code {
+			t.Fatalf("Wrong code at %v expected %v got %v\n", test.time, test.code, code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("Err should when generating a secret be nil %v\n", err)
+	}
+	now := time.Now()
+	previous, err := Code(secret, Step(now)-1)
+	if err != nil {
+		t.Fatalf("Err should when generating a code be nil %v\n", err)
+	}
+
+	step, err := Validate(secret, previous, now)
+	if err != nil {
+		t.Fatalf("Err should when validating a code of the previous step be nil %v\n", err)
+	}
+	if step != Step(now)-1 {
+		t.Fatalf("Wrong step expected %v got %v\n", Step(now)-1, step)
+	}
+
+	old, _ := Code(secret, Step(now)-5)
+	if _, err := Validate(secret, old, now); err != ErrInvalidCode {
+		t.Fatalf("Err should be %v got %v\n", ErrInvalidCode, err)
+	}
+}